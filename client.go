@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
+	"github.com/dustin/go-humanize"
+)
+
+// client generates load against one or more target instances and prints the
+// report, returns the exit code: 0 if all the requests succeeded, 1 otherwise
+// (2 for usage errors).
+func client(args []string) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	targets := fs.String("target", "",
+		"Comma separated base `URLs` of the target instances (like http://10.1.0.2:8080), requests are sent round-robin.")
+	mix := fs.String("mix", "get",
+		"The request `mix` with relative weights, like get=5,upload=1,download=2.")
+	concurrency := fs.Int("concurrency", 1,
+		"Number of concurrent workers.")
+	rate := fs.Float64("rate", 0,
+		"Maximum number of requests per second (of all the workers together), 0 means unlimited.")
+	duration := fs.Duration("duration", 10*time.Second,
+		"How long to generate load, 0 means until interrupted (or until -requests requests were made).")
+	requests := fs.Int("requests", 0,
+		"Maximum number of requests, 0 means unlimited.")
+	getPath := fs.String("get-path", "/",
+		"The `path` requested by the get requests.")
+	uploadSize := fs.String("upload-size", "1MB",
+		"The `size` of the content uploaded by the upload requests.")
+	downloadSize := fs.String("download-size", "1MB",
+		"The `size` of the content downloaded by the download requests.")
+	username := fs.String("username", os.Getenv("HELLO_USERNAME"),
+		"Username for HTTP basic authentication (needed for uploads and downloads). Defaults to the HELLO_USERNAME environment variable.")
+	password := fs.String("password", os.Getenv("HELLO_PASSWORD"),
+		"Password for HTTP basic authentication. Defaults to the HELLO_PASSWORD environment variable.")
+	insecure := fs.Bool("insecure", false,
+		"Don't verify the certificates of the targets.")
+	timeout := fs.Duration("timeout", 30*time.Second,
+		"Timeout of each request.")
+	jsonOutput := fs.Bool("json", false,
+		"Print the report as JSON.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	config := loadgen.Config{
+		Mix:         *mix,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Duration:    *duration,
+		Requests:    *requests,
+		GetPath:     *getPath,
+		Username:    *username,
+		Password:    *password,
+		Insecure:    *insecure,
+		Timeout:     *timeout,
+	}
+	for _, t := range strings.Split(*targets, ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			config.Targets = append(config.Targets, t)
+		}
+	}
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"upload-size", *uploadSize, &config.UploadSize},
+		{"download-size", *downloadSize, &config.DownloadSize},
+	} {
+		x, err := humanize.ParseBytes(s.value)
+		if err != nil || x > 1<<40 {
+			fmt.Fprintf(os.Stderr, "%s: invalid -%s\n", s.value, s.name)
+			return 2
+		}
+		*s.dst = int64(x)
+	}
+
+	// Stop on SIGINT/SIGTERM and still print the report.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runner, err := loadgen.Start(ctx, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	<-runner.Done()
+
+	report := runner.Report()
+	if *jsonOutput {
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+
+	if report.Errors > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// probeAddr converts the listen address of the server to an address which
+// can be used to connect to it: an empty or unspecified host (like `:8080` or
+// `0.0.0.0:8080`) becomes the loopback address.
+func probeAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid address: %w", listen, err)
+	}
+
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// readAddrFile returns the address of the listener `index` (its line) from an
+// address file written by the server (see -addr-file).
+func readAddrFile(path string, index int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read address file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	for i := 0; sc.Scan(); i++ {
+		if i == index {
+			return strings.TrimSpace(sc.Text()), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: no address for listener %d in the address file", path, index+1)
+}
+
+// isLoopback returns true if the host of the `host:port` address is a
+// loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// healthcheck probes the health endpoint of a running server and returns the
+// exit code: 0 if healthy, 1 otherwise (2 for usage errors).
+func healthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("HELLO_CONFIG"),
+		"The configuration `file` of the server, read with the environment variables like by serve to find"+
+			" the listener serving the health endpoints. Defaults to the HELLO_CONFIG environment variable.")
+	addr := fs.String("addr", "",
+		"The `host:port` of the server, an empty or unspecified host means the loopback address."+
+			" Defaults to the first listener of the server configuration serving the health endpoints.")
+	addrFile := fs.String("addr-file", "",
+		"Read the address from the address `file` written by the server instead of -addr"+
+			" (default: the addr_file setting of the server configuration).")
+	unixSocket := fs.String("unix", "",
+		"Connect to the Unix socket at `path` instead of TCP.")
+	probe := fs.String("probe", "healthz",
+		"The `probe` to check: healthz, readyz or startupz.")
+	useTLS := fs.Bool("tls", false,
+		"Use HTTPS. Defaults to whether the listener of the server configuration serves HTTPS.")
+	insecure := fs.Bool("insecure", false,
+		"Don't verify the server certificate. It's never verified for a loopback address without -ca or -server-name.")
+	caFile := fs.String("ca", "",
+		"PEM bundle `file` of CA certificates used to verify the server certificate (default: the system ones).")
+	serverName := fs.String("server-name", "",
+		"The `name` expected in the server certificate (default: the host of -addr).")
+	certFile := fs.String("cert", "",
+		"PEM encoded client certificate `file`, for mTLS authentication.")
+	keyFile := fs.String("key", "",
+		"PEM encoded private key `file` for -cert.")
+	username := fs.String("username", "",
+		"Username for HTTP basic authentication. Defaults to the one of the server configuration.")
+	password := fs.String("password", "",
+		"Password for HTTP basic authentication. Defaults to the one of the server configuration.")
+	timeout := fs.Duration("timeout", 5*time.Second,
+		"Timeout of the health check request.")
+	verbose := fs.Bool("v", false,
+		"Print the response of the health endpoint.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch *probe {
+	case "healthz", "readyz", "startupz":
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown probe (expected one of healthz, readyz, startupz)\n", *probe)
+		return 2
+	}
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	// The listener is found like serve does, from the defaults, the
+	// configuration file and the environment variables.
+	config, err := loadConfig(*configPath, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 2
+	}
+	listener, err := config.HealthListener()
+	if err != nil && !setFlags["addr"] && !setFlags["addr-file"] && !setFlags["unix"] {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if !setFlags["tls"] {
+		*useTLS = listener.TLS
+	}
+	if !setFlags["username"] && !setFlags["password"] {
+		*username, *password = config.Username, config.Password
+	}
+	if !setFlags["addr"] && !setFlags["addr-file"] && !setFlags["unix"] {
+		switch {
+		case len(config.AddrFile) > 0:
+			*addrFile = config.AddrFile
+		case listener.Network == "unix":
+			*unixSocket = listener.Address
+		default:
+			*addr = listener.Address
+		}
+	}
+
+	transport := &http.Transport{}
+	host := "localhost"
+	if len(*unixSocket) > 0 {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *unixSocket)
+		}
+	} else {
+		listen := *addr
+		if len(*addrFile) > 0 {
+			a, err := readAddrFile(*addrFile, listener.Index)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			listen = a
+		}
+		if strings.HasPrefix(listen, "/") {
+			// A Unix socket in the address file.
+			socket := listen
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			}
+		} else {
+			a, err := probeAddr(listen)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 2
+			}
+			host = a
+		}
+	}
+
+	scheme := "http"
+	if *useTLS {
+		scheme = "https"
+		// The certificate of the server rarely covers the loopback address
+		// (or the name of a Unix socket), which is probed from the same
+		// host or container anyway.
+		local := len(*unixSocket) > 0 || host == "localhost" || isLoopback(host)
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: *insecure || (local && len(*caFile) == 0 && len(*serverName) == 0),
+			ServerName:         *serverName,
+		}
+		if len(*caFile) > 0 {
+			pem, err := os.ReadFile(*caFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read CA bundle: %v\n", err)
+				return 2
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				fmt.Fprintf(os.Stderr, "%s: no valid certificates found in CA bundle\n", *caFile)
+				return 2
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if len(*certFile) > 0 || len(*keyFile) > 0 {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load client certificate: %v\n", err)
+				return 2
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s://%s/_/%s", scheme, host, *probe)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	// A $RANDOM username (the server default) is of no use here.
+	if len(*username) > 0 && !strings.EqualFold(*username, "$RANDOM") {
+		req.SetBasicAuth(*username, *password)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+		return 1
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Health check failed: %s %s\n%s", url, resp.Status, body)
+		return 1
+	}
+	if *verbose {
+		fmt.Printf("%s", body)
+	}
+
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	_ "embed"
 	"encoding/base64"
@@ -8,7 +9,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/andrei-zededa/hello-zedcloud/pkg/server"
 )
@@ -32,71 +35,232 @@ func quickID(length int) string {
 	return base64.URLEncoding.EncodeToString(bytes)
 }
 
-// getEnvOrDefault returns the value of the environment variable if it exists,
-// (including if it exists but set to an empty value), otherwise returns the
-// default value.
-func getEnvOrDefault(envVar, def string) string {
-	if v, ok := os.LookupEnv(envVar); ok {
-		return v
+// setting is a server configuration setting which can be set from (in order
+// of precedence) a CLI flag, an environment variable or the config file.
+type setting struct {
+	flag  string
+	env   string
+	def   string
+	usage string
+	field func(c *server.Config) *string
+}
+
+// settings are all the server configuration settings.
+var settings = []setting{
+	{"listen", "HELLO_LISTEN", ":8080",
+		"The address (`host:port`) on which the server should listen to.",
+		func(c *server.Config) *string { return &c.Listen }},
+	{"listeners", "HELLO_LISTENERS", "",
+		"Several listeners instead of -listen, a `list` separated by ; of comma separated key=value settings:" +
+			" addr, name, network (tcp, tcp4, tcp6, unix), tls, h2c, http3, bw_limit and endpoints (+ separated groups static, public, admin, all or /path prefixes)." +
+			" For example: name=public,addr=:8080,endpoints=static;name=mgmt,addr=127.0.0.1:9090,endpoints=admin+public.",
+		func(c *server.Config) *string { return &c.Listeners }},
+	{"addr-file", "HELLO_ADDR_FILE", "",
+		"Optional `file` to which the addresses the server listens on are written once listening, one per line." +
+			" Useful with -listen :0 (ephemeral port), for test harnesses and sidecar scripts.",
+		func(c *server.Config) *string { return &c.AddrFile }},
+	{"static", "HELLO_STATIC", "./static",
+		"The directory from which to serve static files.",
+		func(c *server.Config) *string { return &c.StaticDir }},
+	{"bw-limit", "HELLO_BW_LIMIT", "2GB",
+		"Limit the read and write bandwidth (each, not combined) of the entire server." +
+			" A string like `2m, 2mb, 2M or 2MB all meaning 2 megabytes per second`.",
+		func(c *server.Config) *string { return &c.BwLimit }},
+	{"username", "HELLO_USERNAME", "$RANDOM",
+		"Username for HTTP basic authentication." +
+			" Default: $RANDOM, meaning that a random username is generated." +
+			" Set to an empty string to disable authentication.",
+		func(c *server.Config) *string { return &c.Username }},
+	{"password", "HELLO_PASSWORD", "$RANDOM",
+		"Password for HTTP basic authentication." +
+			" Default: $RANDOM, meaning that a random password is generated.",
+		func(c *server.Config) *string { return &c.Password }},
+	{"tls-cert", "HELLO_TLS_CERT", "",
+		"PEM encoded certificate `file` used to serve HTTPS." +
+			" TLS is enabled only if both -tls-cert and -tls-key are set.",
+		func(c *server.Config) *string { return &c.TLSCertFile }},
+	{"tls-key", "HELLO_TLS_KEY", "",
+		"PEM encoded private key `file` for -tls-cert.",
+		func(c *server.Config) *string { return &c.TLSKeyFile }},
+	{"client-ca", "HELLO_CLIENT_CA", "",
+		"PEM bundle `file` of CA certificates used to verify TLS client certificates." +
+			" Requires TLS to be enabled.",
+		func(c *server.Config) *string { return &c.ClientCAFile }},
+	{"client-cert-users", "HELLO_CLIENT_CERT_USERS", "",
+		"Map client certificate identities to usernames," +
+			" a `list` like cn:device-1=alice,dns:node1.example.com=bob (kinds: cn, dns, email, uri)." +
+			" If empty, the certificate subject common name is used as the username.",
+		func(c *server.Config) *string { return &c.ClientCertUsers }},
+	{"auth-mode", "HELLO_AUTH_MODE", "basic",
+		"Default authentication `mode` of the /_/ endpoints: none, basic, mtls or either.",
+		func(c *server.Config) *string { return &c.AuthMode }},
+	{"endpoint-auth", "HELLO_ENDPOINT_AUTH", "",
+		"Per-endpoint authentication mode overrides," +
+			" a `list` like /_/crash=mtls,/_/logs=either.",
+		func(c *server.Config) *string { return &c.EndpointAuth }},
+	{"trusted-proxies", "HELLO_TRUSTED_PROXIES", "",
+		"Comma separated `list` of CIDRs (or addresses) of trusted proxies." +
+			" Client address headers (Forwarded, X-Forwarded-For, X-Real-IP, Fly-Client-IP) are only used for requests coming from these.",
+		func(c *server.Config) *string { return &c.TrustedProxies }},
+	{"rate-limit", "HELLO_RATE_LIMIT", "",
+		"Request rate limit of each client (authenticated user or client IP)," +
+			" a `rate` like 10/s, 100/m or 10/s:20 (with a burst of 20). Empty disables rate limiting.",
+		func(c *server.Config) *string { return &c.RateLimit }},
+	{"rate-limits", "HELLO_RATE_LIMITS", "",
+		"Per path prefix request rate limits which take precedence over -rate-limit," +
+			" a `list` like /_/alloc=1/s:2,/_/upload=10/m.",
+		func(c *server.Config) *string { return &c.RateLimits }},
+	{"log-level", "HELLO_LOG_LEVEL", "debug",
+		"Minimum `level` of the log messages written to stderr: debug, info, warn or error.",
+		func(c *server.Config) *string { return &c.LogLevel }},
+	{"on-panic", "HELLO_ON_PANIC", "recover",
+		"What to do when a request handler panics: `recover` (log the panic and return a 500 response)" +
+			" or crash (exit the process, for example to test the restart policy of the app instance).",
+		func(c *server.Config) *string { return &c.OnPanic }},
+	{"health-min-free-disk", "HELLO_HEALTH_MIN_FREE_DISK", "",
+		"Minimum free disk `size` of the static directory filesystem, below which /_/readyz fails. Empty disables the check.",
+		func(c *server.Config) *string { return &c.HealthMinFreeDisk }},
+	{"health-max-memory", "HELLO_HEALTH_MAX_MEMORY", "",
+		"Maximum Go runtime memory `size`, above which /_/healthz fails. Empty disables the check.",
+		func(c *server.Config) *string { return &c.HealthMaxMemory }},
+	{"alloc-limit", "HELLO_ALLOC_LIMIT", "1GB",
+		"Maximum total `size` of the memory allocations made with /_/alloc, beyond which allocations are refused unless forced (force=true)." +
+			" Empty disables the limit.",
+		func(c *server.Config) *string { return &c.AllocLimit }},
+	{"disk-dir", "HELLO_DISK_DIR", "",
+		"The `directory` in which the /_/disk jobs write their files (default: _/disk in the static directory).",
+		func(c *server.Config) *string { return &c.DiskDir }},
+	{"crash-file", "HELLO_CRASH_FILE", "",
+		"The `file` in which the crashes scheduled with /_/crash for the next starts are persisted" +
+			" (default: hello-zedcloud-crash.json in the temporary directory).",
+		func(c *server.Config) *string { return &c.CrashFile }},
+	{"scenario", "HELLO_SCENARIO", "",
+		"Scenario `file` (or inline YAML or JSON scenario) of fault steps run once the server is started, see /_/scenario.",
+		func(c *server.Config) *string { return &c.Scenario }},
+	{"peers", "HELLO_PEERS", "",
+		"Comma separated `list` of peer instances to probe continuously: base URLs (like http://10.1.0.3:8080)," +
+			" host:port addresses or DNS SRV names prefixed with srv: (like srv:_hello._tcp.example.com).",
+		func(c *server.Config) *string { return &c.Peers }},
+	{"peer-discovery", "HELLO_PEER_DISCOVERY", "",
+		"UDP `address` of the multicast group (like 239.255.72.65:7946) or the broadcast address (like 255.255.255.255:7946)" +
+			" on which the instances announce themselves to discover each other. Empty disables the discovery.",
+		func(c *server.Config) *string { return &c.PeerDiscovery }},
+	{"peer-name", "HELLO_PEER_NAME", "",
+		"The `name` of this instance in the connectivity matrix (default: the hostname).",
+		func(c *server.Config) *string { return &c.PeerName }},
+	{"peer-interval", "HELLO_PEER_INTERVAL", "10s",
+		"The `interval` between the probes of the peers and between the discovery announcements.",
+		func(c *server.Config) *string { return &c.PeerInterval }},
+	{"peer-sample-size", "HELLO_PEER_SAMPLE_SIZE", "256KB",
+		"The `size` of the throughput sample sent to /_/echo of each peer at every probe. 0 disables the throughput samples.",
+		func(c *server.Config) *string { return &c.PeerSampleSize }},
+}
+
+// loadConfig builds the server configuration from (in order of increasing
+// precedence) the defaults, the config file (if `configPath` is set), the
+// environment variables and the CLI flags that were explicitly set.
+func loadConfig(configPath string, flagVals map[string]*string, setFlags map[string]bool) (server.Config, error) {
+	var config server.Config
+	for _, s := range settings {
+		*s.field(&config) = s.def
 	}
 
-	return def
+	if len(configPath) > 0 {
+		c, err := server.LoadConfigFile(configPath, config)
+		if err != nil {
+			return config, err
+		}
+		config = c
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			*s.field(&config) = v
+		}
+	}
+
+	for _, s := range settings {
+		if setFlags[s.flag] {
+			*s.field(&config) = *flagVals[s.flag]
+		}
+	}
+
+	config.Version = version
+
+	return config, nil
 }
 
-func main() {
-	// Get default values from environment variables (CLI flags will take
-	// precedence).
-	listenDef := getEnvOrDefault("HELLO_LISTEN", ":8080")
-	staticDef := getEnvOrDefault("HELLO_STATIC", "./static")
-	bwLimitDef := getEnvOrDefault("HELLO_BW_LIMIT", "2GB")
-	usernameDef := getEnvOrDefault("HELLO_USERNAME", "$RANDOM")
-	passwordDef := getEnvOrDefault("HELLO_PASSWORD", "$RANDOM")
+// randomCredentials remembers the generated random username and password, such
+// that they stay the same when the configuration is reloaded.
+type randomCredentials struct {
+	username string
+	password string
+}
 
-	// Define the CLI flags for the server.
-	listen := flag.String("listen", listenDef, "The address (`host:port`) on which the server should listen to."+
-		" Can also be set via the HELLO_LISTEN environment variable.")
-	staticDir := flag.String("static", staticDef, "The directory from which to serve static files."+
-		" Can also be set via the HELLO_STATIC environment variable.")
-	bwLimitStr := flag.String("bw-limit", bwLimitDef, "Limit the read and write bandwidth (each, not combined) of the entire server."+
-		" A string like `2m, 2mb, 2M or 2MB all meaning 2 megabytes per second`."+
-		" Can also be set via the HELLO_BW_LIMIT environment variable.")
-	userFlag := flag.String("username", usernameDef, "Username for HTTP basic authentication."+
-		" Default: $RANDOM, meaning that a random username is generated."+
-		" Set to an empty string to disable authentication."+
-		" Can also be set via the HELLO_USERNAME environment variable.")
-	passFlag := flag.String("password", passwordDef, "Password for HTTP basic authentication."+
-		" Default: $RANDOM, meaning that a random password is generated."+
-		" Can also be set via the HELLO_PASSWORD environment variable.")
-	flag.Parse()
-
-	// Handle $RANDOM for username and password.
-	username := *userFlag
-	password := *passFlag
-
-	if len(username) > 0 && strings.EqualFold(username, "$RANDOM") {
-		username = quickID(12)
-		if username == quickIDNotRandom {
-			fmt.Fprintf(os.Stderr, "Failed to generate a random username\n")
-			os.Exit(1)
+// resolve handles the $RANDOM value for username and password.
+func (rc *randomCredentials) resolve(config *server.Config) error {
+	if len(config.Username) > 0 && strings.EqualFold(config.Username, "$RANDOM") {
+		if len(rc.username) == 0 {
+			rc.username = quickID(12)
+			if rc.username == quickIDNotRandom {
+				return fmt.Errorf("failed to generate a random username")
+			}
 		}
+		config.Username = rc.username
 	}
 
-	if len(username) > 0 && strings.EqualFold(password, "$RANDOM") {
-		password = quickID(24)
-		if password == quickIDNotRandom {
-			fmt.Fprintf(os.Stderr, "Failed to generate a random password\n")
-			os.Exit(1)
+	if len(config.Username) > 0 && strings.EqualFold(config.Password, "$RANDOM") {
+		if len(rc.password) == 0 {
+			rc.password = quickID(24)
+			if rc.password == quickIDNotRandom {
+				return fmt.Errorf("failed to generate a random password")
+			}
 		}
+		config.Password = rc.password
 	}
 
-	// Create server configuration.
-	config := server.Config{
-		Listen:    *listen,
-		StaticDir: *staticDir,
-		BwLimit:   *bwLimitStr,
-		Username:  username,
-		Password:  password,
-		Version:   version,
+	return nil
+}
+
+// serve runs the server, the default subcommand.
+func serve(args []string) {
+	configDef, _ := os.LookupEnv("HELLO_CONFIG")
+
+	// Define the CLI flags for the server.
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", configDef, "Optional configuration `file` (YAML or TOML, selected by the"+
+		" .yaml/.yml or .toml extension). Settings are taken from, in order of precedence,"+
+		" CLI flags, environment variables, the configuration file and the defaults."+
+		" Can also be set via the HELLO_CONFIG environment variable.")
+	flagVals := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagVals[s.flag] = fs.String(s.flag, s.def, s.usage+
+			" Can also be set via the "+s.env+" environment variable.")
+	}
+	_ = fs.Parse(args)
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	// The same loader is used when the configuration is reloaded.
+	var creds randomCredentials
+	load := func() (server.Config, error) {
+		config, err := loadConfig(*configPath, flagVals, setFlags)
+		if err != nil {
+			return config, err
+		}
+		return config, creds.resolve(&config)
+	}
+
+	config, err := load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
 	}
 
 	// Create and start the server.
@@ -104,8 +268,53 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
+	srv.SetConfigLoader(load, *configPath)
+
+	// Gracefully shut down on SIGINT and SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := srv.Serve(); err != nil {
+	if err := srv.ServeContext(ctx); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// usage prints the usage of the app.
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [serve|healthcheck|client|version] [flags]
+
+Subcommands:
+  serve        Run the web server (default if no subcommand is given).
+  healthcheck  Probe the health endpoint of a running server, exits with 0 if healthy, 1 otherwise.
+  client       Generate load (GETs, uploads, downloads) against other instances and report the results.
+  version      Print the version.
+
+Run '%s <subcommand> -h' for the flags of a subcommand.
+`, os.Args[0], os.Args[0])
+}
+
+func main() {
+	// The subcommand is optional, `serve` is the default such that
+	// `hello-zedcloud -listen ...` keeps working.
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "healthcheck":
+		os.Exit(healthcheck(args))
+	case "client":
+		os.Exit(client(args))
+	case "version":
+		fmt.Println(strings.TrimSpace(version))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown subcommand: %s\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
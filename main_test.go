@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "listen: \":7070\"\nlog_level: warn\nusername: file-user\nbw_limit: 10MB\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Only the environment variables of the test apply.
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+		_ = os.Unsetenv(s.env)
+	}
+	t.Setenv("HELLO_LOG_LEVEL", "info")
+	t.Setenv("HELLO_USERNAME", "env-user")
+
+	flagVals := map[string]*string{}
+	for _, s := range settings {
+		flagVals[s.flag] = new(string)
+	}
+	*flagVals["username"] = "flag-user"
+	*flagVals["listen"] = ":6060"
+
+	tests := []struct {
+		name       string
+		configPath string
+		setFlags   map[string]bool
+		setting    string
+		want       string
+	}{
+		{name: "default", setting: "static_dir", want: "./static"},
+		{name: "file over default", configPath: path, setting: "bw_limit", want: "10MB"},
+		{name: "file", configPath: path, setting: "listen", want: ":7070"},
+		{name: "env over file", configPath: path, setting: "log_level", want: "info"},
+		{name: "env over default", setting: "log_level", want: "info"},
+		{name: "flag over env", configPath: path, setFlags: map[string]bool{"username": true},
+			setting: "username", want: "flag-user"},
+		{name: "flag over file", configPath: path, setFlags: map[string]bool{"listen": true},
+			setting: "listen", want: ":6060"},
+		{name: "flag not set", configPath: path, setFlags: map[string]bool{}, setting: "username", want: "env-user"},
+	}
+	for _, tt := range tests {
+		config, err := loadConfig(tt.configPath, flagVals, tt.setFlags)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := map[string]string{
+			"static_dir": config.StaticDir,
+			"bw_limit":   config.BwLimit,
+			"listen":     config.Listen,
+			"log_level":  config.LogLevel,
+			"username":   config.Username,
+		}[tt.setting]
+		if got != tt.want {
+			t.Errorf("%s: %s = %q, want %q", tt.name, tt.setting, got, tt.want)
+		}
+		if config.Version != version {
+			t.Errorf("%s: version %q, want %q", tt.name, config.Version, version)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), flagVals, nil); err == nil {
+		t.Errorf("missing config file: expected an error")
+	}
+}
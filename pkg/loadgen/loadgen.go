@@ -0,0 +1,406 @@
+// Package loadgen generates HTTP traffic against hello-zedcloud instances,
+// with a configurable mix of requests, concurrency, rate and duration, and
+// reports the latency percentiles, throughput and errors.
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Op is a kind of request made by the load generator.
+type Op string
+
+const (
+	// OpGet is a GET of the `GetPath` of the target.
+	OpGet Op = "get"
+	// OpUpload is a `/_/upload` POST of generated content.
+	OpUpload Op = "upload"
+	// OpDownload is a `/_/download` GET.
+	OpDownload Op = "download"
+)
+
+// weightedOp is an Op with its relative weight in the request mix.
+type weightedOp struct {
+	op     Op
+	weight int
+}
+
+// parseMix parses a request mix like `get=5,upload=1,download=2` (the
+// numbers are relative weights). An op without a weight has a weight of 1.
+func parseMix(s string) ([]weightedOp, error) {
+	var mix []weightedOp
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		name, w, hasWeight := strings.Cut(entry, "=")
+		op := Op(strings.ToLower(strings.TrimSpace(name)))
+		switch op {
+		case OpGet, OpUpload, OpDownload:
+		default:
+			return nil, fmt.Errorf("%s: unknown request type (expected get, upload or download)", name)
+		}
+		weight := 1
+		if hasWeight {
+			x, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || x < 0 {
+				return nil, fmt.Errorf("%s: invalid request mix weight", entry)
+			}
+			weight = x
+		}
+		mix = append(mix, weightedOp{op: op, weight: weight})
+	}
+
+	total := 0
+	for _, w := range mix {
+		total += w.weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s: the request mix is empty", s)
+	}
+
+	return mix, nil
+}
+
+// Config is the configuration of a load generator run.
+type Config struct {
+	// Targets are the base URLs (like `http://10.1.0.2:8080`) of the
+	// instances to which requests are sent, in a round-robin fashion.
+	Targets []string
+
+	// Mix is the request mix, like `get=5,upload=1,download=2`.
+	Mix string
+
+	// Concurrency is the number of concurrent workers (default: 1).
+	Concurrency int
+
+	// Rate is the maximum number of requests per second of all the workers
+	// together, 0 means unlimited.
+	Rate float64
+
+	// Duration is how long to generate load, 0 means until stopped (or
+	// until `Requests` requests were made).
+	Duration time.Duration
+
+	// Requests is the maximum number of requests, 0 means unlimited.
+	Requests int
+
+	// GetPath is the path requested by the `get` requests (default: `/`).
+	GetPath string
+
+	// UploadSize and DownloadSize are the sizes in bytes of the uploaded
+	// and downloaded content (default: 1MB).
+	UploadSize   int64
+	DownloadSize int64
+
+	// Username and Password are the HTTP Basic authentication credentials
+	// of the targets, needed for uploads and downloads.
+	Username string
+	Password string
+
+	// Insecure disables the verification of the targets' certificates.
+	Insecure bool
+
+	// Timeout is the timeout of each request (default: 30s).
+	Timeout time.Duration
+}
+
+// withDefaults validates the configuration and fills in the defaults.
+func (c Config) withDefaults() (Config, []weightedOp, error) {
+	var errs []error
+
+	if len(c.Targets) == 0 {
+		errs = append(errs, fmt.Errorf("at least one target URL must be set"))
+	}
+	for i, t := range c.Targets {
+		t = strings.TrimRight(strings.TrimSpace(t), "/")
+		if !strings.HasPrefix(t, "http://") && !strings.HasPrefix(t, "https://") {
+			errs = append(errs, fmt.Errorf("%s: invalid target URL (expected http:// or https://)", t))
+		}
+		c.Targets[i] = t
+	}
+	if len(c.Mix) == 0 {
+		c.Mix = string(OpGet)
+	}
+	mix, err := parseMix(c.Mix)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.Rate < 0 || c.Duration < 0 || c.Requests < 0 || c.UploadSize < 0 || c.DownloadSize < 0 {
+		errs = append(errs, fmt.Errorf("the rate, duration, number of requests and sizes can't be negative"))
+	}
+	if len(c.GetPath) == 0 {
+		c.GetPath = "/"
+	}
+	if !strings.HasPrefix(c.GetPath, "/") {
+		c.GetPath = "/" + c.GetPath
+	}
+	if c.UploadSize == 0 {
+		c.UploadSize = 1 << 20
+	}
+	if c.DownloadSize == 0 {
+		c.DownloadSize = 1 << 20
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+
+	return c, mix, errors.Join(errs...)
+}
+
+// Runner is a running (or finished) load generator run.
+type Runner struct {
+	config Config
+	mix    []weightedOp
+	client *http.Client
+
+	limiter *rate.Limiter
+	stats   *stats
+
+	// next is the number of requests started so far, used to pick the
+	// target and to stop after `config.Requests` requests.
+	nextMu sync.Mutex
+	next   int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start validates the configuration and starts generating load in the
+// background, until the duration elapses, the number of requests is reached,
+// Stop is called or `ctx` is done.
+func Start(ctx context.Context, config Config) (*Runner, error) {
+	config.Targets = append([]string(nil), config.Targets...)
+	config, mix, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.Concurrency
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.Insecure}
+
+	r := &Runner{
+		config: config,
+		mix:    mix,
+		client: &http.Client{Transport: transport, Timeout: config.Timeout},
+		stats:  newStats(),
+		done:   make(chan struct{}),
+	}
+	if config.Rate > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(config.Rate), 1)
+	}
+
+	if config.Duration > 0 {
+		ctx, r.cancel = context.WithTimeout(ctx, config.Duration)
+	} else {
+		ctx, r.cancel = context.WithCancel(ctx)
+	}
+
+	var wg sync.WaitGroup
+	for range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.worker(ctx)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		r.stats.finish()
+		transport.CloseIdleConnections()
+		r.cancel()
+		close(r.done)
+	}()
+
+	return r, nil
+}
+
+// Config returns the effective configuration of the run.
+func (r *Runner) Config() Config {
+	return r.config
+}
+
+// Stop stops generating load, the requests in progress are canceled.
+func (r *Runner) Stop() {
+	r.cancel()
+}
+
+// Done returns a channel which is closed once the run is finished.
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+// Report returns the report of the run so far (or of the whole run, once
+// finished).
+func (r *Runner) Report() Report {
+	return r.stats.report(r.config)
+}
+
+// take returns the sequence number of the next request, or false if the
+// maximum number of requests was reached.
+func (r *Runner) take() (int, bool) {
+	r.nextMu.Lock()
+	defer r.nextMu.Unlock()
+
+	if r.config.Requests > 0 && r.next >= r.config.Requests {
+		return 0, false
+	}
+	n := r.next
+	r.next++
+
+	return n, true
+}
+
+// pick returns a random op according to the weights of the request mix.
+func (r *Runner) pick() Op {
+	total := 0
+	for _, w := range r.mix {
+		total += w.weight
+	}
+	x := rand.IntN(total)
+	for _, w := range r.mix {
+		if x < w.weight {
+			return w.op
+		}
+		x -= w.weight
+	}
+
+	return r.mix[len(r.mix)-1].op
+}
+
+// worker makes requests until `ctx` is done or the maximum number of requests
+// is reached.
+func (r *Runner) worker(ctx context.Context) {
+	for {
+		if r.limiter != nil {
+			if err := r.limiter.Wait(ctx); err != nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		n, ok := r.take()
+		if !ok {
+			return
+		}
+
+		op := r.pick()
+		target := r.config.Targets[n%len(r.config.Targets)]
+		start := time.Now()
+		sent, received, err := r.do(ctx, op, target, n)
+		// Requests canceled because the run ended are not counted.
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		r.stats.record(op, time.Since(start), sent, received, err)
+	}
+}
+
+// statusError is the error of a request which got a non 2xx response.
+type statusError struct {
+	code int
+}
+
+// Error returns the error message.
+func (e statusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.code)
+}
+
+// do makes one request and returns the number of bytes sent and received.
+func (r *Runner) do(ctx context.Context, op Op, target string, n int) (int64, int64, error) {
+	var (
+		req  *http.Request
+		err  error
+		sent int64
+	)
+
+	switch op {
+	case OpUpload:
+		body, contentType := uploadBody(r.config.UploadSize, fmt.Sprintf("loadgen-%d.bin", n))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, target+"/_/upload", body)
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		sent = r.config.UploadSize
+	case OpDownload:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%s/_/download?size=%d", target, r.config.DownloadSize), nil)
+	default:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, target+r.config.GetPath, nil)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(r.config.Username) > 0 {
+		req.SetBasicAuth(r.config.Username, r.config.Password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return sent, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	received, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return sent, received, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return sent, received, statusError{code: resp.StatusCode}
+	}
+
+	return sent, received, nil
+}
+
+// uploadBody returns a streamed multipart body with a file of `size` random
+// bytes, and its content type.
+func uploadBody(size int64, filename string) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := mw.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.CopyN(part, RandomReader(), size)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, mw.FormDataContentType()
+}
+
+// RandomReader returns a reader of (fast, not cryptographically secure)
+// random bytes.
+func RandomReader() io.Reader {
+	var seed [32]byte
+	for i := range seed {
+		seed[i] = byte(rand.Uint32())
+	}
+
+	return rand.NewChaCha8(seed)
+}
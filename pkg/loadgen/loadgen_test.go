@@ -0,0 +1,34 @@
+package loadgen
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []weightedOp
+		wantErr bool
+	}{
+		{in: "get", want: []weightedOp{{OpGet, 1}}},
+		{in: "get=5, upload=1,download=2", want: []weightedOp{{OpGet, 5}, {OpUpload, 1}, {OpDownload, 2}}},
+		{in: "GET=3,,upload", want: []weightedOp{{OpGet, 3}, {OpUpload, 1}}},
+		{in: "get=0,download=1", want: []weightedOp{{OpGet, 0}, {OpDownload, 1}}},
+		{in: "", wantErr: true},
+		{in: "get=0", wantErr: true},
+		{in: "post", wantErr: true},
+		{in: "get=-1", wantErr: true},
+		{in: "get=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMix(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMix(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseMix(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
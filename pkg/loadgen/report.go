@@ -0,0 +1,347 @@
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// opStats are the statistics of one kind of request.
+type opStats struct {
+	latencies latencyHistogram
+	errors    int
+	sent      int64
+	received  int64
+}
+
+// stats are the statistics of a run.
+type stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	ops      map[Op]*opStats
+	errKinds map[string]int
+}
+
+// newStats creates the (empty) statistics of a run starting now.
+func newStats() *stats {
+	return &stats{
+		start:    time.Now(),
+		ops:      make(map[Op]*opStats),
+		errKinds: make(map[string]int),
+	}
+}
+
+// record adds the result of a request.
+func (s *stats) record(op Op, latency time.Duration, sent, received int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.ops[op]
+	if !ok {
+		o = &opStats{}
+		s.ops[op] = o
+	}
+	o.latencies.add(latency)
+	o.sent += sent
+	o.received += received
+	if err != nil {
+		o.errors++
+		s.errKinds[errorKind(err)]++
+	}
+}
+
+// finish marks the end of the run.
+func (s *stats) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.end = time.Now()
+}
+
+// errorKind classifies the error of a request, for the error breakdown.
+func errorKind(err error) string {
+	var (
+		se     statusError
+		netErr net.Error
+		dnsErr *net.DNSError
+		tlsErr *tls.CertificateVerificationError
+	)
+
+	switch {
+	case errors.As(err, &se):
+		return se.Error()
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return "unexpected EOF"
+	default:
+		return "other"
+	}
+}
+
+// Latency are the latency statistics of a set of requests, in milliseconds
+// (such that they are easy to use in JSON).
+type Latency struct {
+	Min  float64 `json:"min_ms"`
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P95  float64 `json:"p95_ms"`
+	P99  float64 `json:"p99_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+const (
+	// latencyGrowth is the ratio of the bounds of consecutive latency
+	// buckets, the precision of the percentiles.
+	latencyGrowth = 1.02
+
+	// latencyBuckets is the number of latency buckets, from 1µs to about
+	// 6h (the last bucket has all the longer latencies).
+	latencyBuckets = 1200
+)
+
+// latencyHistogram records latencies in buckets growing exponentially, such
+// that it has a fixed size however long the run is. The minimum, maximum and
+// mean are exact, the percentiles are within 2%.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	count  int
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// latencyBucket returns the bucket of the latency `d`: bucket `i` has the
+// latencies below latencyGrowth^i microseconds (and above the previous one).
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	i := int(math.Log(us)/math.Log(latencyGrowth)) + 1
+
+	return min(i, latencyBuckets-1)
+}
+
+// add records a latency.
+func (h *latencyHistogram) add(d time.Duration) {
+	h.counts[latencyBucket(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.count++
+	h.sum += d
+}
+
+// merge adds the latencies recorded by `o`.
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	h.max = max(h.max, o.max)
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// latency computes the latency statistics of the histogram.
+func (h *latencyHistogram) latency() Latency {
+	if h.count == 0 {
+		return Latency{}
+	}
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	// Nearest-rank percentile, the upper bound of its bucket (the maximum
+	// for the last bucket, which has no upper bound).
+	pct := func(p float64) float64 {
+		rank := uint64(max(1, int(p/100*float64(h.count)+0.5)))
+		var cum uint64
+		for i, c := range h.counts[:latencyBuckets-1] {
+			cum += c
+			if cum >= rank {
+				upper := time.Duration(math.Pow(latencyGrowth, float64(i)) * float64(time.Microsecond))
+				return ms(min(max(upper, h.min), h.max))
+			}
+		}
+		return ms(h.max)
+	}
+
+	return Latency{
+		Min:  ms(h.min),
+		Mean: ms(h.sum / time.Duration(h.count)),
+		P50:  pct(50),
+		P90:  pct(90),
+		P95:  pct(95),
+		P99:  pct(99),
+		Max:  ms(h.max),
+	}
+}
+
+// OpReport is the report of one kind of request.
+type OpReport struct {
+	Requests      int     `json:"requests"`
+	Errors        int     `json:"errors"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Latency       Latency `json:"latency"`
+}
+
+// Report is the report of a load generator run.
+type Report struct {
+	Targets  []string `json:"targets"`
+	Running  bool     `json:"running"`
+	Started  string   `json:"started"`
+	Duration string   `json:"duration"`
+
+	Requests int `json:"requests"`
+	Errors   int `json:"errors"`
+	// RequestsPerSecond is the throughput in requests per second.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	BytesSent         int64   `json:"bytes_sent"`
+	BytesReceived     int64   `json:"bytes_received"`
+	// SentPerSecond and ReceivedPerSecond are the throughputs in bytes per
+	// second.
+	SentPerSecond     float64 `json:"sent_bytes_per_second"`
+	ReceivedPerSecond float64 `json:"received_bytes_per_second"`
+	Latency           Latency `json:"latency"`
+
+	// Ops are the reports per kind of request.
+	Ops map[Op]OpReport `json:"ops"`
+	// ErrorKinds are the number of errors of each kind, like `HTTP 503`,
+	// `timeout` or `connection refused`.
+	ErrorKinds map[string]int `json:"error_kinds"`
+}
+
+// report creates the report of the run so far.
+func (s *stats) report(config Config) Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(s.start)
+
+	r := Report{
+		Targets:    config.Targets,
+		Running:    s.end.IsZero(),
+		Started:    s.start.Format(time.RFC3339),
+		Duration:   elapsed.Round(time.Millisecond).String(),
+		Ops:        make(map[Op]OpReport),
+		ErrorKinds: make(map[string]int),
+	}
+
+	var all latencyHistogram
+	for op, o := range s.ops {
+		all.merge(&o.latencies)
+		r.Ops[op] = OpReport{
+			Requests:      o.latencies.count,
+			Errors:        o.errors,
+			BytesSent:     o.sent,
+			BytesReceived: o.received,
+			Latency:       o.latencies.latency(),
+		}
+		r.Requests += o.latencies.count
+		r.Errors += o.errors
+		r.BytesSent += o.sent
+		r.BytesReceived += o.received
+	}
+	for k, n := range s.errKinds {
+		r.ErrorKinds[k] = n
+	}
+	r.Latency = all.latency()
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.RequestsPerSecond = float64(r.Requests) / secs
+		r.SentPerSecond = float64(r.BytesSent) / secs
+		r.ReceivedPerSecond = float64(r.BytesReceived) / secs
+	}
+
+	return r
+}
+
+// writeLatency writes latency statistics as one line of text.
+func writeLatency(w io.Writer, prefix string, l Latency) {
+	_, _ = fmt.Fprintf(w, "%slatency: min=%.2fms mean=%.2fms p50=%.2fms p90=%.2fms p95=%.2fms p99=%.2fms max=%.2fms\n",
+		prefix, l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+}
+
+// WriteText writes the report as text.
+func (r Report) WriteText(w io.Writer) {
+	state := "finished"
+	if r.Running {
+		state = "running"
+	}
+
+	_, _ = fmt.Fprintf(w, "Load generator run (%s), started %s, duration %s:\n", state, r.Started, r.Duration)
+	_, _ = fmt.Fprintf(w, "\tTargets: %v\n", r.Targets)
+	_, _ = fmt.Fprintf(w, "\tRequests: %d (%.2f/s), errors: %d\n", r.Requests, r.RequestsPerSecond, r.Errors)
+	_, _ = fmt.Fprintf(w, "\tSent: %s (%s/s), received: %s (%s/s)\n",
+		humanize.Bytes(uint64(r.BytesSent)), humanize.Bytes(uint64(r.SentPerSecond)),
+		humanize.Bytes(uint64(r.BytesReceived)), humanize.Bytes(uint64(r.ReceivedPerSecond)))
+	writeLatency(w, "\t", r.Latency)
+
+	ops := make([]string, 0, len(r.Ops))
+	for op := range r.Ops {
+		ops = append(ops, string(op))
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		o := r.Ops[Op(op)]
+		_, _ = fmt.Fprintf(w, "\t%s: requests=%d errors=%d sent=%s received=%s\n", op, o.Requests, o.Errors,
+			humanize.Bytes(uint64(o.BytesSent)), humanize.Bytes(uint64(o.BytesReceived)))
+		writeLatency(w, "\t\t", o.Latency)
+	}
+
+	if len(r.ErrorKinds) > 0 {
+		_, _ = fmt.Fprintln(w, "\tErrors:")
+		kinds := make([]string, 0, len(r.ErrorKinds))
+		for k := range r.ErrorKinds {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			_, _ = fmt.Fprintf(w, "\t\t%s: %d\n", k, r.ErrorKinds[k])
+		}
+	}
+}
+
+// WriteJSON writes the report as (indented) JSON.
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
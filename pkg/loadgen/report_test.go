@@ -0,0 +1,119 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		want      Latency
+	}{
+		{name: "empty"},
+		{
+			name:      "single",
+			latencies: []time.Duration{5 * time.Millisecond},
+			want:      Latency{Min: 5, Mean: 5, P50: 5, P90: 5, P95: 5, P99: 5, Max: 5},
+		},
+		{
+			name:      "sub-microsecond",
+			latencies: []time.Duration{100, 200},
+			want:      Latency{Min: 0.0001, Mean: 0.00015, P50: 0.0002, P90: 0.0002, P95: 0.0002, P99: 0.0002, Max: 0.0002},
+		},
+		{
+			name: "1ms to 100ms",
+			latencies: func() []time.Duration {
+				var l []time.Duration
+				for i := 1; i <= 100; i++ {
+					l = append(l, time.Duration(i)*time.Millisecond)
+				}
+				return l
+			}(),
+			want: Latency{Min: 1, Mean: 50.5, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100},
+		},
+		{
+			name:      "longer than the last bucket",
+			latencies: []time.Duration{time.Millisecond, 24 * time.Hour},
+			want:      Latency{Min: 1, Mean: 12*3600*1000 + 0.5, P50: 1, P90: 24 * 3600 * 1000, P95: 24 * 3600 * 1000, P99: 24 * 3600 * 1000, Max: 24 * 3600 * 1000},
+		},
+	}
+	// The percentiles are within the precision of the buckets.
+	near := func(got, want float64) bool {
+		return math.Abs(got-want) <= want*(latencyGrowth-1)
+	}
+	for _, tt := range tests {
+		var h latencyHistogram
+		for _, d := range tt.latencies {
+			h.add(d)
+		}
+		got := h.latency()
+		if got.Min != tt.want.Min || got.Max != tt.want.Max || !near(got.Mean, tt.want.Mean) {
+			t.Errorf("%s: min/mean/max = %g/%g/%g, want %g/%g/%g", tt.name,
+				got.Min, got.Mean, got.Max, tt.want.Min, tt.want.Mean, tt.want.Max)
+		}
+		for _, p := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"p50", got.P50, tt.want.P50},
+			{"p90", got.P90, tt.want.P90},
+			{"p95", got.P95, tt.want.P95},
+			{"p99", got.P99, tt.want.P99},
+		} {
+			if !near(p.got, p.want) {
+				t.Errorf("%s: %s = %g, want %g", tt.name, p.name, p.got, p.want)
+			}
+		}
+		if h.count != len(tt.latencies) {
+			t.Errorf("%s: count = %d, want %d", tt.name, h.count, len(tt.latencies))
+		}
+	}
+}
+
+func TestLatencyHistogramMerge(t *testing.T) {
+	var a, b, all latencyHistogram
+	for i := 1; i <= 10; i++ {
+		d := time.Duration(i) * time.Millisecond
+		if i%2 == 0 {
+			a.add(d)
+		} else {
+			b.add(d)
+		}
+		all.add(d)
+	}
+	var merged latencyHistogram
+	merged.merge(&a)
+	merged.merge(&b)
+	merged.merge(&latencyHistogram{})
+	if merged != all {
+		t.Errorf("merged histogram %v, want %v", merged.latency(), all.latency())
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("get: %w", statusError{code: 503}), "HTTP 503"},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), "timeout"},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), "connection refused"},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), "connection reset"},
+		{fmt.Errorf("dial: %w", syscall.EHOSTUNREACH), "unreachable"},
+		{io.ErrUnexpectedEOF, "unexpected EOF"},
+		{errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("errorKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
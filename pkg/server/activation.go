@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd-style socket
+// activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// inheritedListener is a listener passed by socket activation.
+type inheritedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// inheritedListeners returns the listeners passed to the process with
+// systemd-style socket activation (the `LISTEN_PID`, `LISTEN_FDS` and
+// `LISTEN_FDNAMES` environment variables), in order. The environment
+// variables are removed such that child processes don't inherit them. If the
+// process wasn't socket activated nil is returned.
+func inheritedListeners() ([]inheritedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); len(v) > 0 {
+		names = strings.Split(v, ":")
+	}
+
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var inherited []inheritedListener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+
+		name := fmt.Sprintf("activated-%d", i+1)
+		if i < len(names) && len(names[i]) > 0 && names[i] != "unknown" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		// The listener has its own (close-on-exec) duplicate of the file
+		// descriptor.
+		_ = f.Close()
+		if err != nil {
+			for _, l := range inherited {
+				_ = l.ln.Close()
+			}
+			return nil, fmt.Errorf("socket activation: file descriptor %d (%s) is not a listening socket: %w",
+				fd, name, err)
+		}
+
+		inherited = append(inherited, inheritedListener{name: name, ln: ln})
+	}
+
+	return inherited, nil
+}
+
+// assignInherited assigns the inherited (socket activated) listeners to the
+// configured ones: first by name, then the remaining ones in order. Inherited
+// listeners left over after that become additional listeners serving all the
+// endpoints.
+func (s *Server) assignInherited(inherited []inheritedListener) {
+	used := make([]bool, len(inherited))
+
+	for _, l := range s.listeners {
+		for i, in := range inherited {
+			if !used[i] && in.name == l.spec.name {
+				l.inherited, used[i] = in.ln, true
+				break
+			}
+		}
+	}
+
+	next := 0
+	for _, l := range s.listeners {
+		if l.inherited != nil {
+			continue
+		}
+		for next < len(inherited) && used[next] {
+			next++
+		}
+		if next == len(inherited) {
+			break
+		}
+		l.inherited, used[next] = inherited[next].ln, true
+	}
+
+	for i, in := range inherited {
+		if used[i] {
+			continue
+		}
+		s.listeners = append(s.listeners, &serverListener{
+			spec: listenerSpec{
+				name:      in.name,
+				network:   in.ln.Addr().Network(),
+				address:   in.ln.Addr().String(),
+				tls:       s.tlsConfig != nil,
+				endpoints: []string{groupAll},
+			},
+			inherited: in.ln,
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// allocation is a memory allocation made with `/_/alloc`.
+type allocation struct {
+	ID      string    `json:"id"`
+	Size    uint64    `json:"size"`
+	Delay   string    `json:"delay"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user"`
+
+	// stop is closed to stop the walker goroutine, which closes stopped
+	// once it doesn't reference the buffer anymore.
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// allocRegistry tracks the memory allocations, such that they can be listed
+// and freed.
+type allocRegistry struct {
+	mu     sync.Mutex
+	allocs []*allocation
+	nextID int
+}
+
+// total returns the number and the total size of the allocations.
+func (ar *allocRegistry) total() (int, uint64) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	var total uint64
+	for _, a := range ar.allocs {
+		total += a.Size
+	}
+
+	return len(ar.allocs), total
+}
+
+// list returns the allocations, oldest first.
+func (ar *allocRegistry) list() []allocation {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	list := make([]allocation, 0, len(ar.allocs))
+	for _, a := range ar.allocs {
+		list = append(list, *a)
+	}
+
+	return list
+}
+
+// allocLimitError is returned when an allocation would exceed the limit.
+type allocLimitError struct {
+	size, allocated, limit uint64
+}
+
+// Error returns the error message.
+func (e allocLimitError) Error() string {
+	return fmt.Sprintf("allocating %s more would exceed the limit of %s (%s already allocated), use force=true to allocate anyway",
+		humanize.Bytes(e.size), humanize.Bytes(e.limit), humanize.Bytes(e.allocated))
+}
+
+// alloc allocates `size` bytes, refused if the total of the allocations would
+// exceed `limit` (0 means no limit) unless `force`.
+func (ar *allocRegistry) alloc(size uint64, delay time.Duration, user string, limit uint64,
+	force bool) (allocation, error) {
+	ar.mu.Lock()
+	var allocated uint64
+	for _, a := range ar.allocs {
+		allocated += a.Size
+	}
+	if limit > 0 && allocated+size > limit && !force {
+		ar.mu.Unlock()
+		return allocation{}, allocLimitError{size: size, allocated: allocated, limit: limit}
+	}
+	ar.nextID++
+	a := &allocation{
+		ID:      strconv.Itoa(ar.nextID),
+		Size:    size,
+		Delay:   delay.String(),
+		Created: time.Now(),
+		User:    user,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// Reserve the size before filling the buffer (outside of the lock).
+	ar.allocs = append(ar.allocs, a)
+	ar.mu.Unlock()
+
+	allocMemory(size, delay, a.stop, a.stopped)
+
+	return *a, nil
+}
+
+// free frees the allocation `id`, or all the allocations if `id` is empty.
+// Returns the freed allocations.
+func (ar *allocRegistry) free(id string) []allocation {
+	ar.mu.Lock()
+	var freed []*allocation
+	ar.allocs = slices.DeleteFunc(ar.allocs, func(a *allocation) bool {
+		if len(id) == 0 || a.ID == id {
+			freed = append(freed, a)
+			return true
+		}
+		return false
+	})
+	ar.mu.Unlock()
+
+	list := make([]allocation, 0, len(freed))
+	for _, a := range freed {
+		close(a.stop)
+		list = append(list, *a)
+	}
+	if len(freed) > 0 {
+		// Return the memory to the OS once the walkers are done with it, such
+		// that the memory pressure visibly goes down.
+		go func() {
+			for _, a := range freed {
+				<-a.stopped
+			}
+			debug.FreeOSMemory()
+		}()
+	}
+
+	return list
+}
+
+// sleep sleeps for `d`, returns false if `stop` was closed in the meantime.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// allocMemory will create a new slice of bytes of size `size`. It will then
+// spawn a new gorouting that will periodically walk and update each byte to
+// prevent the GC from freeing it, until `stop` is closed (then it closes
+// `stopped`). The `delay` is using during the walk, thus a smaller delay will
+// cause a higher CPU utilization while a bigger one will decrease the CPU
+// utilization.
+func allocMemory(size uint64, delay time.Duration, stop <-chan struct{}, stopped chan<- struct{}) {
+	buff := make([]byte, size)
+
+	for i := uint64(0); i < size; i++ {
+		buff[i] = byte(mrand.Intn(256)) // Random byte between 0 and 255
+	}
+
+	go func() {
+		defer close(stopped)
+		for {
+			if !sleep(delay, stop) {
+				return
+			}
+			for i := uint64(0); i < size; i++ {
+				buff[i] = byte(mrand.Intn(256)) // Random byte between 0 and 255
+				if i%100 == 0 && !sleep(delay, stop) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// writeAllocations writes a list of allocations, as JSON if the client accepts
+// it and otherwise as text.
+func writeAllocations(w http.ResponseWriter, r *http.Request, status int, title string, list []allocation) {
+	var total uint64
+	for _, a := range list {
+		total += a.Size
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Allocations []allocation `json:"allocations"`
+			Total       uint64       `json:"total"`
+		}{list, total})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	writeAllocationsText(w, title, list, total)
+}
+
+// writeAllocationsText writes a list of allocations as text.
+func writeAllocationsText(w io.Writer, title string, list []allocation, total uint64) {
+	_, _ = fmt.Fprintf(w, "%s: %d, total %s\n", title, len(list), humanize.Bytes(total))
+	for _, a := range list {
+		_, _ = fmt.Fprintf(w, "\tid=%s size=%s delay=%s created=%s user=%s\n", a.ID,
+			humanize.Bytes(a.Size), a.Delay, a.Created.Format(time.RFC3339), a.User)
+	}
+}
+
+// allocMemoryHandler is an HTTP handler that is used on the `/_/alloc` path:
+// `POST` allocates memory if the appropriate query params are set (`size`,
+// optional `delay` and `force`), `GET` lists the allocations and `DELETE`
+// frees the allocation `id`, or all of them with `all=true`.
+func allocMemoryHandler(ar *allocRegistry, limit func() uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeAllocations(w, r, http.StatusOK, "Allocations", ar.list())
+			return
+		case http.MethodDelete:
+			id := query.Get("id")
+			all, _ := strconv.ParseBool(query.Get("all"))
+			if len(id) == 0 && !all {
+				http.Error(w, "the allocation id (or all=true) must be set", http.StatusBadRequest)
+				return
+			}
+			if all {
+				id = ""
+			}
+			freed := ar.free(id)
+			if len(freed) == 0 && !all {
+				http.Error(w, fmt.Sprintf("%s: unknown allocation", id), http.StatusNotFound)
+				return
+			}
+			for _, a := range freed {
+				reqLogger.Info("Memory freed", "alloc_id", a.ID, "size", a.Size)
+			}
+			writeAllocations(w, r, http.StatusOK, "Freed allocations", freed)
+			return
+		}
+
+		sq, ok := query["size"]
+		if !ok || len(sq) != 1 || len(sq[0]) == 0 {
+			http.Error(w, "allocation size must be set",
+				http.StatusBadRequest)
+			return
+		}
+		s, err := humanize.ParseBytes(sq[0])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: invalid size", sq[0]),
+				http.StatusBadRequest)
+			return
+		}
+		size := s
+		delay := 200 * time.Millisecond
+		dq, ok := query["delay"]
+		if ok && len(dq) == 1 && len(dq[0]) > 0 {
+			d, err := time.ParseDuration(dq[0])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: invalid delay", dq[0]),
+					http.StatusBadRequest)
+				return
+			}
+			delay = d
+		}
+		force, _ := strconv.ParseBool(query.Get("force"))
+
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		a, err := ar.alloc(size, delay, user, limit(), force)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		reqLogger.Info("Memory allocated", "alloc_id", a.ID, "size", a.Size, "delay", a.Delay, "force", force)
+
+		http.Error(w, fmt.Sprintf("memory allocated (id %s)", a.ID), http.StatusCreated)
+	})
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authMode selects how the client of an authenticated endpoint must prove its
+// identity.
+type authMode string
+
+const (
+	// authNone disables authentication for an endpoint.
+	authNone authMode = "none"
+	// authBasic requires HTTP Basic authentication credentials.
+	authBasic authMode = "basic"
+	// authMTLS requires a TLS client certificate verified against the
+	// configured client CA bundle.
+	authMTLS authMode = "mtls"
+	// authEither accepts either a verified client certificate or HTTP Basic
+	// authentication credentials.
+	authEither authMode = "either"
+)
+
+// parseAuthMode converts a string (as found in the configuration) to an
+// authMode.
+func parseAuthMode(s string) (authMode, error) {
+	switch m := authMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case authNone, authBasic, authMTLS, authEither:
+		return m, nil
+	default:
+		return "", fmt.Errorf("%s: unknown authentication mode (expected one of none, basic, mtls, either)", s)
+	}
+}
+
+// certUserMapping maps a client certificate identity, for example the subject
+// common name or a DNS SAN, to a username.
+type certUserMapping struct {
+	// kind is one of `cn`, `dns`, `email` or `uri`.
+	kind     string
+	value    string
+	username string
+}
+
+// matches returns true if the certificate has the identity described by `m`.
+func (m certUserMapping) matches(cert *x509.Certificate) bool {
+	switch m.kind {
+	case "cn":
+		return cert.Subject.CommonName == m.value
+	case "dns":
+		for _, n := range cert.DNSNames {
+			if strings.EqualFold(n, m.value) {
+				return true
+			}
+		}
+	case "email":
+		for _, e := range cert.EmailAddresses {
+			if strings.EqualFold(e, m.value) {
+				return true
+			}
+		}
+	case "uri":
+		for _, u := range cert.URIs {
+			if u.String() == m.value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseCertUserMappings parses a list of client certificate identity to
+// username mappings in the format `kind:identity=username,...`, for example
+// `cn:device-1=alice,dns:node1.example.com=bob`.
+func parseCertUserMappings(s string) ([]certUserMapping, error) {
+	var mappings []certUserMapping
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		// The username is after the *last* `=` since identities (e.g.
+		// URIs) might contain `=` themselves.
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 || idx == len(entry)-1 {
+			return nil, fmt.Errorf("%s: invalid client certificate user mapping (expected kind:identity=username)", entry)
+		}
+		identity, username := entry[:idx], entry[idx+1:]
+
+		kind, value, ok := strings.Cut(identity, ":")
+		kind = strings.ToLower(kind)
+		if !ok || len(value) == 0 {
+			return nil, fmt.Errorf("%s: invalid client certificate identity (expected kind:identity)", identity)
+		}
+		switch kind {
+		case "cn", "dns", "email", "uri":
+		default:
+			return nil, fmt.Errorf("%s: unknown client certificate identity kind (expected one of cn, dns, email, uri)", kind)
+		}
+
+		mappings = append(mappings, certUserMapping{kind: kind, value: value, username: username})
+	}
+
+	return mappings, nil
+}
+
+// parseEndpointAuthModes parses per-endpoint authentication mode overrides in
+// the format `path=mode,...`, for example `/_/crash=mtls,/_/logs=either`.
+func parseEndpointAuthModes(s string) (map[string]authMode, error) {
+	modes := make(map[string]authMode)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		path, m, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%s: invalid endpoint authentication mode (expected /path=mode)", entry)
+		}
+		mode, err := parseAuthMode(m)
+		if err != nil {
+			return nil, err
+		}
+		modes[path] = mode
+	}
+
+	return modes, nil
+}
+
+// authenticator holds everything needed to authenticate the clients of the
+// `/_/` endpoints, either with HTTP Basic authentication or with TLS client
+// certificates.
+type authenticator struct {
+	username string
+	password string
+
+	// certUsers maps client certificate identities to usernames. If empty
+	// then the username is the certificate subject common name (or the
+	// first DNS SAN if the common name is empty) and any verified client
+	// certificate is accepted.
+	certUsers []certUserMapping
+
+	defaultMode   authMode
+	endpointModes map[string]authMode
+}
+
+// newAuthenticator creates a new authenticator from the server configuration.
+func newAuthenticator(config Config) (*authenticator, error) {
+	a := &authenticator{
+		username:    config.Username,
+		password:    config.Password,
+		defaultMode: authBasic,
+	}
+
+	if len(strings.TrimSpace(config.AuthMode)) > 0 {
+		m, err := parseAuthMode(config.AuthMode)
+		if err != nil {
+			return nil, err
+		}
+		a.defaultMode = m
+	}
+
+	modes, err := parseEndpointAuthModes(config.EndpointAuth)
+	if err != nil {
+		return nil, err
+	}
+	a.endpointModes = modes
+
+	users, err := parseCertUserMappings(config.ClientCertUsers)
+	if err != nil {
+		return nil, err
+	}
+	a.certUsers = users
+
+	// Client certificates can only be used if TLS is enabled and a client
+	// CA bundle is configured.
+	for _, m := range a.modes() {
+		if m != authMTLS && m != authEither {
+			continue
+		}
+		if !config.tlsEnabled() || len(config.ClientCAFile) == 0 {
+			return nil, fmt.Errorf("authentication mode %s requires TLS and a client CA bundle", m)
+		}
+	}
+
+	return a, nil
+}
+
+// modes returns all the authentication modes in use.
+func (a *authenticator) modes() []authMode {
+	modes := []authMode{a.defaultMode}
+	for _, m := range a.endpointModes {
+		modes = append(modes, m)
+	}
+
+	return modes
+}
+
+// modeFor returns the authentication mode of the endpoint at `path`. Basic
+// authentication without a configured username means that authentication is
+// disabled.
+func (a *authenticator) modeFor(path string) authMode {
+	m, ok := a.endpointModes[path]
+	if !ok {
+		m = a.defaultMode
+	}
+	if m == authBasic && len(a.username) == 0 {
+		return authNone
+	}
+
+	return m
+}
+
+// certUser returns the username for a verified client certificate. If the
+// certificate doesn't map to any username then `ok` is false.
+func (a *authenticator) certUser(cert *x509.Certificate) (string, bool) {
+	if len(a.certUsers) == 0 {
+		if len(cert.Subject.CommonName) > 0 {
+			return cert.Subject.CommonName, true
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], true
+		}
+		return "", false
+	}
+
+	for _, m := range a.certUsers {
+		if m.matches(cert) {
+			return m.username, true
+		}
+	}
+
+	return "", false
+}
+
+// verifiedClientCert returns the client certificate of a request if one was
+// presented and verified against the client CA bundle.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return r.TLS.PeerCertificates[0]
+}
+
+// newTLSConfig creates the TLS configuration used by the server. If a client
+// CA bundle is configured then clients _may_ present a certificate which will
+// be verified against it, whether a certificate is required depends on the
+// authentication mode of each endpoint.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Negotiate HTTP/2 with ALPN, with fallback to HTTP/1.1.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if len(config.ClientCAFile) > 0 {
+		pem, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no valid certificates found in client CA bundle", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authRequest returns a request to `/_/test` with the logger and request ID
+// set by the logging middleware, the basic auth credentials `user:pass` (if
+// `user` isn't empty) and a verified client certificate with the common name
+// `cn` (if not empty).
+func authRequest(user, pass, cn string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/_/test", nil)
+	ctx := context.WithValue(r.Context(), loggerKey, slog.New(slog.DiscardHandler))
+	ctx = context.WithValue(ctx, requestIDKey, "test")
+	r = r.WithContext(ctx)
+	if len(user) > 0 {
+		r.SetBasicAuth(user, pass)
+	}
+	if len(cn) > 0 {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+
+	return r
+}
+
+func TestAuthMidd(t *testing.T) {
+	auth := &authenticator{username: "admin", password: "secret"}
+	mapped := &authenticator{username: "admin", password: "secret",
+		certUsers: []certUserMapping{{kind: "cn", value: "device-1", username: "alice"}}}
+	noBasic := &authenticator{}
+
+	tests := []struct {
+		name       string
+		auth       *authenticator
+		mode       authMode
+		r          *http.Request
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "none", auth: auth, mode: authNone, r: authRequest("", "", ""),
+			wantStatus: http.StatusOK, wantUser: "anonymous"},
+		{name: "basic", auth: auth, mode: authBasic, r: authRequest("admin", "secret", ""),
+			wantStatus: http.StatusOK, wantUser: "admin"},
+		{name: "basic without credentials", auth: auth, mode: authBasic, r: authRequest("", "", ""),
+			wantStatus: http.StatusUnauthorized},
+		{name: "basic wrong password", auth: auth, mode: authBasic, r: authRequest("admin", "guess", ""),
+			wantStatus: http.StatusUnauthorized},
+		{name: "basic ignores certificates", auth: auth, mode: authBasic, r: authRequest("", "", "device-1"),
+			wantStatus: http.StatusUnauthorized},
+		{name: "mtls", auth: auth, mode: authMTLS, r: authRequest("", "", "device-1"),
+			wantStatus: http.StatusOK, wantUser: "device-1"},
+		{name: "mtls mapped", auth: mapped, mode: authMTLS, r: authRequest("", "", "device-1"),
+			wantStatus: http.StatusOK, wantUser: "alice"},
+		{name: "mtls not mapped", auth: mapped, mode: authMTLS, r: authRequest("", "", "device-2"),
+			wantStatus: http.StatusForbidden},
+		{name: "mtls without certificate", auth: auth, mode: authMTLS, r: authRequest("admin", "secret", ""),
+			wantStatus: http.StatusUnauthorized},
+		{name: "either with certificate", auth: auth, mode: authEither, r: authRequest("", "", "device-1"),
+			wantStatus: http.StatusOK, wantUser: "device-1"},
+		{name: "either with basic", auth: auth, mode: authEither, r: authRequest("admin", "secret", ""),
+			wantStatus: http.StatusOK, wantUser: "admin"},
+		{name: "either without username", auth: noBasic, mode: authEither, r: authRequest("admin", "secret", ""),
+			wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		var user string
+		h := authMidd(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ = r.Context().Value(userKey).(string)
+			if len(user) == 0 {
+				user = "anonymous"
+			}
+		}), tt.auth, tt.mode)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, tt.r)
+		if rec.Code != tt.wantStatus || user != tt.wantUser {
+			t.Errorf("%s: status %d, user %q, want %d, %q", tt.name, rec.Code, user, tt.wantStatus, tt.wantUser)
+		}
+	}
+}
+
+func TestAuthenticatorModeFor(t *testing.T) {
+	a := &authenticator{username: "admin", defaultMode: authBasic,
+		endpointModes: map[string]authMode{"/_/config": authEither, "/_/env": authNone}}
+	tests := []struct {
+		a    *authenticator
+		path string
+		want authMode
+	}{
+		{a, "/_/alloc", authBasic},
+		{a, "/_/config", authEither},
+		{a, "/_/env", authNone},
+		{&authenticator{defaultMode: authBasic}, "/_/alloc", authNone},
+	}
+	for _, tt := range tests {
+		if got := tt.a.modeFor(tt.path); got != tt.want {
+			t.Errorf("modeFor(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/conduitio/bwlimit"
+	"golang.org/x/time/rate"
+)
+
+// limitedListener is a net.Listener that limits the read and write bandwidth
+// (each, not combined) of the connections it accepts. Unlike
+// `bwlimit.Listener` the limit can be changed at any time and the change also
+// applies to the connections that are already open.
+type limitedListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	limit bwlimit.Byte
+	conns map[*limitedConn]struct{}
+}
+
+// newLimitedListener wraps `ln` such that each accepted connection is limited
+// to `limit` bytes per second for reads and for writes.
+func newLimitedListener(ln net.Listener, limit bwlimit.Byte) *limitedListener {
+	return &limitedListener{
+		Listener: ln,
+		limit:    limit,
+		conns:    make(map[*limitedConn]struct{}),
+	}
+}
+
+// Accept waits for and returns the next bandwidth limited connection.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := &limitedConn{Conn: bwlimit.NewConn(conn, l.limit, l.limit), l: l}
+	l.conns[c] = struct{}{}
+
+	return c, nil
+}
+
+// Limit returns the current bandwidth limit.
+func (l *limitedListener) Limit() bwlimit.Byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+// Conns returns the number of currently open connections.
+func (l *limitedListener) Conns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// SetLimit changes the bandwidth limit of future and currently open
+// connections.
+func (l *limitedListener) SetLimit(limit bwlimit.Byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	for c := range l.conns {
+		c.SetBandwidthLimit(limit)
+	}
+}
+
+// limitedConn is a bandwidth limited connection which is tracked by the
+// listener that accepted it until closed.
+type limitedConn struct {
+	*bwlimit.Conn
+
+	l    *limitedListener
+	once sync.Once
+}
+
+// Close closes the connection and stops tracking it.
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		defer c.l.mu.Unlock()
+
+		delete(c.l.conns, c)
+	})
+
+	return c.Conn.Close()
+}
+
+// packetBurst is the minimum burst of the UDP bandwidth limiters, it must be
+// at least the size of the biggest datagram.
+const packetBurst = 64 * 1024
+
+// peerLimiters are the read and write bandwidth limiters of one remote
+// address of a limitedPacketConn.
+type peerLimiters struct {
+	read     *rate.Limiter
+	write    *rate.Limiter
+	lastSeen time.Time
+}
+
+// limitedPacketConn is a net.PacketConn that limits the read and write
+// bandwidth (each, not combined) per remote address. It's the UDP (QUIC)
+// equivalent of limitedListener, where each remote address is the equivalent
+// of a connection.
+type limitedPacketConn struct {
+	net.PacketConn
+
+	mu        sync.Mutex
+	limit     bwlimit.Byte
+	peers     map[string]*peerLimiters
+	lastSweep time.Time
+}
+
+// newLimitedPacketConn wraps `pc` such that the traffic with each remote
+// address is limited to `limit` bytes per second for reads and for writes.
+func newLimitedPacketConn(pc net.PacketConn, limit bwlimit.Byte) *limitedPacketConn {
+	return &limitedPacketConn{
+		PacketConn: pc,
+		limit:      limit,
+		peers:      make(map[string]*peerLimiters),
+		lastSweep:  time.Now(),
+	}
+}
+
+// newPacketLimiter creates a token bucket for `limit` bytes per second.
+func newPacketLimiter(limit bwlimit.Byte) *rate.Limiter {
+	if limit <= 0 {
+		return rate.NewLimiter(rate.Inf, packetBurst)
+	}
+
+	return rate.NewLimiter(rate.Limit(limit), max(int(limit), packetBurst))
+}
+
+// peer returns (creating them if needed) the limiters of `addr`. Idle peers
+// are removed from time to time.
+func (c *limitedPacketConn) peer(addr net.Addr) *peerLimiters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, p := range c.peers {
+			if now.Sub(p.lastSeen) > time.Minute {
+				delete(c.peers, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		p = &peerLimiters{read: newPacketLimiter(c.limit), write: newPacketLimiter(c.limit)}
+		c.peers[addr.String()] = p
+	}
+	p.lastSeen = now
+
+	return p
+}
+
+// ReadFrom reads a packet, delaying its delivery according to the bandwidth
+// limit of the remote address.
+func (c *limitedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && n > 0 {
+		_ = c.peer(addr).read.WaitN(context.Background(), n)
+	}
+
+	return n, addr, err
+}
+
+// WriteTo writes a packet once allowed by the bandwidth limit of the remote
+// address.
+func (c *limitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	_ = c.peer(addr).write.WaitN(context.Background(), len(b))
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Limit returns the current bandwidth limit.
+func (c *limitedPacketConn) Limit() bwlimit.Byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.limit
+}
+
+// SetLimit changes the bandwidth limit of all the remote addresses.
+func (c *limitedPacketConn) SetLimit(limit bwlimit.Byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	for _, p := range c.peers {
+		for _, l := range []*rate.Limiter{p.read, p.write} {
+			if limit <= 0 {
+				l.SetLimit(rate.Inf)
+				continue
+			}
+			l.SetLimit(rate.Limit(limit))
+			l.SetBurst(max(int(limit), packetBurst))
+		}
+	}
+}
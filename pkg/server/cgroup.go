@@ -0,0 +1,329 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// cgroupRoot is where the cgroup filesystems are mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupUnlimited is the value above which a cgroup v1 limit means no limit
+// (it's reported as the maximum int64 rounded down to the page size).
+const cgroupUnlimited = 1 << 62
+
+// cgroup is the cgroup of the process, v2 (unified) or v1 (a directory per
+// controller).
+type cgroup struct {
+	v2 bool
+	// path is the path of the cgroup v2, or of the v1 `memory` controller.
+	path string
+	// dirs are the directories of the v1 controllers, or the directory of
+	// the cgroup v2 for "".
+	dirs map[string]string
+}
+
+// findCgroup locates the cgroup of the process with `/proc/self/cgroup`. If
+// the directory of the cgroup isn't found (like in a container with its own
+// cgroup namespace) the root of the mount is used.
+func findCgroup() (*cgroup, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cgroup of the process: %w", err)
+	}
+
+	v1 := map[string]string{}
+	v1Path, v2Path, hasV2 := "", "", false
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		// hierarchy-ID:controller-list:path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && len(fields[1]) == 0 {
+			v2Path, hasV2 = fields[2], true
+			continue
+		}
+		for _, ctrl := range strings.Split(fields[1], ",") {
+			if ctrl == "memory" {
+				v1Path = fields[2]
+			}
+			dir := cgroupDir(filepath.Join(cgroupRoot, fields[1]), fields[2])
+			if _, err := os.Stat(filepath.Join(cgroupRoot, fields[1])); err != nil {
+				dir = cgroupDir(filepath.Join(cgroupRoot, ctrl), fields[2])
+			}
+			v1[ctrl] = dir
+		}
+	}
+
+	// On hybrid hosts the controllers are still v1.
+	if _, ok := v1["memory"]; !ok && hasV2 {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+			return &cgroup{v2: true, path: v2Path, dirs: map[string]string{"": cgroupDir(cgroupRoot, v2Path)}}, nil
+		}
+	}
+	if len(v1) == 0 {
+		return nil, errors.New("no cgroup found")
+	}
+
+	return &cgroup{path: v1Path, dirs: v1}, nil
+}
+
+// cgroupDir returns the directory of the cgroup `path` in the mount `root`,
+// or `root` if it doesn't exist.
+func cgroupDir(root, path string) string {
+	dir := filepath.Join(root, path)
+	if _, err := os.Stat(dir); err != nil {
+		return root
+	}
+
+	return dir
+}
+
+// read returns the (trimmed) content of a file of the cgroup, `v1Ctrl` is the
+// controller of the file for a cgroup v1.
+func (c *cgroup) read(v1Ctrl, name string) (string, error) {
+	dir, ok := c.dirs[""]
+	if !c.v2 {
+		dir, ok = c.dirs[v1Ctrl]
+	}
+	if !ok {
+		return "", fmt.Errorf("%s: cgroup controller not found", v1Ctrl)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readUint returns a number of a file of the cgroup, `ok` is false for
+// `max` (v2) or a value meaning no limit (v1).
+func (c *cgroup) readUint(v1Ctrl, name string) (v uint64, ok bool, err error) {
+	s, err := c.read(v1Ctrl, name)
+	if err != nil {
+		return 0, false, err
+	}
+	if s == "max" || s == "-1" {
+		return 0, false, nil
+	}
+	v, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: invalid value '%s'", name, s)
+	}
+
+	return v, v < cgroupUnlimited, nil
+}
+
+// readKeyValues returns the `key value` lines of a file of the cgroup (or of
+// `/proc`) as numbers.
+func readKeyValues(s string) map[string]uint64 {
+	kv := map[string]uint64{}
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			kv[strings.TrimSuffix(fields[0], ":")] = n
+		}
+	}
+
+	return kv
+}
+
+// writeContainerStats writes the resources of the container (its cgroup)
+// and of the process (from `/proc`), with the memory limit compared to the
+// `allocated` memory of `/_/alloc`. The values which can't be read are
+// reported as unknown.
+func writeContainerStats(w io.Writer, allocated uint64) {
+	c, err := findCgroup()
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "\tcgroup = unknown (%v)\n", err)
+	} else {
+		writeCgroupStats(w, c, allocated)
+	}
+
+	rss := "unknown"
+	if v, err := procStatusField("VmRSS"); err == nil {
+		if kb, err := strconv.ParseUint(strings.TrimSuffix(v, " kB"), 10, 64); err == nil {
+			rss = humanize.Bytes(kb * 1024)
+		}
+	}
+	_, _ = fmt.Fprintf(w, "\tprocess RSS = %s\n", rss)
+
+	fds, limit := "unknown", "unknown"
+	if n, err := openFDs(); err == nil {
+		fds = strconv.Itoa(n)
+	}
+	if l, err := fdLimit(); err == nil {
+		limit = l
+	}
+	_, _ = fmt.Fprintf(w, "\topen file descriptors = %s (limit %s)\n", fds, limit)
+
+	if b, err := os.ReadFile("/proc/self/io"); err == nil {
+		pio := readKeyValues(string(b))
+		_, _ = fmt.Fprintf(w, "\tprocess I/O = read %s (%s from storage, %d syscalls), written %s (%s to storage, %d syscalls)\n",
+			humanize.Bytes(pio["rchar"]), humanize.Bytes(pio["read_bytes"]), pio["syscr"],
+			humanize.Bytes(pio["wchar"]), humanize.Bytes(pio["write_bytes"]), pio["syscw"])
+	} else {
+		_, _ = fmt.Fprintln(w, "\tprocess I/O = unknown")
+	}
+}
+
+// writeCgroupStats writes the limits, usage and events of the cgroup `c`,
+// with the `allocated` memory of `/_/alloc`.
+func writeCgroupStats(w io.Writer, c *cgroup, allocated uint64) {
+	version := "v1"
+	if c.v2 {
+		version = "v2"
+	}
+	_, _ = fmt.Fprintf(w, "\tcgroup = %s %s\n", version, c.path)
+
+	// Memory.
+	limitName, usageName := "memory.limit_in_bytes", "memory.usage_in_bytes"
+	if c.v2 {
+		limitName, usageName = "memory.max", "memory.current"
+	}
+	limit, limited, limitErr := c.readUint("memory", limitName)
+	usage, _, usageErr := c.readUint("memory", usageName)
+	switch {
+	case limitErr != nil:
+		_, _ = fmt.Fprintf(w, "\tmemory limit = unknown (%v)\n", limitErr)
+	case !limited:
+		_, _ = fmt.Fprintln(w, "\tmemory limit = unlimited")
+	default:
+		_, _ = fmt.Fprintf(w, "\tmemory limit = %s\n", humanize.Bytes(limit))
+	}
+	switch {
+	case usageErr != nil:
+		_, _ = fmt.Fprintf(w, "\tmemory usage = unknown (%v)\n", usageErr)
+	case limitErr == nil && limited && limit > 0:
+		_, _ = fmt.Fprintf(w, "\tmemory usage = %s (%.1f%% of the limit, /_/alloc %s)\n", humanize.Bytes(usage),
+			float64(usage)*100/float64(limit), humanize.Bytes(allocated))
+	default:
+		_, _ = fmt.Fprintf(w, "\tmemory usage = %s (/_/alloc %s)\n", humanize.Bytes(usage),
+			humanize.Bytes(allocated))
+	}
+	eventsName := "memory.oom_control"
+	if c.v2 {
+		eventsName = "memory.events"
+	}
+	if s, err := c.read("memory", eventsName); err == nil {
+		events := readKeyValues(s)
+		if oomKill, ok := events["oom_kill"]; ok {
+			_, _ = fmt.Fprintf(w, "\tOOM kill events = %d\n", oomKill)
+		} else {
+			_, _ = fmt.Fprintln(w, "\tOOM kill events = unknown")
+		}
+	} else {
+		_, _ = fmt.Fprintf(w, "\tOOM kill events = unknown (%v)\n", err)
+	}
+
+	// CPU.
+	var quota, period uint64
+	var quotaErr error
+	quotaLimited := false
+	if c.v2 {
+		s, err := c.read("cpu", "cpu.max")
+		quotaErr = err
+		if q, p, ok := strings.Cut(s, " "); err == nil && ok {
+			period, _ = strconv.ParseUint(p, 10, 64)
+			if q != "max" {
+				quota, _ = strconv.ParseUint(q, 10, 64)
+				quotaLimited = true
+			}
+		}
+	} else {
+		quota, quotaLimited, quotaErr = c.readUint("cpu", "cpu.cfs_quota_us")
+		if quotaErr == nil {
+			period, _, quotaErr = c.readUint("cpu", "cpu.cfs_period_us")
+		}
+	}
+	switch {
+	case quotaErr != nil:
+		_, _ = fmt.Fprintf(w, "\tCPU quota = unknown (%v)\n", quotaErr)
+	case !quotaLimited || period == 0:
+		_, _ = fmt.Fprintf(w, "\tCPU quota = unlimited (period %s)\n", time.Duration(period)*time.Microsecond)
+	default:
+		_, _ = fmt.Fprintf(w, "\tCPU quota = %s per %s period (%.2f CPUs)\n", time.Duration(quota)*time.Microsecond,
+			time.Duration(period)*time.Microsecond, float64(quota)/float64(period))
+	}
+	if s, err := c.read("cpu", "cpu.stat"); err == nil {
+		st := readKeyValues(s)
+		throttled := time.Duration(st["throttled_time"]) // v1, in ns.
+		if c.v2 {
+			throttled = time.Duration(st["throttled_usec"]) * time.Microsecond
+		}
+		_, _ = fmt.Fprintf(w, "\tCPU throttling = %d of %d periods throttled, for %s\n", st["nr_throttled"],
+			st["nr_periods"], throttled)
+	} else {
+		_, _ = fmt.Fprintf(w, "\tCPU throttling = unknown (%v)\n", err)
+	}
+
+	// PIDs.
+	pidsLimit := "unknown"
+	if v, ok, err := c.readUint("pids", "pids.max"); err == nil {
+		pidsLimit = "unlimited"
+		if ok {
+			pidsLimit = strconv.FormatUint(v, 10)
+		}
+	}
+	pids := "unknown"
+	if v, _, err := c.readUint("pids", "pids.current"); err == nil {
+		pids = strconv.FormatUint(v, 10)
+	}
+	_, _ = fmt.Fprintf(w, "\tpids = %s (limit %s)\n", pids, pidsLimit)
+
+	// I/O.
+	var read, written uint64
+	var ioErr error
+	if c.v2 {
+		var s string
+		if s, ioErr = c.read("", "io.stat"); ioErr == nil {
+			// One line per device: `major:minor rbytes=N wbytes=N ...`.
+			for _, line := range strings.Split(s, "\n") {
+				for _, f := range strings.Fields(line) {
+					k, v, _ := strings.Cut(f, "=")
+					n, _ := strconv.ParseUint(v, 10, 64)
+					switch k {
+					case "rbytes":
+						read += n
+					case "wbytes":
+						written += n
+					}
+				}
+			}
+		}
+	} else {
+		var s string
+		if s, ioErr = c.read("blkio", "blkio.throttle.io_service_bytes"); ioErr == nil {
+			// One line per device and operation: `major:minor Read N`.
+			for _, line := range strings.Split(s, "\n") {
+				if f := strings.Fields(line); len(f) == 3 {
+					n, _ := strconv.ParseUint(f[2], 10, 64)
+					switch f[1] {
+					case "Read":
+						read += n
+					case "Write":
+						written += n
+					}
+				}
+			}
+		}
+	}
+	if ioErr != nil {
+		_, _ = fmt.Fprintf(w, "\tcgroup I/O = unknown (%v)\n", ioErr)
+	} else {
+		_, _ = fmt.Fprintf(w, "\tcgroup I/O = read %s, written %s\n", humanize.Bytes(read), humanize.Bytes(written))
+	}
+}
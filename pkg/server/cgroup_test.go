@@ -0,0 +1,166 @@
+package server
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadKeyValues(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]uint64
+	}{
+		{in: "", want: map[string]uint64{}},
+		{
+			in:   "oom_kill_disable 0\nunder_oom 0\noom_kill 3\n",
+			want: map[string]uint64{"oom_kill_disable": 0, "under_oom": 0, "oom_kill": 3},
+		},
+		{
+			// /proc/self/io
+			in:   "rchar: 4096\nwchar: 12\nsyscr: 7\n",
+			want: map[string]uint64{"rchar": 4096, "wchar": 12, "syscr": 7},
+		},
+		{
+			in:   "nr_periods 10\nbad line here\nnegative -1\nname value\n",
+			want: map[string]uint64{"nr_periods": 10},
+		},
+	}
+	for _, tt := range tests {
+		if got := readKeyValues(tt.in); !maps.Equal(got, tt.want) {
+			t.Errorf("readKeyValues(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// writeFiles writes the files (name to content) in `dir`.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupReadUint(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"limit":     "1073741824\n",
+		"max":       "max\n",
+		"minus":     "-1\n",
+		"unlimited": "9223372036854771712\n",
+		"bad":       "lots\n",
+	})
+	c := &cgroup{dirs: map[string]string{"memory": dir}}
+
+	tests := []struct {
+		name    string
+		want    uint64
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "limit", want: 1 << 30, wantOK: true},
+		{name: "max"},
+		{name: "minus"},
+		{name: "unlimited", want: 9223372036854771712},
+		{name: "bad", wantErr: true},
+		{name: "missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, ok, err := c.readUint("memory", tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("readUint(%s) error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("readUint(%s) = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if _, _, err := c.readUint("cpu", "limit"); err == nil {
+		t.Errorf("readUint of a missing controller: expected an error")
+	}
+}
+
+func TestWriteCgroupStats(t *testing.T) {
+	v2 := t.TempDir()
+	writeFiles(t, v2, map[string]string{
+		"memory.max":     "1000000000\n",
+		"memory.current": "250000000\n",
+		"memory.events":  "low 0\nhigh 0\nmax 4\noom 2\noom_kill 1\n",
+		"cpu.max":        "50000 100000\n",
+		"cpu.stat":       "usage_usec 100\nnr_periods 20\nnr_throttled 5\nthrottled_usec 1500000\n",
+		"pids.max":       "max\n",
+		"pids.current":   "12\n",
+		"io.stat":        "8:0 rbytes=1000000 wbytes=2000000 rios=1 wios=2\n8:16 rbytes=500000 wbytes=0\n",
+	})
+	v1 := t.TempDir()
+	writeFiles(t, v1, map[string]string{
+		"memory.limit_in_bytes":           "9223372036854771712\n",
+		"memory.usage_in_bytes":           "3000000\n",
+		"memory.oom_control":              "oom_kill_disable 0\nunder_oom 0\n",
+		"cpu.cfs_quota_us":                "-1\n",
+		"cpu.cfs_period_us":               "100000\n",
+		"cpu.stat":                        "nr_periods 0\nnr_throttled 0\nthrottled_time 0\n",
+		"pids.max":                        "100\n",
+		"pids.current":                    "3\n",
+		"blkio.throttle.io_service_bytes": "8:0 Read 4000\n8:0 Write 1000\n8:0 Total 5000\nTotal 5000\n",
+	})
+
+	tests := []struct {
+		name  string
+		c     *cgroup
+		lines []string
+	}{
+		{
+			name: "v2",
+			c:    &cgroup{v2: true, path: "/app", dirs: map[string]string{"": v2}},
+			lines: []string{
+				"\tcgroup = v2 /app\n",
+				"\tmemory limit = 1.0 GB\n",
+				"\tmemory usage = 250 MB (25.0% of the limit, /_/alloc 100 MB)\n",
+				"\tOOM kill events = 1\n",
+				"\tCPU quota = 50ms per 100ms period (0.50 CPUs)\n",
+				"\tCPU throttling = 5 of 20 periods throttled, for 1.5s\n",
+				"\tpids = 12 (limit unlimited)\n",
+				"\tcgroup I/O = read 1.5 MB, written 2.0 MB\n",
+			},
+		},
+		{
+			name: "v1",
+			c: &cgroup{path: "/docker/abc", dirs: map[string]string{
+				"memory": v1, "cpu": v1, "pids": v1, "blkio": v1}},
+			lines: []string{
+				"\tcgroup = v1 /docker/abc\n",
+				"\tmemory limit = unlimited\n",
+				"\tmemory usage = 3.0 MB (/_/alloc 100 MB)\n",
+				"\tOOM kill events = unknown\n",
+				"\tCPU quota = unlimited (period 100ms)\n",
+				"\tCPU throttling = 0 of 0 periods throttled, for 0s\n",
+				"\tpids = 3 (limit 100)\n",
+				"\tcgroup I/O = read 4.0 kB, written 1.0 kB\n",
+			},
+		},
+		{
+			name: "v1 without controllers",
+			c:    &cgroup{path: "/", dirs: map[string]string{"memory": v1}},
+			lines: []string{
+				"\tCPU quota = unknown (cpu: cgroup controller not found)\n",
+				"\tpids = unknown (limit unknown)\n",
+				"\tcgroup I/O = unknown (blkio: cgroup controller not found)\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeCgroupStats(&b, tt.c, 100_000_000)
+		for _, line := range tt.lines {
+			if !strings.Contains(b.String(), line) {
+				t.Errorf("%s: missing %q in:\n%s", tt.name, line, b.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// defaultChaosExpiry is how long a chaos rule applies if not set.
+const defaultChaosExpiry = 10 * time.Minute
+
+// chaosActions are the faults which a chaos rule can inject.
+var chaosActions = []string{"status", "delay", "abort", "truncate"}
+
+// chaosRule injects a fault in the responses to the requests matching its
+// path pattern, with a probability.
+type chaosRule struct {
+	ID          string  `json:"id"`
+	Path        string  `json:"path"`
+	Probability float64 `json:"probability"`
+	Action      string  `json:"action"`
+	// Status is the status code returned by the `status` action.
+	Status int `json:"status,omitempty"`
+	// Delay is the latency added by the `delay` action.
+	Delay string `json:"delay,omitempty"`
+	// After is the number of bytes of the body sent before the `abort` or
+	// `truncate` actions.
+	After   int64     `json:"after"`
+	Expires time.Time `json:"expires,omitzero"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user"`
+	Hits    uint64    `json:"hits"`
+
+	delay time.Duration
+	hits  *atomic.Uint64
+}
+
+// matches returns true if the rule applies to `p`: the pattern is either a
+// path prefix or, if it contains wildcards, a pattern like `/*.iso`.
+func (cr *chaosRule) matches(p string) bool {
+	if strings.ContainsAny(cr.Path, "*?[") {
+		ok, _ := path.Match(cr.Path, p)
+		return ok
+	}
+
+	return strings.HasPrefix(p, cr.Path)
+}
+
+// expired returns true if the rule doesn't apply anymore at `now`.
+func (cr *chaosRule) expired(now time.Time) bool {
+	return !cr.Expires.IsZero() && now.After(cr.Expires)
+}
+
+// chaosRules are the chaos rules configured with `/_/chaos`.
+type chaosRules struct {
+	mu     sync.Mutex
+	rules  []*chaosRule
+	nextID int
+}
+
+// prune removes the expired rules, it must be called with the lock held.
+func (cs *chaosRules) prune(now time.Time) {
+	cs.rules = slices.DeleteFunc(cs.rules, func(cr *chaosRule) bool { return cr.expired(now) })
+}
+
+// list returns the rules which didn't expire, in the order they apply.
+func (cs *chaosRules) list() []chaosRule {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.prune(time.Now())
+	list := make([]chaosRule, 0, len(cs.rules))
+	for _, cr := range cs.rules {
+		c := *cr
+		c.Hits = cr.hits.Load()
+		list = append(list, c)
+	}
+
+	return list
+}
+
+// add adds the rule `cr`, which applies after the existing ones.
+func (cs *chaosRules) add(cr *chaosRule) chaosRule {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.prune(time.Now())
+	cs.nextID++
+	cr.ID = strconv.Itoa(cs.nextID)
+	cr.hits = new(atomic.Uint64)
+	cs.rules = append(cs.rules, cr)
+
+	return *cr
+}
+
+// remove removes the rule `id`, or all the rules if `id` is empty. Returns
+// the number of rules removed.
+func (cs *chaosRules) remove(id string) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	n := len(cs.rules)
+	cs.rules = slices.DeleteFunc(cs.rules, func(cr *chaosRule) bool { return len(id) == 0 || cr.ID == id })
+
+	return n - len(cs.rules)
+}
+
+// match returns the rules which fire for a request to `p`, each one being
+// drawn with its probability.
+func (cs *chaosRules) match(p string) []*chaosRule {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	var fired []*chaosRule
+	for _, cr := range cs.rules {
+		if cr.expired(now) || !cr.matches(p) {
+			continue
+		}
+		if mrand.Float64() < cr.Probability {
+			fired = append(fired, cr)
+		}
+	}
+
+	return fired
+}
+
+// chaosMidd is an HTTP middleware which injects the faults of the chaos rules
+// firing for a request: the `delay` rules add their latency, then the first
+// other rule (if any) returns its status code, or aborts the connection or
+// truncates the body after some bytes of the response.
+func chaosMidd(cs *chaosRules, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fired := cs.match(r.URL.Path)
+		if len(fired) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.Default()
+		}
+		id, _ := r.Context().Value(requestIDKey).(string)
+
+		inject := func(cr *chaosRule) {
+			cr.hits.Add(1)
+			reqLogger.Warn("Chaos fault injected", "id", id, "method", r.Method, "url", r.URL.Path,
+				"rule_id", cr.ID, "action", cr.Action)
+		}
+
+		var fault *chaosRule
+		for _, cr := range fired {
+			if cr.Action != "delay" {
+				if fault == nil {
+					fault = cr
+				}
+				continue
+			}
+			inject(cr)
+			if !sleep(cr.delay, r.Context().Done()) {
+				return
+			}
+		}
+		if fault != nil {
+			inject(fault)
+			switch fault.Action {
+			case "status":
+				http.Error(w, fmt.Sprintf("chaos: injected fault (rule %s)", fault.ID), fault.Status)
+				return
+			case "abort":
+				w = &abortWriter{ResponseWriter: w, remaining: fault.After}
+			case "truncate":
+				w = &truncateWriter{ResponseWriter: w, remaining: fault.After}
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// abortWriter is an http.ResponseWriter which aborts the connection once
+// `remaining` bytes of the body were sent, the response header keeps the
+// announced length (if any).
+type abortWriter struct {
+	http.ResponseWriter
+	remaining int64
+}
+
+// Write writes the body, until the connection is aborted.
+func (aw *abortWriter) Write(b []byte) (int, error) {
+	n := int(min(int64(len(b)), aw.remaining))
+	n, err := aw.ResponseWriter.Write(b[:n])
+	aw.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	if aw.remaining <= 0 {
+		_ = http.NewResponseController(aw.ResponseWriter).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	return n, nil
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (aw *abortWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// truncateWriter is an http.ResponseWriter which ends the body after
+// `remaining` bytes, while the response otherwise looks complete: the
+// announced length (if any) is removed and the handler doesn't notice.
+type truncateWriter struct {
+	http.ResponseWriter
+	remaining   int64
+	wroteHeader bool
+}
+
+// WriteHeader removes the length of the body and sends the response header.
+func (tw *truncateWriter) WriteHeader(code int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Del("Content-Length")
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the body until it's truncated, and discards the rest.
+func (tw *truncateWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	n := min(int64(len(b)), tw.remaining)
+	if n > 0 {
+		k, err := tw.ResponseWriter.Write(b[:n])
+		tw.remaining -= int64(k)
+		if err != nil {
+			return k, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (tw *truncateWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// parseChaosRule converts the query params of a `/_/chaos` request to a chaos
+// rule.
+func parseChaosRule(r *http.Request) (*chaosRule, error) {
+	var errs []error
+	query := r.URL.Query()
+
+	cr := &chaosRule{
+		Path:        "/",
+		Probability: 1,
+		Action:      query.Get("action"),
+		Created:     time.Now(),
+	}
+	if v := query.Get("path"); len(v) > 0 {
+		if _, err := path.Match(v, "/"); err != nil || !strings.HasPrefix(v, "/") {
+			errs = append(errs, fmt.Errorf("%s: invalid path pattern", v))
+		}
+		cr.Path = v
+	}
+	if v := query.Get("probability"); len(v) > 0 {
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || x <= 0 || x > 1 {
+			errs = append(errs, fmt.Errorf("%s: invalid probability (more than 0, at most 1)", v))
+		}
+		cr.Probability = x
+	}
+
+	switch cr.Action {
+	case "status":
+		cr.Status = http.StatusServiceUnavailable
+		if v := query.Get("status"); len(v) > 0 {
+			x, err := strconv.Atoi(v)
+			if err != nil || x < 100 || x > 999 {
+				errs = append(errs, fmt.Errorf("%s: invalid status code", v))
+			}
+			cr.Status = x
+		}
+	case "delay":
+		v := query.Get("delay")
+		x, err := time.ParseDuration(v)
+		if err != nil || x <= 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid delay", v))
+		}
+		cr.delay = x
+		cr.Delay = x.String()
+	case "abort", "truncate":
+		if v := query.Get("after"); len(v) > 0 {
+			x, err := humanize.ParseBytes(v)
+			if err != nil || x > 1<<40 {
+				errs = append(errs, fmt.Errorf("%s: invalid after size", v))
+			}
+			cr.After = int64(x)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s: invalid action (expected one of %v)", cr.Action, chaosActions))
+	}
+
+	expiry := defaultChaosExpiry
+	if v := query.Get("expires"); len(v) > 0 {
+		x, err := time.ParseDuration(v)
+		if err != nil || x < 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid expiry (0 means never)", v))
+		}
+		expiry = x
+	}
+	if expiry > 0 {
+		cr.Expires = cr.Created.Add(expiry)
+	}
+
+	return cr, errors.Join(errs...)
+}
+
+// writeChaosRules writes a list of chaos rules, as JSON if the client accepts
+// it and otherwise as text.
+func writeChaosRules(w http.ResponseWriter, r *http.Request, status int, title string, list []chaosRule) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Rules []chaosRule `json:"rules"`
+		}{list})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	writeChaosRulesText(w, title, list)
+}
+
+// writeChaosRulesText writes a list of chaos rules as text.
+func writeChaosRulesText(w io.Writer, title string, list []chaosRule) {
+	_, _ = fmt.Fprintf(w, "%s: %d\n", title, len(list))
+	for _, cr := range list {
+		_, _ = fmt.Fprintf(w, "\tid=%s path=%s probability=%g action=%s", cr.ID, cr.Path, cr.Probability, cr.Action)
+		switch cr.Action {
+		case "status":
+			_, _ = fmt.Fprintf(w, " status=%d", cr.Status)
+		case "delay":
+			_, _ = fmt.Fprintf(w, " delay=%s", cr.Delay)
+		default:
+			_, _ = fmt.Fprintf(w, " after=%s", humanize.Bytes(uint64(cr.After)))
+		}
+		expires := "never"
+		if !cr.Expires.IsZero() {
+			expires = cr.Expires.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(w, " expires=%s hits=%d created=%s user=%s\n", expires, cr.Hits,
+			cr.Created.Format(time.RFC3339), cr.User)
+	}
+}
+
+// chaosHandler is an HTTP handler that is used on the `/_/chaos` path: `POST`
+// adds a chaos rule with the `path` (a prefix or a pattern like `/*.iso`,
+// default: `/`), `probability` (default: 1), `action` (`status`, `delay`,
+// `abort` or `truncate`, with `status`, `delay` or `after`) and `expires`
+// (default: 10m, 0 means never) query params. `GET` lists the rules and
+// `DELETE` removes the rule `id`, or all of them with `all=true`.
+func chaosHandler(cs *chaosRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeChaosRules(w, r, http.StatusOK, "Chaos rules", cs.list())
+			return
+		case http.MethodDelete:
+			id := query.Get("id")
+			all, _ := strconv.ParseBool(query.Get("all"))
+			if len(id) == 0 && !all {
+				http.Error(w, "the chaos rule id (or all=true) must be set", http.StatusBadRequest)
+				return
+			}
+			if all {
+				id = ""
+			}
+			n := cs.remove(id)
+			if n == 0 && !all {
+				http.Error(w, fmt.Sprintf("%s: unknown chaos rule", id), http.StatusNotFound)
+				return
+			}
+			reqLogger.Info("Chaos rules removed", "rule_id", id, "removed", n)
+			_, _ = fmt.Fprintf(w, "Removed %d chaos rule(s)\n", n)
+			return
+		}
+
+		cr, err := parseChaosRule(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		cr.User = user
+
+		added := cs.add(cr)
+		reqLogger.Warn("Chaos rule added", "rule_id", added.ID, "path", added.Path,
+			"probability", added.Probability, "action", added.Action, "expires", added.Expires)
+		writeChaosRules(w, r, http.StatusCreated, "Chaos rules added", []chaosRule{added})
+	})
+}
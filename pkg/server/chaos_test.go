@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaosRule(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    chaosRule
+		expires time.Duration
+		wantErr string
+	}{
+		{
+			query:   "action=status",
+			want:    chaosRule{Path: "/", Probability: 1, Action: "status", Status: http.StatusServiceUnavailable},
+			expires: defaultChaosExpiry,
+		},
+		{
+			query:   "action=status&status=429&path=/_/version&probability=0.25&expires=1m",
+			want:    chaosRule{Path: "/_/version", Probability: 0.25, Action: "status", Status: 429},
+			expires: time.Minute,
+		},
+		{
+			query:   "action=delay&delay=1500ms&path=/*.iso&expires=0",
+			want:    chaosRule{Path: "/*.iso", Probability: 1, Action: "delay", Delay: "1.5s", delay: 1500 * time.Millisecond},
+			expires: 0,
+		},
+		{
+			query:   "action=truncate&after=1KiB",
+			want:    chaosRule{Path: "/", Probability: 1, Action: "truncate", After: 1024},
+			expires: defaultChaosExpiry,
+		},
+		{
+			query:   "action=abort",
+			want:    chaosRule{Path: "/", Probability: 1, Action: "abort"},
+			expires: defaultChaosExpiry,
+		},
+		{query: "", wantErr: "invalid action"},
+		{query: "action=explode", wantErr: "invalid action"},
+		{query: "action=status&status=42", wantErr: "invalid status code"},
+		{query: "action=delay", wantErr: "invalid delay"},
+		{query: "action=delay&delay=-1s", wantErr: "invalid delay"},
+		{query: "action=abort&after=lots", wantErr: "invalid after size"},
+		{query: "action=status&probability=0", wantErr: "invalid probability"},
+		{query: "action=status&probability=1.5", wantErr: "invalid probability"},
+		{query: "action=status&path=version", wantErr: "invalid path pattern"},
+		{query: "action=status&path=/[", wantErr: "invalid path pattern"},
+		{query: "action=status&expires=-1m", wantErr: "invalid expiry"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/_/chaos?"+tt.query, nil)
+		got, err := parseChaosRule(r)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want it to contain %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.query, err)
+			continue
+		}
+		if got.Expires.Sub(got.Created) != tt.expires && !(tt.expires == 0 && got.Expires.IsZero()) {
+			t.Errorf("%s: expires after %s, want %s", tt.query, got.Expires.Sub(got.Created), tt.expires)
+		}
+		got.Created, got.Expires = time.Time{}, time.Time{}
+		if *got != tt.want {
+			t.Errorf("%s: parseChaosRule() = %+v, want %+v", tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestChaosRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/_/", "/_/version", true},
+		{"/_/", "/index.html", false},
+		{"/*.iso", "/eve.iso", true},
+		{"/*.iso", "/images/eve.iso", false},
+		{"/_/leak/?ds", "/_/leak/fds", true},
+	}
+	for _, tt := range tests {
+		cr := &chaosRule{Path: tt.pattern}
+		if got := cr.matches(tt.path); got != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestChaosWriters(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 10; i++ {
+			if _, err := w.Write([]byte(body[i*10 : (i+1)*10])); err != nil {
+				t.Errorf("write: %v", err)
+			}
+		}
+	})
+
+	tests := []struct {
+		action    string
+		after     int64
+		want      string
+		wantAbort bool
+	}{
+		{action: "truncate", after: 25, want: body[:25]},
+		{action: "truncate", after: 0, want: ""},
+		{action: "truncate", after: 1000, want: body},
+		{action: "abort", after: 25, want: body[:25], wantAbort: true},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		var w http.ResponseWriter = &truncateWriter{ResponseWriter: rec, remaining: tt.after}
+		if tt.action == "abort" {
+			w = &abortWriter{ResponseWriter: rec, remaining: tt.after}
+		}
+
+		aborted := func() (aborted bool) {
+			defer func() {
+				if v := recover(); v != nil {
+					err, ok := v.(error)
+					aborted = ok && errors.Is(err, http.ErrAbortHandler)
+				}
+			}()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			return false
+		}()
+
+		if aborted != tt.wantAbort {
+			t.Errorf("%s after %d: aborted = %v, want %v", tt.action, tt.after, aborted, tt.wantAbort)
+		}
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s after %d: body %q, want %q", tt.action, tt.after, got, tt.want)
+		}
+		if cl := rec.Header().Get("Content-Length"); tt.action == "truncate" && len(cl) > 0 {
+			t.Errorf("%s after %d: Content-Length %s kept", tt.action, tt.after, cl)
+		}
+	}
+}
+
+func TestChaosMiddStatus(t *testing.T) {
+	var cs chaosRules
+	cs.add(&chaosRule{Path: "/_/version", Probability: 1, Action: "status", Status: http.StatusTeapot})
+	cs.add(&chaosRule{Path: "/gone", Probability: 1, Action: "status", Status: http.StatusGone,
+		Expires: time.Now().Add(-time.Second)})
+	h := chaosMidd(&cs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	for path, want := range map[string]int{"/_/version": http.StatusTeapot, "/gone": http.StatusOK, "/": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+	if list := cs.list(); len(list) != 1 || list[0].Hits != 1 {
+		t.Errorf("rules after the requests = %+v, want the unexpired rule with 1 hit", list)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies is a list of networks from which proxy headers (e.g.
+// X-Forwarded-For) are trusted when determining the real client IP address of
+// a request.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma separated list of CIDRs (e.g.
+// `10.0.0.0/8,fd00::/8`) or plain IP addresses.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var proxies trustedProxies
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid trusted proxy CIDR: %w", entry, err)
+			}
+			proxies = append(proxies, p.Masked())
+			continue
+		}
+
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid trusted proxy address: %w", entry, err)
+		}
+		ip = ip.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+
+	return proxies, nil
+}
+
+// trusts returns true if `ip` belongs to any of the trusted proxy networks.
+func (t trustedProxies) trusts(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range t {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHostAddr parses an IP address which might have a port and might be
+// enclosed in brackets (IPv6), as found in RemoteAddr or proxy headers.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap(), true
+}
+
+// forwardedFor returns the `for=` addresses of an RFC 7239 `Forwarded` header,
+// in order from the client to the closest proxy. Multiple header fields are
+// treated as a single comma separated list.
+func forwardedFor(values []string) []string {
+	var addrs []string
+
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				addrs = append(addrs, strings.Trim(strings.TrimSpace(val), `"`))
+			}
+		}
+	}
+
+	return addrs
+}
+
+// forwardedChain returns the client address chain as recorded by proxies,
+// preferring the standard `Forwarded` header over `X-Forwarded-For`.
+func forwardedChain(r *http.Request) []string {
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		return forwardedFor(fwd)
+	}
+
+	var addrs []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, a := range strings.Split(v, ",") {
+			addrs = append(addrs, strings.TrimSpace(a))
+		}
+	}
+
+	return addrs
+}
+
+// clientIP extracts the real client IP address from an HTTP request. Proxy
+// headers are only considered if the request comes directly from a trusted
+// proxy, otherwise the address of the socket peer is returned. When the peer
+// is trusted the headers are checked in the following priority order:
+//  1. Fly-Client-IP (used by Fly.io proxy)
+//  2. X-Real-IP (used by Nginx and others)
+//  3. Forwarded (RFC 7239) or X-Forwarded-For, walked right-to-left skipping
+//     trusted proxies, the first untrusted address being the client.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		// Not an IP address, e.g. a Unix socket.
+		return r.RemoteAddr
+	}
+	if !t.trusts(peer) {
+		return peer.String()
+	}
+
+	// Single value headers set by the (trusted) proxy in front of us.
+	for _, h := range []string{"Fly-Client-IP", "X-Real-IP"} {
+		if ip, ok := parseHostAddr(r.Header.Get(h)); ok {
+			return ip.String()
+		}
+	}
+
+	client := peer
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, ok := parseHostAddr(chain[i])
+		if !ok {
+			// Obfuscated identifier (e.g. `unknown`) or garbage, can't
+			// go further than the last trusted hop.
+			break
+		}
+		client = ip
+		if !t.trusts(ip) {
+			break
+		}
+	}
+
+	return client.String()
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{values: nil, want: nil},
+		{values: []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, want: []string{"192.0.2.60"}},
+		{values: []string{`For="[2001:db8:cafe::17]:4711"`}, want: []string{"[2001:db8:cafe::17]:4711"}},
+		{values: []string{"for=192.0.2.43, for=198.51.100.17"}, want: []string{"192.0.2.43", "198.51.100.17"}},
+		{values: []string{"for=192.0.2.43", "proto=https;for=unknown"}, want: []string{"192.0.2.43", "unknown"}},
+		{values: []string{"by=203.0.113.43;proto=http"}, want: nil},
+	}
+	for _, tt := range tests {
+		if got := forwardedFor(tt.values); !slices.Equal(got, tt.want) {
+			t.Errorf("forwardedFor(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer headers ignored", remote: "203.0.113.5:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			want:    "203.0.113.5"},
+		{name: "mapped IPv4 peer", remote: "[::ffff:10.1.2.3]:80", want: "10.1.2.3"},
+		{name: "trusted peer without headers", remote: "10.1.2.3:80", want: "10.1.2.3"},
+		{name: "fly client ip first", remote: "10.1.2.3:80",
+			headers: map[string]string{"Fly-Client-IP": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			want:    "198.51.100.1"},
+		{name: "real ip", remote: "192.168.1.1:80",
+			headers: map[string]string{"X-Real-IP": "198.51.100.2"}, want: "198.51.100.2"},
+		{name: "x-forwarded-for skips trusted hops", remote: "10.1.2.3:80",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.9, 198.51.100.1, 10.9.9.9"},
+			want:    "198.51.100.1"},
+		{name: "forwarded preferred over x-forwarded-for", remote: "10.1.2.3:80",
+			headers: map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`, "X-Forwarded-For": "198.51.100.1"},
+			want:    "2001:db8::1"},
+		{name: "obfuscated hop stops the walk", remote: "10.1.2.3:80",
+			headers: map[string]string{"Forwarded": "for=198.51.100.1, for=_hidden, for=10.2.2.2"},
+			want:    "10.2.2.2"},
+		{name: "all hops trusted", remote: "[fd00::1]:80",
+			headers: map[string]string{"X-Forwarded-For": "10.3.3.3"}, want: "10.3.3.3"},
+		{name: "not an ip", remote: "@", want: "@"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := proxies.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "10.0.0.0/8,fd00::/8", want: 2},
+		{in: " 192.168.1.1 , ::1 ", want: 2},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "not-an-ip", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrustedProxies(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if len(got) != tt.want {
+			t.Errorf("parseTrustedProxies(%q) = %v, want %d entries", tt.in, got, tt.want)
+		}
+	}
+}
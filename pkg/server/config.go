@@ -0,0 +1,441 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/conduitio/bwlimit"
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when displaying the configuration.
+const redacted = "REDACTED"
+
+// Config holds the configuration for the server. The field tags are the keys
+// used in a configuration file (YAML or TOML).
+type Config struct {
+	// Listen is the address (host:port) on which the server should listen.
+	// Ignored if Listeners is set.
+	Listen string `yaml:"listen" toml:"listen" json:"listen"`
+
+	// Listeners configures several listeners instead of the single Listen
+	// one. It's a list of listeners separated by `;` (or new lines), each
+	// a comma separated list of `key=value` settings: `addr` (required),
+	// `name`, `network` (`tcp`, `tcp4`, `tcp6` or `unix`), `tls`, `h2c`,
+	// `http3`, `bw_limit` and `endpoints` (`+` separated endpoint groups `static`,
+	// `public`, `admin`, `all` or path prefixes). For example
+	// `name=public,addr=:8080,endpoints=static;name=mgmt,addr=127.0.0.1:9090,endpoints=admin+public`.
+	Listeners string `yaml:"listeners" toml:"listeners" json:"listeners"`
+
+	// AddrFile is an optional file to which the addresses the server
+	// listens on are written once listening, one per line in the order of
+	// the listeners. Useful with `:0` (ephemeral port) listen addresses.
+	AddrFile string `yaml:"addr_file" toml:"addr_file" json:"addr_file"`
+
+	// StaticDir is the directory from which to serve static files.
+	StaticDir string `yaml:"static_dir" toml:"static_dir" json:"static_dir"`
+
+	// BwLimit limits the read and write bandwidth (each, not combined) of
+	// the entire server. A string like `2m, 2mb, 2M or 2MB`, all meaning
+	// 2 megabytes per second.
+	BwLimit string `yaml:"bw_limit" toml:"bw_limit" json:"bw_limit"`
+
+	// Username for HTTP basic authentication. Empty string disables authentication.
+	Username string `yaml:"username" toml:"username" json:"username"`
+
+	// Password for HTTP basic authentication.
+	Password string `yaml:"password" toml:"password" json:"password"`
+
+	// TLSCertFile is the PEM encoded certificate used to serve HTTPS. TLS
+	// is enabled only if both TLSCertFile and TLSKeyFile are set.
+	TLSCertFile string `yaml:"tls_cert_file" toml:"tls_cert_file" json:"tls_cert_file"`
+
+	// TLSKeyFile is the PEM encoded private key for TLSCertFile.
+	TLSKeyFile string `yaml:"tls_key_file" toml:"tls_key_file" json:"tls_key_file"`
+
+	// ClientCAFile is a PEM bundle of CA certificates used to verify TLS
+	// client certificates (mutual TLS). Requires TLS to be enabled.
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file" json:"client_ca_file"`
+
+	// ClientCertUsers maps client certificate identities to usernames, in
+	// the format `kind:identity=username,...` where kind is one of `cn`,
+	// `dns`, `email` or `uri`. If empty, the certificate subject common
+	// name is used as the username and any verified certificate is
+	// accepted. Otherwise certificates which don't match are refused.
+	ClientCertUsers string `yaml:"client_cert_users" toml:"client_cert_users" json:"client_cert_users"`
+
+	// AuthMode is the default authentication mode of the authenticated
+	// endpoints: `none`, `basic` (default), `mtls` or `either`.
+	AuthMode string `yaml:"auth_mode" toml:"auth_mode" json:"auth_mode"`
+
+	// EndpointAuth overrides AuthMode for individual endpoints, in the
+	// format `path=mode,...`, for example `/_/crash=mtls,/_/logs=either`.
+	EndpointAuth string `yaml:"endpoint_auth" toml:"endpoint_auth" json:"endpoint_auth"`
+
+	// TrustedProxies is a comma separated list of CIDRs (or addresses) of
+	// the proxies from which client address headers (Forwarded,
+	// X-Forwarded-For, X-Real-IP, Fly-Client-IP) are trusted. If empty the
+	// headers are ignored and the socket peer address is used.
+	TrustedProxies string `yaml:"trusted_proxies" toml:"trusted_proxies" json:"trusted_proxies"`
+
+	// RateLimit is the default request rate limit of each client (an
+	// authenticated user or, for the endpoints without authentication, a
+	// client IP address), e.g. `10/s`, `100/m` or `10/s:20` with a burst of
+	// 20. The failed authentication attempts of each client IP address are
+	// limited with the same rate. Empty or `0` disables it.
+	RateLimit string `yaml:"rate_limit" toml:"rate_limit" json:"rate_limit"`
+
+	// RateLimits are per path prefix request rate limits which take
+	// precedence over RateLimit, in the format `prefix=rate,...`, for
+	// example `/_/alloc=1/s:2,/_/upload=10/m`.
+	RateLimits string `yaml:"rate_limits" toml:"rate_limits" json:"rate_limits"`
+
+	// LogLevel is the minimum level of the log messages written to stderr:
+	// `debug` (default), `info`, `warn` or `error`. The logs returned by
+	// `/_/logs` always include all levels.
+	LogLevel string `yaml:"log_level" toml:"log_level" json:"log_level"`
+
+	// OnPanic selects what happens when a request handler panics:
+	// `recover` (default) logs the panic and returns a 500 response,
+	// `crash` exits the process (like an unrecovered panic), for example to
+	// test the restart policy of the app instance.
+	OnPanic string `yaml:"on_panic" toml:"on_panic" json:"on_panic"`
+
+	// HealthMinFreeDisk is the minimum free disk space (like `100MB`) of
+	// the filesystem of the static directory, below which the readiness
+	// probe fails. Empty or `0` disables the check.
+	HealthMinFreeDisk string `yaml:"health_min_free_disk" toml:"health_min_free_disk" json:"health_min_free_disk"`
+
+	// HealthMaxMemory is the maximum memory used by the Go runtime (like
+	// `1GB`) above which the liveness probe fails. Empty or `0` disables
+	// the check.
+	HealthMaxMemory string `yaml:"health_max_memory" toml:"health_max_memory" json:"health_max_memory"`
+
+	// AllocLimit is the maximum total size (like `1GB`, the default) of the
+	// memory allocations made with `/_/alloc`, beyond which allocations
+	// are refused unless forced. Empty or `0` disables the limit.
+	AllocLimit string `yaml:"alloc_limit" toml:"alloc_limit" json:"alloc_limit"`
+
+	// DiskDir is the directory in which the `/_/disk` jobs write their files
+	// (default: `_/disk` in the static directory), for example on the
+	// volume of the app instance to exhaust.
+	DiskDir string `yaml:"disk_dir" toml:"disk_dir" json:"disk_dir"`
+
+	// CrashFile is the file in which the crashes scheduled with `/_/crash`
+	// for the next starts are persisted (default:
+	// `hello-zedcloud-crash.json` in the temporary directory). It must
+	// survive the restarts of the app instance to simulate crash loops.
+	CrashFile string `yaml:"crash_file" toml:"crash_file" json:"crash_file"`
+
+	// Scenario is a scenario file, or an inline scenario in YAML or JSON
+	// (with several lines or starting with `{`), run once the server is
+	// started, see `/_/scenario`. Inline scenarios can be set with the
+	// environment, for example by the custom config of EVE-OS.
+	Scenario string `yaml:"scenario" toml:"scenario" json:"scenario"`
+
+	// Peers is a comma separated list of peer instances which are probed
+	// continuously: base URLs (like `http://10.1.0.3:8080`), `host:port`
+	// addresses (using HTTPS if TLS is enabled) or DNS SRV names prefixed
+	// with `srv:` (like `srv:_hello._tcp.example.com`), resolved every probe
+	// interval.
+	Peers string `yaml:"peers" toml:"peers" json:"peers"`
+
+	// PeerDiscovery is the UDP address (`ip:port`) of the multicast group
+	// (like `239.255.72.65:7946`) or the broadcast address (like
+	// `255.255.255.255:7946`) on which the instances announce themselves
+	// to discover each other. Empty disables the discovery.
+	PeerDiscovery string `yaml:"peer_discovery" toml:"peer_discovery" json:"peer_discovery"`
+
+	// PeerName is the name of this instance in the connectivity matrix
+	// (default: the hostname).
+	PeerName string `yaml:"peer_name" toml:"peer_name" json:"peer_name"`
+
+	// PeerInterval is the interval between the probes of the peers, and
+	// between the discovery announcements (default: `10s`).
+	PeerInterval string `yaml:"peer_interval" toml:"peer_interval" json:"peer_interval"`
+
+	// PeerSampleSize is the size (like `256KB`, the default) of the
+	// throughput sample sent to `/_/echo` of each peer at every probe. `0`
+	// disables the throughput samples.
+	PeerSampleSize string `yaml:"peer_sample_size" toml:"peer_sample_size" json:"peer_sample_size"`
+
+	// Version is the version string of this web server app. It can't be
+	// set from a configuration file.
+	Version string `yaml:"-" toml:"-" json:"-"`
+}
+
+// tlsEnabled returns true if the server should serve HTTPS.
+func (c Config) tlsEnabled() bool {
+	return len(c.TLSCertFile) > 0 && len(c.TLSKeyFile) > 0
+}
+
+// parsedConfig holds the parsed form of the settings of a Config.
+type parsedConfig struct {
+	limit     bwlimit.Byte
+	auth      *authenticator
+	proxies   trustedProxies
+	limiter   *rateLimiter
+	tlsConfig *tls.Config
+	logLevel  slog.Level
+	listeners []listenerSpec
+
+	// crashOnPanic is true if the process should crash when a request
+	// handler panics.
+	crashOnPanic bool
+
+	health healthThresholds
+
+	// allocLimit is the maximum total size of the memory allocations, 0
+	// means no limit.
+	allocLimit uint64
+
+	// scenario is run once the server is started, if not nil.
+	scenario *scenario
+
+	peers peerConfig
+}
+
+// healthThresholds are the limits used by the built-in health checks, 0
+// disables a check.
+type healthThresholds struct {
+	minFreeDisk uint64
+	maxMemory   uint64
+}
+
+// parseSize parses an optional size like `100MB` of the `setting`. An empty
+// string means 0.
+func parseSize(setting, s string) (uint64, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return 0, nil
+	}
+
+	x, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", setting, s, err)
+	}
+
+	return x, nil
+}
+
+// parseLogLevel parses a log level name. An empty string means `debug`.
+func parseLogLevel(s string) (slog.Level, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return slog.LevelDebug, nil
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return l, fmt.Errorf("%s: invalid log level (expected one of debug, info, warn, error)", s)
+	}
+
+	return l, nil
+}
+
+// parseBwLimit parses a bandwidth limit. An empty string or `0` means the
+// default limit of 2GB/s.
+func parseBwLimit(s string) (bwlimit.Byte, error) {
+	limit := 2 * bwlimit.GB
+	if len(s) > 0 && s != "0" {
+		x, err := humanize.ParseBytes(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bandwidth limit '%s': %w", s, err)
+		}
+		limit = bwlimit.Byte(int(x))
+	}
+
+	return limit, nil
+}
+
+// listenerSpecs returns the listeners of the configuration: the Listeners or
+// else the single Listen one.
+func (c Config) listenerSpecs() ([]listenerSpec, error) {
+	if strings.TrimSpace(c.Listeners) != "" {
+		specs, err := parseListenerSpecs(c.Listeners, c.tlsEnabled())
+		if err != nil {
+			return nil, fmt.Errorf("invalid listeners configuration: %w", err)
+		}
+		return specs, nil
+	}
+	if c.Listen == "" {
+		return nil, fmt.Errorf("listen address cannot be empty")
+	}
+
+	return []listenerSpec{{
+		name:      "default",
+		network:   "tcp",
+		address:   c.Listen,
+		tls:       c.tlsEnabled(),
+		endpoints: []string{groupAll},
+	}}, nil
+}
+
+// parse validates and parses the configuration. All the problems found are
+// returned (joined) instead of stopping at the first one.
+func (c Config) parse() (*parsedConfig, error) {
+	var (
+		p    parsedConfig
+		errs []error
+		err  error
+	)
+
+	if p.listeners, err = c.listenerSpecs(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.StaticDir == "" {
+		errs = append(errs, fmt.Errorf("static directory cannot be empty"))
+	}
+
+	if p.limit, err = parseBwLimit(c.BwLimit); err != nil {
+		errs = append(errs, err)
+	}
+
+	tlsOK := true
+	if (len(c.TLSCertFile) > 0) != (len(c.TLSKeyFile) > 0) {
+		errs = append(errs, fmt.Errorf("both the TLS certificate and key must be set to enable TLS"))
+		tlsOK = false
+	}
+	if len(c.ClientCAFile) > 0 && !c.tlsEnabled() {
+		errs = append(errs, fmt.Errorf("client CA bundle requires TLS to be enabled"))
+		tlsOK = false
+	}
+	if tlsOK && c.tlsEnabled() {
+		if p.tlsConfig, err = newTLSConfig(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if p.auth, err = newAuthenticator(c); err != nil {
+		errs = append(errs, fmt.Errorf("invalid authentication configuration: %w", err))
+	}
+
+	if p.proxies, err = parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+
+	if p.limiter, err = newRateLimiter(c.RateLimit, c.RateLimits); err != nil {
+		errs = append(errs, fmt.Errorf("invalid rate limit configuration: %w", err))
+	}
+
+	if p.logLevel, err = parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+
+	if p.health.minFreeDisk, err = parseSize("minimum free disk space", c.HealthMinFreeDisk); err != nil {
+		errs = append(errs, err)
+	}
+	if p.health.maxMemory, err = parseSize("maximum memory", c.HealthMaxMemory); err != nil {
+		errs = append(errs, err)
+	}
+
+	if p.allocLimit, err = parseSize("allocation limit", c.AllocLimit); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(strings.TrimSpace(c.Scenario)) > 0 {
+		if p.scenario, err = loadScenario(c.Scenario); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if p.peers, err = parsePeerConfig(c); err != nil {
+		errs = append(errs, fmt.Errorf("invalid peers configuration: %w", err))
+	}
+
+	switch strings.ToLower(strings.TrimSpace(c.OnPanic)) {
+	case "", "recover":
+	case "crash":
+		p.crashOnPanic = true
+	default:
+		errs = append(errs, fmt.Errorf("%s: invalid on panic setting (expected recover or crash)", c.OnPanic))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return &p, nil
+}
+
+// Validate checks the configuration and returns an error listing every
+// problem found, or nil if the configuration is valid.
+func (c Config) Validate() error {
+	_, err := c.parse()
+	return err
+}
+
+// Redacted returns a copy of the configuration with secrets replaced, such
+// that it can be displayed.
+func (c Config) Redacted() Config {
+	if len(c.Password) > 0 {
+		c.Password = redacted
+	}
+
+	return c
+}
+
+// LoadConfigFile reads the configuration file at `path` on top of `config`,
+// meaning that only the settings present in the file are changed. The format
+// (YAML or TOML) is selected by the file extension (`.yaml`, `.yml` or
+// `.toml`). Unknown settings are reported as errors.
+func LoadConfigFile(path string, config Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return config, fmt.Errorf("%s: invalid YAML config file: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), &config)
+		if err != nil {
+			return config, fmt.Errorf("%s: invalid TOML config file: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, k := range undecoded {
+				keys = append(keys, k.String())
+			}
+			return config, fmt.Errorf("%s: unknown settings in config file: %s", path,
+				strings.Join(keys, ", "))
+		}
+	default:
+		return config, fmt.Errorf("%s: unsupported config file extension '%s' (expected .yaml, .yml or .toml)",
+			path, ext)
+	}
+
+	return config, nil
+}
+
+// marshalConfig encodes the configuration in the given format (`yaml`,
+// `toml` or `json`).
+func marshalConfig(config Config, format string) ([]byte, error) {
+	switch format {
+	case "", "yaml", "yml":
+		return yaml.Marshal(config)
+	case "toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "json":
+		return json.MarshalIndent(config, "", "  ")
+	default:
+		return nil, fmt.Errorf("%s: unsupported format (expected yaml, toml or json)", format)
+	}
+}
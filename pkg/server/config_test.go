@@ -0,0 +1,115 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	base := Config{Listen: ":8080", LogLevel: "debug", Username: "admin"}
+
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    Config
+		wantErr string
+	}{
+		{
+			name: "yaml overrides only the present settings",
+			file: "config.yaml",
+			data: "listen: \":9090\"\nlog_level: info\n",
+			want: Config{Listen: ":9090", LogLevel: "info", Username: "admin"},
+		},
+		{
+			name: "yml extension",
+			file: "config.YML",
+			data: "password: secret\n",
+			want: Config{Listen: ":8080", LogLevel: "debug", Username: "admin", Password: "secret"},
+		},
+		{
+			name: "empty yaml",
+			file: "config.yaml",
+			data: "",
+			want: base,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			data: "listen = \":9091\"\nrate_limit = \"10/s\"\n",
+			want: Config{Listen: ":9091", LogLevel: "debug", Username: "admin", RateLimit: "10/s"},
+		},
+		{
+			name:    "unknown yaml setting",
+			file:    "config.yaml",
+			data:    "listen: \":9090\"\nlisten_port: 9090\n",
+			wantErr: "listen_port",
+		},
+		{
+			name:    "unknown toml setting",
+			file:    "config.toml",
+			data:    "listen_port = 9090\n",
+			wantErr: "unknown settings in config file: listen_port",
+		},
+		{
+			name:    "invalid toml",
+			file:    "config.toml",
+			data:    "listen = \n",
+			wantErr: "invalid TOML config file",
+		},
+		{
+			name:    "unsupported extension",
+			file:    "config.json",
+			data:    "{}",
+			wantErr: "unsupported config file extension",
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := LoadConfigFile(path, base)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: config = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"), base); err == nil {
+		t.Errorf("missing file: expected an error")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("DefaultConfig().Validate() = %v", err)
+	}
+
+	c := DefaultConfig()
+	c.LogLevel = "loud"
+	c.RateLimit = "10"
+	c.OnPanic = "ignore"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Every problem is reported.
+	for _, s := range []string{"loud", "10", "ignore"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q doesn't mention %q", err, s)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// cpuBurnPeriod is the period of the duty cycle of the CPU burn workers:
+	// in each period a worker spins for the target percentage of it and
+	// sleeps for the rest.
+	cpuBurnPeriod = 100 * time.Millisecond
+
+	// maxCPUBurnWorkers is the maximum number of workers of all the CPU
+	// burns in progress.
+	maxCPUBurnWorkers = 1024
+
+	// defaultCPUSample is the default duration over which the process CPU
+	// usage is measured.
+	defaultCPUSample = time.Second
+)
+
+// cpuBurn is a CPU burn started with `/_/cpu`.
+type cpuBurn struct {
+	ID       string    `json:"id"`
+	Workers  int       `json:"workers"`
+	Percent  int       `json:"percent"`
+	Duration string    `json:"duration"`
+	Started  time.Time `json:"started"`
+	User     string    `json:"user"`
+
+	// cancel stops the workers of the burn.
+	cancel context.CancelFunc
+}
+
+// cpuBurner tracks the CPU burns in progress.
+type cpuBurner struct {
+	mu     sync.Mutex
+	burns  []*cpuBurn
+	nextID int
+}
+
+// list returns the CPU burns in progress, oldest first.
+func (cb *cpuBurner) list() []cpuBurn {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := make([]cpuBurn, 0, len(cb.burns))
+	for _, b := range cb.burns {
+		list = append(list, cpuBurn{ID: b.ID, Workers: b.Workers, Percent: b.Percent, Duration: b.Duration,
+			Started: b.Started, User: b.User})
+	}
+
+	return list
+}
+
+// start starts `workers` workers, each using `percent` of a CPU, for
+// `duration` (0 means until stopped), unless the burns in progress would then
+// have more than maxCPUBurnWorkers workers in total.
+func (cb *cpuBurner) start(workers, percent int, duration time.Duration, user string) (cpuBurn, error) {
+	d := "until stopped"
+	if duration > 0 {
+		d = duration.String()
+	}
+
+	cb.mu.Lock()
+	total := 0
+	for _, b := range cb.burns {
+		total += b.Workers
+	}
+	if total+workers > maxCPUBurnWorkers {
+		cb.mu.Unlock()
+		return cpuBurn{}, fmt.Errorf("%d workers of the CPU burns in progress, starting %d more would be above "+
+			"the maximum of %d, stop some first", total, workers, maxCPUBurnWorkers)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	cb.nextID++
+	b := &cpuBurn{
+		ID:       strconv.Itoa(cb.nextID),
+		Workers:  workers,
+		Percent:  percent,
+		Duration: d,
+		Started:  time.Now(),
+		User:     user,
+		cancel:   cancel,
+	}
+	cb.burns = append(cb.burns, b)
+	cb.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			burnCPU(percent, ctx.Done())
+		}()
+	}
+	// Remove the burn once all its workers are done.
+	go func() {
+		wg.Wait()
+		cancel()
+		cb.mu.Lock()
+		cb.burns = slices.DeleteFunc(cb.burns, func(x *cpuBurn) bool { return x == b })
+		cb.mu.Unlock()
+	}()
+
+	return cpuBurn{ID: b.ID, Workers: b.Workers, Percent: b.Percent, Duration: b.Duration,
+		Started: b.Started, User: b.User}, nil
+}
+
+// halt stops the burn `id`, or all the burns if `id` is empty. Returns the
+// number of burns stopped.
+func (cb *cpuBurner) halt(id string) int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	n := 0
+	for _, b := range cb.burns {
+		if len(id) == 0 || b.ID == id {
+			b.cancel()
+			n++
+		}
+	}
+
+	return n
+}
+
+// burnCPU spins for `percent` of every cpuBurnPeriod and sleeps for the rest,
+// until `stop` is closed.
+func burnCPU(percent int, stop <-chan struct{}) {
+	busy := cpuBurnPeriod * time.Duration(percent) / 100
+	for {
+		start := time.Now()
+		for time.Since(start) < busy {
+			// Spin.
+		}
+		if percent == 100 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			continue
+		}
+		if !sleep(cpuBurnPeriod-busy, stop) {
+			return
+		}
+	}
+}
+
+// cpuUsage is the measured CPU usage of the process, and the CPUs available
+// to it.
+type cpuUsage struct {
+	// Percent is the CPU usage in percent of one CPU (200% means two CPUs
+	// fully used).
+	Percent    float64 `json:"percent"`
+	Sample     string  `json:"sample"`
+	NumCPU     int     `json:"num_cpu"`
+	GoMaxProcs int     `json:"gomaxprocs"`
+	// CPUsAllowed is the list of the CPUs on which the process can run
+	// (its CPU affinity, Linux only).
+	CPUsAllowed string `json:"cpus_allowed,omitempty"`
+}
+
+// cpusAllowed returns the list of the CPUs on which the process can run, as
+// reported by Linux, or an empty string.
+func cpusAllowed() string {
+	v, _ := procStatusField("Cpus_allowed_list")
+
+	return v
+}
+
+// measureCPU measures the CPU usage of the process over `sample`.
+func measureCPU(sample time.Duration, stop <-chan struct{}) (cpuUsage, error) {
+	u := cpuUsage{
+		Sample:      sample.String(),
+		NumCPU:      runtime.NumCPU(),
+		GoMaxProcs:  runtime.GOMAXPROCS(0),
+		CPUsAllowed: cpusAllowed(),
+	}
+
+	before, err := processCPUTime()
+	if err != nil {
+		return u, err
+	}
+	start := time.Now()
+	sleep(sample, stop)
+	after, err := processCPUTime()
+	if err != nil {
+		return u, err
+	}
+	u.Percent = float64(after-before) / float64(time.Since(start)) * 100
+
+	return u, nil
+}
+
+// cpuStatus is the response of `/_/cpu`.
+type cpuStatus struct {
+	Burns []cpuBurn `json:"burns"`
+	Usage cpuUsage  `json:"usage"`
+	Error string    `json:"error,omitempty"`
+}
+
+// writeText writes the CPU burns and the CPU usage as text.
+func (cs cpuStatus) writeText(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "CPU burns: %d\n", len(cs.Burns))
+	for _, b := range cs.Burns {
+		_, _ = fmt.Fprintf(w, "\tid=%s workers=%d percent=%d duration=%s started=%s user=%s\n", b.ID, b.Workers,
+			b.Percent, b.Duration, b.Started.Format(time.RFC3339), b.User)
+	}
+	if len(cs.Error) > 0 {
+		_, _ = fmt.Fprintf(w, "Process CPU usage: unknown: %s\n", cs.Error)
+		return
+	}
+	u := cs.Usage
+	_, _ = fmt.Fprintf(w, "Process CPU usage: %.1f%% (%.2f CPUs) over %s\n", u.Percent, u.Percent/100, u.Sample)
+	_, _ = fmt.Fprintf(w, "\tnum_cpu=%d gomaxprocs=%d", u.NumCPU, u.GoMaxProcs)
+	if len(u.CPUsAllowed) > 0 {
+		_, _ = fmt.Fprintf(w, " cpus_allowed=%s", u.CPUsAllowed)
+	}
+	_, _ = fmt.Fprintln(w)
+}
+
+// cpuHandler is an HTTP handler that is used on the `/_/cpu` path: `POST`
+// starts burning CPU with the `workers` (default: 1), `percent` (target
+// utilization of each worker, default: 100) and `duration` (default: 30s, 0
+// means until stopped) query params. `GET` lists the CPU burns and measures
+// the process CPU usage over `sample` (default: 1s). `DELETE` stops the burn
+// `id`, or all of them with `all=true`.
+func cpuHandler(cb *cpuBurner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			sample := defaultCPUSample
+			if v := query.Get("sample"); len(v) > 0 {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 || d > time.Minute {
+					http.Error(w, fmt.Sprintf("%s: invalid sample duration (at most 1m)", v), http.StatusBadRequest)
+					return
+				}
+				sample = d
+			}
+			cs := cpuStatus{Burns: cb.list()}
+			var err error
+			if cs.Usage, err = measureCPU(sample, r.Context().Done()); err != nil {
+				cs.Error = err.Error()
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(cs)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			cs.writeText(w)
+			return
+		case http.MethodDelete:
+			id := query.Get("id")
+			all, _ := strconv.ParseBool(query.Get("all"))
+			if len(id) == 0 && !all {
+				http.Error(w, "the CPU burn id (or all=true) must be set", http.StatusBadRequest)
+				return
+			}
+			if all {
+				id = ""
+			}
+			n := cb.halt(id)
+			if n == 0 && !all {
+				http.Error(w, fmt.Sprintf("%s: unknown CPU burn", id), http.StatusNotFound)
+				return
+			}
+			reqLogger.Info("CPU burn stopped", "burn_id", id, "stopped", n)
+			_, _ = fmt.Fprintf(w, "Stopped %d CPU burn(s)\n", n)
+			return
+		}
+
+		workers, percent, duration := 1, 100, 30*time.Second
+		var err error
+		if v := query.Get("workers"); len(v) > 0 {
+			if workers, err = strconv.Atoi(v); err != nil || workers < 1 || workers > maxCPUBurnWorkers {
+				http.Error(w, fmt.Sprintf("%s: invalid number of workers (1 to %d)", v, maxCPUBurnWorkers),
+					http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("percent"); len(v) > 0 {
+			if percent, err = strconv.Atoi(v); err != nil || percent < 1 || percent > 100 {
+				http.Error(w, fmt.Sprintf("%s: invalid percent (1 to 100)", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("duration"); len(v) > 0 {
+			if duration, err = time.ParseDuration(v); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("%s: invalid duration", v), http.StatusBadRequest)
+				return
+			}
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+
+		b, err := cb.start(workers, percent, duration, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		reqLogger.Warn("CPU burn started", "burn_id", b.ID, "workers", workers, "percent", percent,
+			"duration", duration)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, "CPU burn started (id %s): %d worker(s) at %d%%, duration %s\n", b.ID, workers, percent,
+			b.Duration)
+	})
+}
@@ -0,0 +1,24 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import (
+	"strconv"
+	"time"
+)
+
+// processCPUTime returns the CPU time used by the process so far, as
+// estimated by the Go runtime (the OS measurement isn't supported on this
+// platform).
+func processCPUTime() (time.Duration, error) {
+	v, err := getRuntimeStat("/cpu/classes/total:cpu-seconds")
+	if err != nil {
+		return 0, err
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the CPU time (user and system) used by the process
+// so far, as measured by the OS.
+func processCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, fmt.Errorf("failed to get the process resource usage: %w", err)
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
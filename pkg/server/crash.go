@@ -0,0 +1,336 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCrashDelay is how long the process keeps running after a crash
+	// was requested, such that the response can be sent.
+	defaultCrashDelay = 2 * time.Second
+
+	// maxCrashDelay is the maximum crash delay.
+	maxCrashDelay = time.Hour
+
+	// minCrashLoopDelay is the minimum delay of a crash on every start,
+	// such that it can still be cancelled with `/_/crash` after a start.
+	minCrashLoopDelay = 10 * time.Second
+)
+
+// crashModes are the ways `/_/crash` can crash the process.
+var crashModes = []string{"exit", "panic", "segv", "sigkill", "sigabrt", "deadlock", "hang"}
+
+// signalModes are the crash modes which send a signal to the process itself.
+var signalModes = []string{"sigkill", "sigabrt", "hang"}
+
+// crashFile returns the file in which the crashes scheduled for the next
+// starts are persisted.
+func crashFile(c Config) string {
+	if len(c.CrashFile) > 0 {
+		return c.CrashFile
+	}
+
+	return filepath.Join(os.TempDir(), "hello-zedcloud-crash.json")
+}
+
+// crasher crashes the process on demand, see crashHandler.
+type crasher struct {
+	// gate is read locked by every request, such that a deadlock holding
+	// it blocks them all.
+	gate sync.RWMutex
+	// other is the other lock of the deadlock.
+	other sync.Mutex
+}
+
+// gateMidd is an HTTP middleware which blocks the requests while the gate is
+// locked (by a deadlock).
+func (c *crasher) gateMidd(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only waits for the gate to be unlocked.
+		c.gate.RLock()
+		c.gate.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// crash crashes the process with `mode`, `exitCode` is used by `exit` (and
+// if sending a signal fails). It only returns for `hang` once the process is
+// continued.
+func (c *crasher) crash(logger *slog.Logger, mode string, exitCode int) {
+	logger.Error("Crashing the process as requested", "mode", mode, "exit_code", exitCode)
+
+	switch mode {
+	case "panic":
+		panic(fmt.Sprintf("crash requested with /_/crash (mode %s)", mode))
+	case "segv":
+		var p *int
+		*p = exitCode // Nil pointer dereference.
+	case "sigkill", "sigabrt", "hang":
+		if err := signalSelf(mode); err != nil {
+			logger.Error("Failed to signal the process, exiting instead", "mode", mode, "error", err)
+			os.Exit(exitCode)
+		}
+	case "deadlock":
+		// Two goroutines locking the same two locks in opposite orders,
+		// while one of them is needed by every request.
+		go func() {
+			c.other.Lock()
+			time.Sleep(100 * time.Millisecond)
+			c.gate.Lock()
+		}()
+		c.gate.Lock()
+		time.Sleep(100 * time.Millisecond)
+		c.other.Lock()
+	default:
+		os.Exit(exitCode)
+	}
+}
+
+// pendingCrash is a crash scheduled for the next start(s) of the process,
+// persisted in the crash file.
+type pendingCrash struct {
+	Mode     string `json:"mode"`
+	ExitCode int    `json:"exit_code"`
+	Delay    string `json:"delay"`
+	// Starts is the number of starts which still crash, 0 means every
+	// start until cancelled.
+	Starts  int       `json:"starts"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user"`
+}
+
+// String describes the crash on one line.
+func (pc pendingCrash) String() string {
+	starts := "every start until cancelled"
+	if pc.Starts > 0 {
+		starts = fmt.Sprintf("the next %d start(s)", pc.Starts)
+	}
+
+	return fmt.Sprintf("mode %s (exit code %d) %s after %s, scheduled %s by %s", pc.Mode, pc.ExitCode, pc.Delay,
+		starts, pc.Created.Format(time.RFC3339), pc.User)
+}
+
+// loadPendingCrash reads the crash scheduled in `path`, nil if none.
+func loadPendingCrash(path string) (*pendingCrash, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the crash file: %w", err)
+	}
+	var pc pendingCrash
+	if err := json.Unmarshal(b, &pc); err != nil {
+		return nil, fmt.Errorf("%s: invalid crash file: %w", path, err)
+	}
+
+	return &pc, nil
+}
+
+// savePendingCrash writes `pc` in `path` (atomically), or removes `path` if
+// `pc` is nil.
+func savePendingCrash(path string, pc *pendingCrash) error {
+	if pc == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove the crash file: %w", err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(pc)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write the crash file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write the crash file: %w", err)
+	}
+
+	return nil
+}
+
+// crashOnStart schedules the crash persisted for this start, if any.
+func (s *Server) crashOnStart() {
+	path := crashFile(s.config)
+	pc, err := loadPendingCrash(path)
+	if err != nil {
+		s.logger.Error("Failed to load the crash scheduled on start", "error", err)
+		return
+	}
+	if pc == nil {
+		return
+	}
+	delay, err := time.ParseDuration(pc.Delay)
+	if err != nil {
+		s.logger.Error("Invalid delay of the crash scheduled on start", "delay", pc.Delay)
+		return
+	}
+	// Leave time to cancel a crash on every start (like one written in
+	// the crash file by hand).
+	if pc.Starts == 0 && delay < minCrashLoopDelay {
+		delay = minCrashLoopDelay
+	}
+
+	s.logger.Warn("Crash scheduled on start", "mode", pc.Mode, "exit_code", pc.ExitCode, "delay", delay,
+		"starts", pc.Starts, "crash_file", path)
+	time.AfterFunc(delay, func() {
+		// The crash may have been cancelled (or changed) in the meantime.
+		pc, err := loadPendingCrash(path)
+		if err != nil || pc == nil {
+			s.logger.Info("Crash scheduled on start was cancelled")
+			return
+		}
+		// Count this start before crashing.
+		switch pc.Starts {
+		case 0:
+		case 1:
+			err = savePendingCrash(path, nil)
+		default:
+			pc.Starts--
+			err = savePendingCrash(path, pc)
+		}
+		if err != nil {
+			s.logger.Error("Failed to update the crash scheduled on start", "error", err)
+		}
+		s.crash.crash(s.logger, pc.Mode, pc.ExitCode)
+	})
+}
+
+// crashHandler is an HTTP handler that is used on the `/_/crash` path and
+// which crashes the server process with `DELETE`, if called with the
+// appropriate query: the `mode` (default: `exit`), `exitCode` (default: `77`)
+// and `delay` (default: `2s`). With `next_start=true` the crash happens
+// `delay` after the next `starts` starts (default: `1`, `0` means every
+// start, with a `delay` of at least 10s) instead, and `cancel=true` cancels
+// it. `GET` returns the crash scheduled on the next start, if any.
+func crashHandler(c *crasher, logger *slog.Logger, file func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		if r.Method == http.MethodGet {
+			pc, err := loadPendingCrash(file())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(struct {
+					Pending *pendingCrash `json:"pending"`
+				}{pc})
+				return
+			}
+			if pc == nil {
+				_, _ = fmt.Fprintln(w, "No crash scheduled on start")
+				return
+			}
+			_, _ = fmt.Fprintf(w, "Crash scheduled on start: %s\n", pc)
+			return
+		}
+
+		if areYouSure, ok := query["areYouSure"]; !ok || len(areYouSure) != 1 || areYouSure[0] != "YesIAmSure" {
+			http.Error(w, "I'm sorry, Dave. I'm afraid I can't do that.",
+				http.StatusNotAcceptable)
+			return
+		}
+
+		if cancel, _ := strconv.ParseBool(query.Get("cancel")); cancel {
+			if err := savePendingCrash(file(), nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reqLogger.Info("Crash scheduled on start cancelled")
+			_, _ = fmt.Fprintln(w, "Crash scheduled on start cancelled")
+			return
+		}
+
+		exitCode := 77
+		if ec, ok := query["exitCode"]; ok && len(ec) == 1 {
+			x, err := strconv.Atoi(ec[0])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: invalid exit code", ec[0]),
+					http.StatusBadRequest)
+				return
+			}
+			exitCode = x
+		}
+		mode := "exit"
+		if v := query.Get("mode"); len(v) > 0 {
+			mode = v
+		}
+		if !slices.Contains(crashModes, mode) {
+			http.Error(w, fmt.Sprintf("%s: invalid mode (expected one of %v)", mode, crashModes),
+				http.StatusBadRequest)
+			return
+		}
+		if slices.Contains(signalModes, mode) && !signalsSupported {
+			http.Error(w, fmt.Sprintf("%s: mode not supported on this platform", mode), http.StatusNotImplemented)
+			return
+		}
+		delay := defaultCrashDelay
+		if v := query.Get("delay"); len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 || d > maxCrashDelay {
+				http.Error(w, fmt.Sprintf("%s: invalid delay (at most %s)", v, maxCrashDelay), http.StatusBadRequest)
+				return
+			}
+			delay = d
+		}
+
+		if nextStart, _ := strconv.ParseBool(query.Get("next_start")); nextStart {
+			starts := 1
+			if v := query.Get("starts"); len(v) > 0 {
+				x, err := strconv.Atoi(v)
+				if err != nil || x < 0 {
+					http.Error(w, fmt.Sprintf("%s: invalid number of starts", v), http.StatusBadRequest)
+					return
+				}
+				starts = x
+			}
+			if starts == 0 && delay < minCrashLoopDelay {
+				http.Error(w, fmt.Sprintf("%s: delay too short to cancel a crash on every start (at least %s)",
+					delay, minCrashLoopDelay), http.StatusBadRequest)
+				return
+			}
+			user, ok := r.Context().Value(userKey).(string)
+			if !ok {
+				user = "anonymous"
+			}
+			pc := &pendingCrash{Mode: mode, ExitCode: exitCode, Delay: delay.String(), Starts: starts,
+				Created: time.Now(), User: user}
+			if err := savePendingCrash(file(), pc); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reqLogger.Warn("Crash scheduled on start", "mode", mode, "exit_code", exitCode, "delay", delay,
+				"starts", starts)
+			_, _ = fmt.Fprintf(w, "Dave, I will crash on start: %s.\n", pc)
+			return
+		}
+
+		reqLogger.Warn("Crash requested", "mode", mode, "exit_code", exitCode, "delay", delay)
+		http.Error(w, "Dave, this conversation can serve no purpose anymore. Good-bye.",
+			http.StatusInternalServerError)
+
+		time.AfterFunc(delay, func() { c.crash(logger, mode, exitCode) })
+	})
+}
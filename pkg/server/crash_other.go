@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import (
+	"fmt"
+)
+
+// signalsSupported is true if the process can send signals to itself.
+const signalsSupported = false
+
+// signalSelf is not supported on this platform.
+func signalSelf(mode string) error {
+	return fmt.Errorf("%s: signals not supported on this platform", mode)
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalsSupported is true if the process can send signals to itself.
+const signalsSupported = true
+
+// signalSelf sends to the process itself the signal of the crash `mode`:
+// `SIGKILL`, `SIGABRT` or `SIGSTOP` (`hang`).
+func signalSelf(mode string) error {
+	sig := syscall.SIGKILL
+	switch mode {
+	case "sigabrt":
+		sig = syscall.SIGABRT
+	case "hang":
+		sig = syscall.SIGSTOP
+	}
+
+	return syscall.Kill(os.Getpid(), sig)
+}
@@ -0,0 +1,706 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// maxDiskWorkers is the maximum number of workers of a disk I/O job.
+	maxDiskWorkers = 64
+
+	// maxDiskBlock is the maximum block size of a disk job.
+	maxDiskBlock = 64 << 20
+
+	// maxDiskDuration is the maximum duration of a disk I/O job.
+	maxDiskDuration = 24 * time.Hour
+)
+
+// diskModes are the modes of the disk jobs: `fill` writes files until the
+// requested size is reached (or the disk is full), the other ones are I/O
+// workloads on a file per worker, named like the fio ones.
+var diskModes = []string{"fill", "read", "write", "rw", "randread", "randwrite", "randrw"}
+
+// diskDir returns the directory in which the `/_/disk` jobs write their
+// files.
+func diskDir(c Config) string {
+	if len(c.DiskDir) > 0 {
+		return c.DiskDir
+	}
+
+	return filepath.Join(c.StaticDir, "_", "disk")
+}
+
+// diskJob is a disk fill or disk I/O job started with `/_/disk`.
+type diskJob struct {
+	id       string
+	mode     string
+	dir      string
+	size     uint64
+	fileSize uint64
+	block    uint64
+	rate     uint64
+	workers  int
+	duration time.Duration
+	fsync    bool
+	started  time.Time
+	user     string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	read    atomic.Uint64
+	written atomic.Uint64
+	ops     atomic.Uint64
+
+	mu       sync.Mutex
+	state    string
+	err      string
+	measured time.Time // When the I/O started being measured.
+	finished time.Time
+	files    []string
+}
+
+// diskJobStatus is the state and the results of a disk job.
+type diskJobStatus struct {
+	ID       string    `json:"id"`
+	Mode     string    `json:"mode"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Dir      string    `json:"dir"`
+	Size     uint64    `json:"size"`
+	Block    uint64    `json:"block"`
+	Rate     uint64    `json:"rate,omitempty"`
+	Workers  int       `json:"workers"`
+	Duration string    `json:"duration,omitempty"`
+	Fsync    bool      `json:"fsync"`
+	Started  time.Time `json:"started"`
+	User     string    `json:"user"`
+	Files    int       `json:"files"`
+
+	Elapsed         string  `json:"elapsed"`
+	Read            uint64  `json:"read"`
+	Written         uint64  `json:"written"`
+	Ops             uint64  `json:"ops"`
+	IOPS            float64 `json:"iops"`
+	ReadThroughput  float64 `json:"read_throughput"`
+	WriteThroughput float64 `json:"write_throughput"`
+}
+
+// status returns the state and the results (so far) of the job.
+func (j *diskJob) status() diskJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	js := diskJobStatus{
+		ID:      j.id,
+		Mode:    j.mode,
+		State:   j.state,
+		Error:   j.err,
+		Dir:     j.dir,
+		Size:    j.size,
+		Block:   j.block,
+		Rate:    j.rate,
+		Workers: j.workers,
+		Fsync:   j.fsync,
+		Started: j.started,
+		User:    j.user,
+		Files:   len(j.files),
+		Read:    j.read.Load(),
+		Written: j.written.Load(),
+		Ops:     j.ops.Load(),
+	}
+	if j.mode != "fill" {
+		js.Duration = j.duration.String()
+	}
+	if j.measured.IsZero() {
+		js.Elapsed = "0s"
+		return js
+	}
+	end := j.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(j.measured)
+	js.Elapsed = elapsed.Round(time.Millisecond).String()
+	if secs := elapsed.Seconds(); secs > 0 {
+		js.IOPS = float64(js.Ops) / secs
+		js.ReadThroughput = float64(js.Read) / secs
+		js.WriteThroughput = float64(js.Written) / secs
+	}
+
+	return js
+}
+
+// setState sets the state of the job, and starts measuring the I/O when it
+// starts running.
+func (j *diskJob) setState(state string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.state = state
+	if state == "running" {
+		j.measured = time.Now()
+	}
+}
+
+// addFile records a file written by the job, removed by a cleanup.
+func (j *diskJob) addFile(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.files = append(j.files, path)
+}
+
+// throttle sleeps as needed to keep the job at its rate (if any). Returns
+// false if the job was stopped in the meantime.
+func (j *diskJob) throttle(ctx context.Context) bool {
+	if j.rate == 0 {
+		return true
+	}
+	j.mu.Lock()
+	measured := j.measured
+	j.mu.Unlock()
+
+	done := j.read.Load() + j.written.Load()
+	ahead := time.Duration(float64(done)/float64(j.rate)*float64(time.Second)) - time.Since(measured)
+	if ahead <= 0 {
+		return true
+	}
+
+	return sleep(ahead, ctx.Done())
+}
+
+// randomBlock returns a block of `size` random bytes, such that the data
+// written can't be compressed by the filesystem.
+func randomBlock(size uint64) []byte {
+	buf := make([]byte, size)
+	_, _ = io.ReadFull(loadgen.RandomReader(), buf)
+
+	return buf
+}
+
+// run runs the job until it's done, stopped or fails.
+func (j *diskJob) run(ctx context.Context) {
+	defer close(j.done)
+	defer j.cancel()
+
+	var err error
+	if j.mode == "fill" {
+		err = j.fill(ctx)
+	} else {
+		err = j.runIO(ctx)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.finished = time.Now()
+	switch {
+	case ctx.Err() != nil:
+		j.state = "stopped"
+	case errors.Is(err, syscall.ENOSPC):
+		j.state = "disk full"
+		j.err = err.Error()
+	case err != nil:
+		j.state = "failed"
+		j.err = err.Error()
+	default:
+		j.state = "done"
+	}
+}
+
+// fill writes files of `fileSize` in the directory of the job until `size`
+// bytes are written, or the disk is full.
+func (j *diskJob) fill(ctx context.Context) error {
+	if err := os.MkdirAll(j.dir, os.ModePerm); err != nil {
+		return err
+	}
+	buf := randomBlock(j.block)
+	j.setState("running")
+
+	var written uint64
+	for n := 0; written < j.size; n++ {
+		path := filepath.Join(j.dir, fmt.Sprintf("fill-%s-%d.bin", j.id, n))
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		j.addFile(path)
+
+		size := min(j.fileSize, j.size-written)
+		for fw := uint64(0); fw < size; {
+			if ctx.Err() != nil || !j.throttle(ctx) {
+				_ = f.Close()
+				return ctx.Err()
+			}
+			k, err := f.Write(buf[:min(uint64(len(buf)), size-fw)])
+			fw += uint64(k)
+			written += uint64(k)
+			j.written.Add(uint64(k))
+			j.ops.Add(1)
+			if err == nil && j.fsync {
+				err = f.Sync()
+			}
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runIO lays out a file per worker, then runs the I/O workload of the job on
+// them for its duration.
+func (j *diskJob) runIO(ctx context.Context) error {
+	if err := os.MkdirAll(j.dir, os.ModePerm); err != nil {
+		return err
+	}
+	buf := randomBlock(j.block)
+
+	// The files are written first (not measured) such that the reads hit
+	// the disk blocks instead of a sparse file.
+	files := make([]*os.File, 0, j.workers)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for w := range j.workers {
+		path := filepath.Join(j.dir, fmt.Sprintf("io-%s-%d.bin", j.id, w))
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return err
+		}
+		j.addFile(path)
+		files = append(files, f)
+		for off := uint64(0); off < j.size; off += j.block {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, err := f.Write(buf); err != nil {
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	j.setState("running")
+
+	deadline := time.Now().Add(j.duration)
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for w, f := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[w] = j.ioWorker(ctx, f, buf, deadline, int64(w))
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// ioWorker runs the I/O workload of the job on `f` until `deadline`.
+func (j *diskJob) ioWorker(ctx context.Context, f *os.File, buf []byte, deadline time.Time, seed int64) error {
+	rnd := mrand.New(mrand.NewSource(time.Now().UnixNano() + seed))
+	random := j.mode == "randread" || j.mode == "randwrite" || j.mode == "randrw"
+	blocks := int64(j.size / j.block)
+
+	var off int64
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil || !j.throttle(ctx) {
+			return ctx.Err()
+		}
+		if random {
+			off = rnd.Int63n(blocks) * int64(j.block)
+		}
+		var write bool
+		switch j.mode {
+		case "write", "randwrite":
+			write = true
+		case "rw", "randrw":
+			write = rnd.Intn(2) == 0
+		}
+
+		if write {
+			k, err := f.WriteAt(buf, off)
+			j.written.Add(uint64(k))
+			if err == nil && j.fsync {
+				err = f.Sync()
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			k, err := f.ReadAt(buf, off)
+			j.read.Add(uint64(k))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+		}
+		j.ops.Add(1)
+
+		if !random {
+			if off += int64(j.block); off >= blocks*int64(j.block) {
+				off = 0
+			}
+		}
+	}
+
+	return nil
+}
+
+// diskManager tracks the disk jobs, until they are cleaned up.
+type diskManager struct {
+	mu     sync.Mutex
+	jobs   []*diskJob
+	nextID int
+}
+
+// list returns the state of the disk jobs, oldest first.
+func (dm *diskManager) list() []diskJobStatus {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	list := make([]diskJobStatus, 0, len(dm.jobs))
+	for _, j := range dm.jobs {
+		list = append(list, j.status())
+	}
+
+	return list
+}
+
+// running returns the number of disk jobs in progress.
+func (dm *diskManager) running() int {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	n := 0
+	for _, j := range dm.jobs {
+		select {
+		case <-j.done:
+		default:
+			n++
+		}
+	}
+
+	return n
+}
+
+// start starts the job `j`.
+func (dm *diskManager) start(j *diskJob) diskJobStatus {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	j.started = time.Now()
+	j.state = "preparing"
+
+	dm.mu.Lock()
+	dm.nextID++
+	j.id = strconv.Itoa(dm.nextID)
+	dm.jobs = append(dm.jobs, j)
+	dm.mu.Unlock()
+
+	go j.run(ctx)
+
+	return j.status()
+}
+
+// halt stops the job `id`, or all the jobs if `id` is empty. Returns the
+// number of jobs stopped, -1 if the job `id` doesn't exist.
+func (dm *diskManager) halt(id string) int {
+	dm.mu.Lock()
+	var jobs []*diskJob
+	found := false
+	for _, j := range dm.jobs {
+		if len(id) == 0 || j.id == id {
+			found = true
+			jobs = append(jobs, j)
+		}
+	}
+	dm.mu.Unlock()
+	if !found && len(id) > 0 {
+		return -1
+	}
+
+	n := 0
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+			continue
+		default:
+		}
+		j.cancel()
+		<-j.done
+		n++
+	}
+
+	return n
+}
+
+// cleanup stops all the jobs, removes the files they wrote and forgets them.
+// Returns the number of files removed and their total size.
+func (dm *diskManager) cleanup() (int, uint64, error) {
+	dm.halt("")
+
+	dm.mu.Lock()
+	jobs := dm.jobs
+	dm.jobs = nil
+	dm.mu.Unlock()
+
+	var (
+		n     int
+		freed uint64
+		errs  []error
+	)
+	for _, j := range jobs {
+		j.mu.Lock()
+		files := slices.Clone(j.files)
+		j.mu.Unlock()
+		for _, path := range files {
+			fi, err := os.Stat(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			n++
+			if fi != nil {
+				freed += uint64(fi.Size())
+			}
+		}
+	}
+
+	return n, freed, errors.Join(errs...)
+}
+
+// diskStatus is the response of `/_/disk`.
+type diskStatus struct {
+	Dir   string          `json:"dir"`
+	Free  uint64          `json:"free"`
+	Error string          `json:"error,omitempty"`
+	Jobs  []diskJobStatus `json:"jobs"`
+}
+
+// writeText writes the disk jobs and their results as text.
+func (ds diskStatus) writeText(w io.Writer) {
+	if len(ds.Error) > 0 {
+		_, _ = fmt.Fprintf(w, "Disk directory: %s, free space unknown: %s\n", ds.Dir, ds.Error)
+	} else {
+		_, _ = fmt.Fprintf(w, "Disk directory: %s, free %s\n", ds.Dir, humanize.Bytes(ds.Free))
+	}
+	_, _ = fmt.Fprintf(w, "Disk jobs: %d\n", len(ds.Jobs))
+	for _, j := range ds.Jobs {
+		_, _ = fmt.Fprintf(w, "\tid=%s mode=%s state=%s size=%s block=%s workers=%d fsync=%t", j.ID, j.Mode,
+			j.State, humanize.Bytes(j.Size), humanize.Bytes(j.Block), j.Workers, j.Fsync)
+		if j.Rate > 0 {
+			_, _ = fmt.Fprintf(w, " rate=%s/s", humanize.Bytes(j.Rate))
+		}
+		if len(j.Duration) > 0 {
+			_, _ = fmt.Fprintf(w, " duration=%s", j.Duration)
+		}
+		_, _ = fmt.Fprintf(w, " started=%s user=%s\n", j.Started.Format(time.RFC3339), j.User)
+		_, _ = fmt.Fprintf(w, "\t\telapsed=%s files=%d read=%s written=%s ops=%d iops=%.1f read/s=%s write/s=%s\n",
+			j.Elapsed, j.Files, humanize.Bytes(j.Read), humanize.Bytes(j.Written), j.Ops, j.IOPS,
+			humanize.Bytes(uint64(j.ReadThroughput)), humanize.Bytes(uint64(j.WriteThroughput)))
+		if len(j.Error) > 0 {
+			_, _ = fmt.Fprintf(w, "\t\terror=%s\n", j.Error)
+		}
+	}
+}
+
+// parseDiskJob converts the query params of a `/_/disk` request to a disk job.
+func parseDiskJob(r *http.Request, dir string) (*diskJob, error) {
+	var errs []error
+	query := r.URL.Query()
+
+	j := &diskJob{
+		mode:     query.Get("mode"),
+		dir:      dir,
+		size:     64 << 20,
+		fileSize: 100 << 20,
+		block:    4 << 10,
+		workers:  1,
+		duration: 30 * time.Second,
+	}
+	if !slices.Contains(diskModes, j.mode) {
+		errs = append(errs, fmt.Errorf("%s: invalid mode (expected one of %v)", j.mode, diskModes))
+	}
+	if j.mode == "fill" {
+		j.block = 1 << 20
+		if len(query.Get("size")) == 0 {
+			errs = append(errs, errors.New("the size to fill must be set"))
+		}
+	}
+
+	for _, s := range []struct {
+		name string
+		dst  *uint64
+	}{
+		{"size", &j.size},
+		{"file_size", &j.fileSize},
+		{"block", &j.block},
+		{"rate", &j.rate},
+	} {
+		if v := query.Get(s.name); len(v) > 0 {
+			// The rate can be written like `10MB/s`.
+			x, err := humanize.ParseBytes(strings.TrimSuffix(v, "/s"))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid %s", v, s.name))
+			}
+			*s.dst = x
+		}
+	}
+	if j.block < 512 || j.block > maxDiskBlock {
+		errs = append(errs, fmt.Errorf("%d: invalid block size (512B to %s)", j.block,
+			humanize.IBytes(maxDiskBlock)))
+	}
+	if j.size < j.block {
+		errs = append(errs, fmt.Errorf("%d: invalid size (at least the block size)", j.size))
+	}
+	if j.fileSize == 0 {
+		errs = append(errs, errors.New("invalid file size (0)"))
+	}
+
+	if v := query.Get("workers"); len(v) > 0 {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 1 || x > maxDiskWorkers {
+			errs = append(errs, fmt.Errorf("%s: invalid number of workers (1 to %d)", v, maxDiskWorkers))
+		}
+		j.workers = x
+	}
+	if v := query.Get("duration"); len(v) > 0 {
+		x, err := time.ParseDuration(v)
+		if err != nil || x <= 0 || x > maxDiskDuration {
+			errs = append(errs, fmt.Errorf("%s: invalid duration (at most %s)", v, maxDiskDuration))
+		}
+		j.duration = x
+	}
+	if v := query.Get("fsync"); len(v) > 0 {
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid fsync value", v))
+		}
+		j.fsync = x
+	}
+
+	return j, errors.Join(errs...)
+}
+
+// diskHandler is an HTTP handler that is used on the `/_/disk` path: `POST`
+// starts a disk job, either filling the disk (`mode=fill` with `size`) or an
+// I/O workload (`mode=read`, `write`, `rw`, `randread`, `randwrite` or
+// `randrw`) with the `size`, `block`, `workers`, `duration`, `fsync` and
+// `rate` query params. `GET` lists the disk jobs with the achieved IOPS and
+// throughput. `DELETE` stops the job `id`, or all of them with `all=true`,
+// and with `cleanup=true` stops all the jobs and removes their files.
+func diskHandler(dm *diskManager, dir func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			ds := diskStatus{Dir: dir(), Jobs: dm.list()}
+			// The directory is only created by the first job, until then
+			// use the closest existing parent.
+			path := ds.Dir
+			for {
+				if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+					break
+				}
+				path = filepath.Dir(path)
+			}
+			var err error
+			if ds.Free, err = diskFree(path); err != nil {
+				ds.Error = err.Error()
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(ds)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			ds.writeText(w)
+			return
+		case http.MethodDelete:
+			if cleanup, _ := strconv.ParseBool(query.Get("cleanup")); cleanup {
+				n, freed, err := dm.cleanup()
+				reqLogger.Info("Disk jobs cleaned up", "files", n, "freed", freed)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("removed %d file(s) (%s), failed to remove some: %v", n,
+						humanize.Bytes(freed), err), http.StatusInternalServerError)
+					return
+				}
+				_, _ = fmt.Fprintf(w, "Removed %d file(s) (%s)\n", n, humanize.Bytes(freed))
+				return
+			}
+			id := query.Get("id")
+			all, _ := strconv.ParseBool(query.Get("all"))
+			if len(id) == 0 && !all {
+				http.Error(w, "the disk job id (or all=true, or cleanup=true) must be set", http.StatusBadRequest)
+				return
+			}
+			if all {
+				id = ""
+			}
+			n := dm.halt(id)
+			if n < 0 {
+				http.Error(w, fmt.Sprintf("%s: unknown disk job", id), http.StatusNotFound)
+				return
+			}
+			reqLogger.Info("Disk jobs stopped", "job_id", id, "stopped", n)
+			_, _ = fmt.Fprintf(w, "Stopped %d disk job(s)\n", n)
+			return
+		}
+
+		j, err := parseDiskJob(r, dir())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		j.user = user
+
+		js := dm.start(j)
+		reqLogger.Warn("Disk job started", "job_id", js.ID, "mode", js.Mode, "dir", js.Dir, "size", js.Size,
+			"block", js.Block, "workers", js.Workers, "rate", js.Rate, "fsync", js.Fsync)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, "Disk job started (id %s): mode=%s dir=%s size=%s\n", js.ID, js.Mode, js.Dir,
+			humanize.Bytes(js.Size))
+	})
+}
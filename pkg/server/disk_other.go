@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import (
+	"fmt"
+)
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("%s: free disk space not supported on this platform", path)
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users on the
+// filesystem containing `path`.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("%s: failed to get filesystem statistics: %w", path, err)
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
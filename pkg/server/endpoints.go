@@ -0,0 +1,282 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// echoMaxBody is the maximum size of the requests echoed by `/_/echo`, which
+// are kept in memory.
+const echoMaxBody = 10 << 20
+
+// route describes an endpoint of the server and the policy applied to its
+// requests.
+type route struct {
+	path string
+
+	// methods are the allowed HTTP methods, HEAD is allowed together with
+	// GET. All methods are allowed if empty.
+	methods []string
+
+	// auth requires the clients to authenticate, with the default
+	// authentication mode or the one set for the path.
+	auth bool
+
+	// rateLimit is a request rate limit of the route (like `1/s:5`) which
+	// applies per client in addition to the server's rate limits.
+	rateLimit string
+
+	// maxBody is the maximum size of the request body, 0 means unlimited.
+	maxBody int64
+
+	// group is the endpoint group used to select the listeners which
+	// serve the route (its exposure).
+	group string
+
+	handler http.Handler
+}
+
+// endpoint is an HTTP endpoint of the server, with the handler of its route
+// wrapped by the middleware chain.
+type endpoint struct {
+	path    string
+	group   string
+	handler http.Handler
+}
+
+// EndpointOptions are the options of an endpoint added with RegisterEndpoint.
+type EndpointOptions struct {
+	// Methods are the allowed HTTP methods (HEAD is allowed together with
+	// GET), other methods get a 405 response. All methods are allowed if
+	// empty.
+	Methods []string
+
+	// Auth requires the clients to authenticate, with the default
+	// authentication mode or the one set for the path with
+	// Config.EndpointAuth.
+	Auth bool
+
+	// RateLimit is a request rate limit of the endpoint, like `1/s:5`,
+	// which applies per client in addition to the server's rate limits.
+	RateLimit string
+
+	// MaxBodySize is the maximum size of the request body in bytes, 0
+	// means unlimited.
+	MaxBodySize int64
+
+	// Group is the endpoint group (`static`, `public` or `admin`) used to
+	// select the listeners which serve the endpoint, see Config.Listeners.
+	// Defaults to `admin` for authenticated endpoints and `public`
+	// otherwise.
+	Group string
+}
+
+// routeHandler wraps the handler of `rt` with the middleware chain applying
+// its policy: the crash gate, logging, metrics, panic recovery, chaos, the
+// limit of the failed authentication attempts, allowed methods,
+// authentication, the server's and the endpoint's rate limits and the request
+// body size limit.
+func (s *Server) routeHandler(rt route) (http.Handler, error) {
+	var limiter *rateLimiter
+	if len(rt.rateLimit) > 0 {
+		var err error
+		if limiter, err = newRateLimiter(rt.rateLimit, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid rate limit: %w", rt.path, err)
+		}
+	}
+	m := s.metrics.endpoint(rt.path)
+
+	mws := []middleware{
+		s.crash.gateMidd,
+		s.snapshotMidd,
+		s.withState(func(st *liveState, h http.Handler) http.Handler {
+			return loggingMidd(s.logger, st.proxies, h)
+		}),
+		func(h http.Handler) http.Handler { return metricsMidd(m, h) },
+		s.withState(func(st *liveState, h http.Handler) http.Handler {
+			return recoverMidd(m, st.crashOnPanic, h)
+		}),
+	}
+	// The chaos rules never apply to `/_/chaos` itself, such that they can
+	// always be removed.
+	if rt.path != "/_/chaos" {
+		mws = append(mws, func(h http.Handler) http.Handler { return chaosMidd(&s.chaos, h) })
+	}
+	// The failed authentication attempts are limited per client IP address
+	// before authentication, the requests per user after it.
+	if rt.auth {
+		mws = append(mws, s.withState(func(st *liveState, h http.Handler) http.Handler {
+			return authFailureLimitMidd(st.limiter, st.proxies, h)
+		}))
+	}
+	mws = append(mws, methodsMidd(rt.methods))
+	if rt.auth {
+		mws = append(mws, s.withState(func(st *liveState, h http.Handler) http.Handler {
+			return authMidd(h, st.auth, st.auth.modeFor(rt.path))
+		}))
+	}
+	mws = append(mws, s.withState(func(st *liveState, h http.Handler) http.Handler {
+		return rateLimitMidd(st.limiter, st.proxies, h)
+	}))
+	if limiter != nil {
+		mws = append(mws, s.withState(func(st *liveState, h http.Handler) http.Handler {
+			return rateLimitMidd(limiter, st.proxies, h)
+		}))
+	}
+	if rt.maxBody > 0 {
+		mws = append(mws, maxBodyMidd(rt.maxBody))
+	}
+
+	return chain(rt.handler, mws...), nil
+}
+
+// builtinRoutes returns the route table of all the endpoints of
+// hello-zedcloud.
+func (s *Server) builtinRoutes() []route {
+	get := []string{http.MethodGet}
+	post := []string{http.MethodPost}
+
+	return []route{
+		// Serve static files.
+		{path: "/", methods: get, group: groupStatic,
+			handler: http.FileServer(http.Dir(s.config.StaticDir))},
+
+		// The public endpoints.
+		{path: "/_/version", methods: get, group: groupPublic,
+			handler: displayVer(s.config.Version)},
+		{path: "/_/stats", methods: get, group: groupPublic,
+			handler: displayStats(s.startTime, func() []*serverListener { return s.listeners }, s.metrics,
+				&s.allocs, &s.leak, s.resLeaks, &s.cpu, &s.disk)},
+		{path: "/_/echo", maxBody: echoMaxBody, group: groupPublic,
+			handler: reqDump()},
+		{path: "/_/healthz", methods: get, group: groupPublic,
+			handler: probeHandler(s.health, ProbeLiveness)},
+		{path: "/_/readyz", methods: get, group: groupPublic,
+			handler: probeHandler(s.health, ProbeReadiness)},
+		{path: "/_/startupz", methods: get, group: groupPublic,
+			handler: probeHandler(s.health, ProbeStartup)},
+		{path: "/_/peers", methods: get, group: groupPublic,
+			handler: peersHandler(s.peers)},
+
+		// The authenticated endpoints.
+		{path: "/_/env", methods: get, auth: true, group: groupAdmin,
+			handler: displayEnv()},
+		{path: "/_/config", methods: get, auth: true, group: groupAdmin,
+			handler: displayConfig(func() Config { return s.state.Load().config })},
+		{path: "/_/reload", methods: post, auth: true, group: groupAdmin,
+			handler: reloadConfig(s.Reload)},
+		{path: "/_/logs", methods: get, auth: true, group: groupAdmin,
+			handler: displayLogs(s.teeLogger)},
+		{path: "/_/crash", methods: []string{http.MethodGet, http.MethodDelete}, auth: true, group: groupAdmin,
+			handler: crashHandler(&s.crash, s.logger, func() string { return crashFile(s.state.Load().config) })},
+		{path: "/_/alloc", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: allocMemoryHandler(&s.allocs, func() uint64 { return s.state.Load().allocLimit })},
+		{path: "/_/leak", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: leakHandler(&s.leak, func() uint64 { return s.state.Load().allocLimit })},
+		{path: "/_/leak/goroutines", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: resourceLeakHandler(s.resLeaks.goroutines)},
+		{path: "/_/leak/fds", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: resourceLeakHandler(s.resLeaks.fds)},
+		{path: "/_/leak/threads", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: resourceLeakHandler(s.resLeaks.threads)},
+		{path: "/_/cpu", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: cpuHandler(&s.cpu)},
+		{path: "/_/disk", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: diskHandler(&s.disk, func() string { return diskDir(s.state.Load().config) })},
+		{path: "/_/chaos", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			group: groupAdmin, handler: chaosHandler(&s.chaos)},
+		{path: "/_/scenario", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			maxBody: scenarioMaxBody, group: groupAdmin, handler: scenarioHandler(&s.scenarios, s.logger, s.execScenarioStep)},
+		{path: "/_/upload", methods: post, auth: true, group: groupAdmin,
+			handler: uploadHandler(uploadsDir(s.config.StaticDir))},
+		{path: "/_/download", methods: get, auth: true, group: groupAdmin,
+			handler: downloadHandler()},
+		{path: "/_/loadgen", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, auth: true,
+			maxBody: loadgenMaxBody, group: groupAdmin, handler: loadgenHandler(&s.loadgen)},
+		{path: "/_/probes", methods: []string{http.MethodPost, http.MethodDelete}, auth: true, group: groupAdmin,
+			handler: forceProbes(s.health)},
+	}
+}
+
+// addRoute adds the endpoint of `rt`, which must have a unique path.
+func (s *Server) addRoute(rt route) error {
+	if !strings.HasPrefix(rt.path, "/") {
+		return fmt.Errorf("%s: invalid endpoint path, must start with /", rt.path)
+	}
+	switch rt.group {
+	case groupStatic, groupPublic, groupAdmin:
+	default:
+		return fmt.Errorf("%s: unknown endpoint group (expected static, public or admin)", rt.group)
+	}
+
+	s.endpointsMu.Lock()
+	defer s.endpointsMu.Unlock()
+
+	if s.sealed {
+		return fmt.Errorf("%s: endpoints must be registered before calling Handler or serving", rt.path)
+	}
+	for _, e := range s.endpoints {
+		if e.path == rt.path {
+			return fmt.Errorf("%s: endpoint already registered", rt.path)
+		}
+	}
+
+	h, err := s.routeHandler(rt)
+	if err != nil {
+		return err
+	}
+	s.endpoints = append(s.endpoints, endpoint{path: rt.path, group: rt.group, handler: h})
+
+	return nil
+}
+
+// RegisterEndpoint adds an endpoint to the server, with the same logging,
+// metrics and rate limiting as the built-in ones and the policy (methods,
+// authentication, ...) set by `opts`. Endpoints must be registered before
+// calling Handler or serving.
+func (s *Server) RegisterEndpoint(path string, handler http.Handler, opts EndpointOptions) error {
+	group := opts.Group
+	if len(group) == 0 {
+		group = groupPublic
+		if opts.Auth {
+			group = groupAdmin
+		}
+	}
+
+	return s.addRoute(route{
+		path:      path,
+		methods:   opts.Methods,
+		auth:      opts.Auth,
+		rateLimit: opts.RateLimit,
+		maxBody:   opts.MaxBodySize,
+		group:     group,
+		handler:   handler,
+	})
+}
+
+// newMux creates a ServeMux with the endpoints for which `serves` returns
+// true. No more endpoints can be registered after that.
+func (s *Server) newMux(serves func(path, group string) bool) *http.ServeMux {
+	s.endpointsMu.Lock()
+	defer s.endpointsMu.Unlock()
+
+	s.sealed = true
+	mux := http.NewServeMux()
+	for _, e := range s.endpoints {
+		if serves(e.path, e.group) {
+			mux.Handle(e.path, e.handler)
+		}
+	}
+
+	return mux
+}
+
+// Handler returns an http.Handler serving all the endpoints of the server,
+// such that they can be mounted in another HTTP server. Requests are
+// bandwidth limited only when served by the server's own listeners. The
+// startup probe passes once it's called.
+func (s *Server) Handler() http.Handler {
+	s.startupDone.Store(true)
+	return s.newMux(func(string, string) bool { return true })
+}
@@ -5,17 +5,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	mrand "math/rand"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime/metrics"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
 	"github.com/dustin/go-humanize"
 )
 
@@ -63,64 +63,24 @@ func sanitizeFilename(filename string) string {
 	return sanitized + ext
 }
 
-// getRuntimeStat will retrive one of the supported runtime metrics (see
-// https://pkg.go.dev/runtime/metrics#hdr-Supported_metrics).
-//
-// TODO: Currently pretty inefficient, change to a global map, etc.
-func getRuntimeStat(name string) (string, error) {
-	// Create a sample for the metric.
-	sample := make([]metrics.Sample, 1)
-	sample[0].Name = name
-
-	// Sample the metric.
-	metrics.Read(sample)
-
-	v := sample[0].Value
-
-	// Handle the result.
-	switch v.Kind() {
-	case metrics.KindUint64:
-		return fmt.Sprintf("%d", v.Uint64()), nil
-	case metrics.KindFloat64:
-		return fmt.Sprintf("%f", v.Float64()), nil
-	case metrics.KindFloat64Histogram:
-		return "", fmt.Errorf("%s: histogram metric not currently supported", name)
-	case metrics.KindBad:
-		return "", fmt.Errorf("%s: metric no longer supported", name)
-	default:
-		return "", fmt.Errorf("%s: unexpected metric Kind: %v", name, sample[0].Value.Kind())
-	}
-}
-
-// allocMemory will create a new slice of bytes of size `size`. It will then
-// spawn a new gorouting that will periodically walk and update each byte to
-// prevent the GC from freeing it. The `delay` is using during the walk, thus
-// a smaller delay will cause a higher CPU utilization while a bigger one will
-// decrease the CPU utilization.
-func allocMemory(size uint64, delay time.Duration) {
-	buff := make([]byte, size)
-
-	for i := uint64(0); i < size; i++ {
-		buff[i] = byte(mrand.Intn(256)) // Random byte between 0 and 255
-	}
-
-	go func() {
-		for {
-			time.Sleep(delay)
-			for i := uint64(0); i < size; i++ {
-				buff[i] = byte(mrand.Intn(256)) // Random byte between 0 and 255
-				if i%100 == 0 {
-					time.Sleep(delay)
-				}
-			}
-		}
-	}()
+// uploadsDir returns the directory where `/_/upload` saves the uploaded files.
+func uploadsDir(staticDir string) string {
+	return filepath.Join(staticDir, "_", "uploads")
 }
 
 // reqDump is an HTTP middleware that dumps an incoming HTTP request on stdout
-// and at the same time it echos it back to the client.
+// and at the same time it echos it back to the client. Only the request line
+// and headers are dumped on stdout (the body can be binary) and nothing with
+// the `quiet` query param, like for the throughput samples of the peers.
 func reqDump() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		quiet, _ := strconv.ParseBool(r.URL.Query().Get("quiet"))
+		head, err := httputil.DumpRequest(r, false)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		dump, err := httputil.DumpRequest(r, true)
 		if err != nil {
 			fmt.Printf("%s\n", err)
@@ -130,7 +90,9 @@ func reqDump() http.Handler {
 		}
 		w.WriteHeader(http.StatusAlreadyReported)
 		_, _ = fmt.Fprintf(w, "%s", dump)
-		fmt.Printf("%s\n", dump)
+		if !quiet {
+			fmt.Printf("%s(body of %d bytes not shown)\n", head, len(dump)-len(head))
+		}
 	})
 }
 
@@ -138,12 +100,6 @@ func reqDump() http.Handler {
 // which will return the version of this web server app.
 func displayVer(version string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
-			return
-		}
-
 		_, _ = fmt.Fprintf(w, "Version: %s\n", version)
 	})
 }
@@ -152,12 +108,6 @@ func displayVer(version string) http.Handler {
 // will return all environment variables of the server process.
 func displayEnv() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
-			return
-		}
-
 		_, _ = fmt.Fprintln(w, "Environment Variables:")
 		for _, v := range os.Environ() {
 			_, _ = fmt.Fprintf(w, "\t%s\n", v)
@@ -165,149 +115,99 @@ func displayEnv() http.Handler {
 	})
 }
 
-// displayStats is an HTTP handler that is used on the `/_/stats` path and which
-// will returns Go runtime statistics about the current process.
-func displayStats(startTime time.Time) http.Handler {
+// displayConfig is an HTTP handler that is used on the `/_/config` path and
+// which will return the effective configuration of the server, with secrets
+// redacted. The `format` query param selects `yaml` (default), `toml` or `json`.
+func displayConfig(config func() Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
-			return
-		}
-
-		currTime := time.Now()
-		uptime := currTime.Sub(startTime)
-
-		_, _ = fmt.Fprintln(w, "Process Go runtime statistics:")
-		_, _ = fmt.Fprintf(w, "\tUptime: %s (current time: %s, process start time: %s)\n",
-			uptime.String(), currTime.String(), startTime.String())
-
-		metric := "/sched/gomaxprocs:threads"
-		val, err := getRuntimeStat(metric)
+		out, err := marshalConfig(config().Redacted(), r.URL.Query().Get("format"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		_, _ = fmt.Fprintf(w, "\t%s = %s\n", metric, val)
 
-		metric = "/sched/goroutines:goroutines"
-		val, err = getRuntimeStat(metric)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		_, _ = fmt.Fprintf(w, "\t%s = %s\n", metric, val)
+		_, _ = w.Write(out)
+	})
+}
 
-		// percent := (cpu_sec / uptime_sec * goroutines) * 100
-		metric = "/cpu/classes/user:cpu-seconds"
-		val, err = getRuntimeStat(metric)
+// reloadConfig is an HTTP handler that is used on the `/_/reload` path and
+// which will reload the configuration of the server with `reload`, returning
+// the settings that changed.
+func reloadConfig(reload func(trigger string) ([]ConfigChange, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changes, err := reload("POST /_/reload")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to reload configuration:\n%s", err),
+				http.StatusUnprocessableEntity)
 			return
 		}
-		_, _ = fmt.Fprintf(w, "\t%s = %s\n", metric, val)
 
-		metric = "/memory/classes/total:bytes"
-		val, err = getRuntimeStat(metric)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		_, _ = fmt.Fprintf(w, "Configuration reloaded, %d change(s):\n", len(changes))
+		for _, c := range changes {
+			_, _ = fmt.Fprintf(w, "\t%s\n", c)
 		}
-		_, _ = fmt.Fprintf(w, "\t%s = %s\n", metric, val)
 	})
 }
 
-// displayLogs is an HTTP handler that is used on the `/_/logs` path and which
-// will return all the logs of all the previous requests.
-func displayLogs(logger *TeeLogHandler) http.Handler {
+// displayStats is an HTTP handler that is used on the `/_/stats` path and which
+// will returns Go runtime statistics about the current process. The `metric`
+// query param(s) select the runtime metrics to return instead: a metric name,
+// a prefix (like `/gc/`) or `all`.
+func displayStats(startTime time.Time, listeners func() []*serverListener, metrics *requestMetrics,
+	allocs *allocRegistry, leak *memLeak, res resourceLeaks, cpu *cpuBurner, disk *diskManager) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
-			return
-		}
+		currTime := time.Now()
+		uptime := currTime.Sub(startTime)
 
-		_ = logger.Flush(w)
-	})
-}
+		_, _ = fmt.Fprintln(w, "Process Go runtime statistics:")
+		_, _ = fmt.Fprintf(w, "\tUptime: %s (current time: %s, process start time: %s)\n",
+			uptime.String(), currTime.String(), startTime.String())
 
-// shouldCrash is an HTTP handler that will crash the server process (with a
-// go runtime panic) if called with the appropriate query.
-func shouldCrash() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
+		// Only the selected runtime metrics with the `metric` query
+		// param(s).
+		if filters := r.URL.Query()["metric"]; len(filters) > 0 {
+			names, unknown := selectRuntimeMetrics(filters)
+			writeRuntimeStats(w, names)
+			for _, f := range unknown {
+				_, _ = fmt.Fprintf(w, "\t%s = unknown metric\n", f)
+			}
 			return
 		}
+		writeRuntimeStats(w, defaultRuntimeMetrics)
 
-		exitCode := 77
+		n, total := allocs.total()
+		_, _ = fmt.Fprintf(w, "\tmemory allocations (/_/alloc) = %d, total %s\n", n, humanize.Bytes(total))
+		_, _ = fmt.Fprintf(w, "\tmemory leak (/_/leak) = %s\n", leak.status())
 
-		query := r.URL.Query()
-		if areYouSure, ok := query["areYouSure"]; !ok || len(areYouSure) != 1 || areYouSure[0] != "YesIAmSure" {
-			http.Error(w, "I'm sorry, Dave. I'm afraid I can't do that.",
-				http.StatusNotAcceptable)
-			return
+		threads := "unknown"
+		if n, err := osThreads(); err == nil {
+			threads = strconv.Itoa(n)
 		}
-		if ec, ok := query["exitCode"]; ok && len(ec) == 1 {
-			x, err := strconv.Atoi(ec[0])
-			if err != nil {
-				http.Error(w, fmt.Sprintf("%s: invalid exit code", ec[0]),
-					http.StatusBadRequest)
-				return
-			}
-			exitCode = x
+		_, _ = fmt.Fprintf(w, "\tOS threads = %s\n", threads)
+		_, _ = fmt.Fprintf(w, "\tleaked goroutines (/_/leak/goroutines) = %d\n", res.goroutines.status().Leaked)
+		_, _ = fmt.Fprintf(w, "\tleaked file descriptors (/_/leak/fds) = %d\n", res.fds.status().Leaked)
+		_, _ = fmt.Fprintf(w, "\tleaked threads (/_/leak/threads) = %d\n", res.threads.status().Leaked)
+		_, _ = fmt.Fprintf(w, "\tcpu burns (/_/cpu) = %d\n", len(cpu.list()))
+		_, _ = fmt.Fprintf(w, "\tdisk jobs (/_/disk) = %d running\n", disk.running())
+
+		_, _ = fmt.Fprintln(w, "Container resources (cgroup and /proc):")
+		writeContainerStats(w, total)
+
+		_, _ = fmt.Fprintln(w, "Listeners:")
+		for _, l := range listeners() {
+			l.writeStats(w)
 		}
 
-		http.Error(w, "Dave, this conversation can serve no purpose anymore. Good-bye.",
-			http.StatusInternalServerError)
-
-		go func() {
-			time.Sleep(2 * time.Second)
-			os.Exit(exitCode)
-		}()
+		_, _ = fmt.Fprintln(w, "Endpoints:")
+		metrics.writeStats(w)
 	})
 }
 
-// allocMemoryHandler is an HTTP handler that will allocate memory if the
-// appropriate query params are set.
-func allocMemoryHandler() http.Handler {
+// displayLogs is an HTTP handler that is used on the `/_/logs` path and which
+// will return all the logs of all the previous requests.
+func displayLogs(logger *TeeLogHandler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, fmt.Sprintf("method %s not implemented for this path", r.Method),
-				http.StatusNotImplemented)
-			return
-		}
-
-		query := r.URL.Query()
-		sq, ok := query["size"]
-		if !ok || len(sq) != 1 || len(sq[0]) == 0 {
-			http.Error(w, "allocation size must be set",
-				http.StatusBadRequest)
-			return
-		}
-		s, err := humanize.ParseBytes(sq[0])
-		if err != nil {
-			http.Error(w, fmt.Sprintf("%s: invalid size", sq[0]),
-				http.StatusBadRequest)
-			return
-		}
-		size := s
-		delay := 200 * time.Millisecond
-		dq, ok := query["delay"]
-		if ok && len(dq) == 1 || len(dq[0]) > 0 {
-			d, err := time.ParseDuration(dq[0])
-			if err != nil {
-				http.Error(w, fmt.Sprintf("%s: invalid delay", dq[0]),
-					http.StatusBadRequest)
-				return
-			}
-			delay = d
-		}
-
-		allocMemory(size, delay)
-
-		http.Error(w, "memory allocated", http.StatusCreated)
+		_ = logger.Flush(w)
 	})
 }
 
@@ -319,12 +219,6 @@ func allocMemoryHandler() http.Handler {
 // directory where the server was started.
 func uploadHandler(uploadPath string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only allow the POST method for uploads.
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
 		// Parse the multipart form, 10 << 20 specifies a maximum upload of 10 MB.
 		if err := r.ParseMultipartForm(10 << 20); err != nil {
 			http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
@@ -377,3 +271,29 @@ func uploadHandler(uploadPath string) http.Handler {
 			handler.Filename, dst, n, humanize.Bytes(uint64(n)), hashString)
 	})
 }
+
+// downloadHandler is an HTTP handler that is used on the `/_/download` path and
+// which returns `size` (query param, default 1MB) random bytes. Together with
+// `/_/upload` it can be used to simulate traffic in both directions.
+func downloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := uint64(1 << 20)
+		if v := r.URL.Query().Get("size"); len(v) > 0 {
+			s, err := humanize.ParseBytes(v)
+			if err != nil || s > math.MaxInt64 {
+				http.Error(w, fmt.Sprintf("%s: invalid size", v), http.StatusBadRequest)
+				return
+			}
+			size = s
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+		w.Header().Set("Content-Disposition", `attachment; filename="download.bin"`)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = io.CopyN(w, loadgen.RandomReader(), int64(size))
+	})
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/metrics"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Probe is a kind of health probe, named after its endpoint.
+type Probe string
+
+const (
+	// ProbeLiveness (`/_/healthz`) fails if the server should be restarted.
+	ProbeLiveness Probe = "healthz"
+	// ProbeReadiness (`/_/readyz`) fails if the server shouldn't receive
+	// traffic.
+	ProbeReadiness Probe = "readyz"
+	// ProbeStartup (`/_/startupz`) fails until the server has started
+	// (including the scenario of the configuration, if any).
+	ProbeStartup Probe = "startupz"
+)
+
+// parseProbe converts a probe name to a Probe.
+func parseProbe(s string) (Probe, error) {
+	switch p := Probe(s); p {
+	case ProbeLiveness, ProbeReadiness, ProbeStartup:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%s: unknown probe (expected one of healthz, readyz, startupz)", s)
+	}
+}
+
+// healthCheckTimeout is the maximum duration of a health check.
+const healthCheckTimeout = 5 * time.Second
+
+// healthCheck is a named check used by one or more probes.
+type healthCheck struct {
+	name   string
+	probes []Probe
+	check  func(ctx context.Context) error
+}
+
+// forcedState forces the result of a probe, until a deadline (or until
+// cleared if the deadline is zero).
+type forcedState struct {
+	fail   bool
+	until  time.Time
+	reason string
+}
+
+// active returns true if the forced state didn't expire at `now`.
+func (f forcedState) active(now time.Time) bool {
+	return f.until.IsZero() || now.Before(f.until)
+}
+
+// String describes the forced state.
+func (f forcedState) String() string {
+	state := "passing"
+	if f.fail {
+		state = "failing"
+	}
+	if f.until.IsZero() {
+		return fmt.Sprintf("forced %s until cleared (%s)", state, f.reason)
+	}
+
+	return fmt.Sprintf("forced %s for another %s (%s)", state,
+		time.Until(f.until).Round(time.Second), f.reason)
+}
+
+// healthRegistry holds the health checks and the forced probe states.
+type healthRegistry struct {
+	mu     sync.Mutex
+	checks []healthCheck
+	forced map[Probe]forcedState
+}
+
+// newHealthRegistry creates an empty health check registry.
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{forced: make(map[Probe]forcedState)}
+}
+
+// add adds a health check, replacing the one with the same name if any.
+func (hr *healthRegistry) add(name string, check func(ctx context.Context) error, probes ...Probe) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	hr.checks = slices.DeleteFunc(hr.checks, func(c healthCheck) bool { return c.name == name })
+	hr.checks = append(hr.checks, healthCheck{name: name, probes: probes, check: check})
+}
+
+// force forces the state of `probe` for `d` (0 means until cleared).
+func (hr *healthRegistry) force(probe Probe, fail bool, d time.Duration, reason string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	f := forcedState{fail: fail, reason: reason}
+	if d > 0 {
+		f.until = time.Now().Add(d)
+	}
+	hr.forced[probe] = f
+}
+
+// clear removes the forced states of all the probes.
+func (hr *healthRegistry) clear() {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	clear(hr.forced)
+}
+
+// checkResult is the result of a health check.
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// probeResult is the result of a probe.
+type probeResult struct {
+	Probe  Probe         `json:"probe"`
+	OK     bool          `json:"ok"`
+	Forced string        `json:"forced,omitempty"`
+	Checks []checkResult `json:"checks"`
+}
+
+// run runs the checks of `probe`. A forced state overrides the result of the
+// checks, which are still run and reported.
+func (hr *healthRegistry) run(ctx context.Context, probe Probe) probeResult {
+	hr.mu.Lock()
+	var checks []healthCheck
+	for _, c := range hr.checks {
+		if slices.Contains(c.probes, probe) {
+			checks = append(checks, c)
+		}
+	}
+	f, forced := hr.forced[probe]
+	if forced && !f.active(time.Now()) {
+		delete(hr.forced, probe)
+		forced = false
+	}
+	hr.mu.Unlock()
+
+	res := probeResult{Probe: probe, OK: true, Checks: []checkResult{}}
+	for _, c := range checks {
+		cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := c.check(cctx)
+		cancel()
+
+		cr := checkResult{Name: c.name, OK: err == nil}
+		if err != nil {
+			cr.Error = err.Error()
+			res.OK = false
+		}
+		res.Checks = append(res.Checks, cr)
+	}
+
+	if forced {
+		res.OK = !f.fail
+		res.Forced = f.String()
+	}
+
+	return res
+}
+
+// RegisterHealthCheck adds a named check to the probes (if none are given
+// then to the liveness and readiness probes), replacing any check with the
+// same name. The check fails if it returns an error. Can be called at any
+// time.
+func (s *Server) RegisterHealthCheck(name string, check func(ctx context.Context) error, probes ...Probe) {
+	if len(probes) == 0 {
+		probes = []Probe{ProbeLiveness, ProbeReadiness}
+	}
+	s.health.add(name, check, probes...)
+}
+
+// runtimeMemory returns the memory used by the Go runtime.
+func runtimeMemory() (uint64, error) {
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0, errors.New("memory in use not supported by the Go runtime")
+	}
+
+	return sample[0].Value.Uint64(), nil
+}
+
+// registerBuiltinHealthChecks adds the built-in health checks.
+func (s *Server) registerBuiltinHealthChecks() {
+	staticDir := s.config.StaticDir
+	s.health.add("startup", func(context.Context) error {
+		if !s.startupDone.Load() {
+			return errors.New("the server hasn't started yet")
+		}
+		return nil
+	}, ProbeStartup)
+
+	s.health.add("log_sink", func(context.Context) error {
+		return s.teeLogger.Err()
+	}, ProbeLiveness, ProbeReadiness)
+
+	s.health.add("memory", func(context.Context) error {
+		limit := s.state.Load().health.maxMemory
+		if limit == 0 {
+			return nil
+		}
+		used, err := runtimeMemory()
+		if err != nil {
+			return err
+		}
+		if used > limit {
+			return fmt.Errorf("%s of memory in use, above the maximum of %s",
+				humanize.Bytes(used), humanize.Bytes(limit))
+		}
+		return nil
+	}, ProbeLiveness)
+
+	s.health.add("static_dir", func(context.Context) error {
+		f, err := os.Open(staticDir)
+		if err != nil {
+			return fmt.Errorf("static directory not readable: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		if _, err := f.ReadDir(1); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("static directory not readable: %w", err)
+		}
+		return nil
+	}, ProbeReadiness, ProbeStartup)
+
+	s.health.add("uploads_dir", func(context.Context) error {
+		dir := uploadsDir(staticDir)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("uploads directory not writable: %w", err)
+		}
+		f, err := os.CreateTemp(dir, ".healthcheck-*")
+		if err != nil {
+			return fmt.Errorf("uploads directory not writable: %w", err)
+		}
+		_ = f.Close()
+		return os.Remove(f.Name())
+	}, ProbeReadiness)
+
+	s.health.add("disk_space", func(context.Context) error {
+		limit := s.state.Load().health.minFreeDisk
+		if limit == 0 {
+			return nil
+		}
+		free, err := diskFree(staticDir)
+		if err != nil {
+			return err
+		}
+		if free < limit {
+			return fmt.Errorf("%s of free disk space, below the minimum of %s",
+				humanize.Bytes(free), humanize.Bytes(limit))
+		}
+		return nil
+	}, ProbeReadiness)
+}
+
+// writeProbeResult writes the result of a probe, as JSON if the client
+// accepts it and otherwise as text. The status code is 503 if it failed.
+func writeProbeResult(w http.ResponseWriter, r *http.Request, res probeResult) {
+	status := http.StatusOK
+	if !res.OK {
+		status = http.StatusServiceUnavailable
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, c := range res.Checks {
+		if c.OK {
+			_, _ = fmt.Fprintf(w, "[+] %s ok\n", c.Name)
+		} else {
+			_, _ = fmt.Fprintf(w, "[-] %s failed: %s\n", c.Name, c.Error)
+		}
+	}
+	if len(res.Forced) > 0 {
+		_, _ = fmt.Fprintf(w, "[!] %s\n", res.Forced)
+	}
+	if res.OK {
+		_, _ = fmt.Fprintf(w, "%s check passed\n", res.Probe)
+	} else {
+		_, _ = fmt.Fprintf(w, "%s check failed\n", res.Probe)
+	}
+}
+
+// probeHandler is an HTTP handler that is used on the `/_/healthz`,
+// `/_/readyz` and `/_/startupz` paths and which runs the checks of `probe`.
+func probeHandler(hr *healthRegistry, probe Probe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResult(w, r, hr.run(r.Context(), probe))
+	})
+}
+
+// forceProbes is an HTTP handler that is used on the `/_/probes` path and
+// which forces the state of a probe: `POST` with the `probe` (healthz, readyz
+// or startupz), `state` (fail or pass) and optional `duration` (default: 30s,
+// 0 means until cleared) query params. `DELETE` clears all the forced states.
+func forceProbes(hr *healthRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			hr.clear()
+			_, _ = fmt.Fprintln(w, "Cleared all forced probe states")
+			return
+		}
+
+		query := r.URL.Query()
+		probe, err := parseProbe(query.Get("probe"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var fail bool
+		switch query.Get("state") {
+		case "fail":
+			fail = true
+		case "pass":
+		default:
+			http.Error(w, fmt.Sprintf("%s: invalid state (expected fail or pass)", query.Get("state")),
+				http.StatusBadRequest)
+			return
+		}
+		d := 30 * time.Second
+		if v := query.Get("duration"); len(v) > 0 {
+			if d, err = time.ParseDuration(v); err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("%s: invalid duration", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		hr.force(probe, fail, d, fmt.Sprintf("by %s", user))
+		if reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger); ok {
+			reqLogger.Warn("Probe state forced", "probe", probe, "fail", fail, "duration", d)
+		}
+
+		_, _ = fmt.Fprintf(w, "Probe %s forced to %s", probe, query.Get("state"))
+		if d > 0 {
+			_, _ = fmt.Fprintf(w, " for %s", d)
+		}
+		_, _ = fmt.Fprintln(w)
+	})
+}
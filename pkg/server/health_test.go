@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStartupProbe(t *testing.T) {
+	config := DefaultConfig()
+	config.StaticDir = t.TempDir()
+	s, err := New(config, WithLogHandler(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := s.health.run(context.Background(), ProbeStartup); res.OK {
+		t.Errorf("startup probe passed before the server started: %+v", res)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.health.run(context.Background(), ProbeStartup).OK {
+		if time.Now().After(deadline) {
+			t.Fatal("startup probe still failing after the server started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
+	"github.com/dustin/go-humanize"
+)
+
+// memLeak simulates a gradual memory leak: `step` bytes are allocated (and
+// never released) every `interval`, up to an optional ceiling.
+type memLeak struct {
+	mu sync.Mutex
+
+	running  bool
+	step     uint64
+	interval time.Duration
+	ceiling  uint64
+	started  time.Time
+	stopped  time.Time
+	user     string
+	reason   string
+
+	chunks [][]byte
+	leaked uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// leakStatus is the state of the memory leak.
+type leakStatus struct {
+	Running  bool   `json:"running"`
+	State    string `json:"state"`
+	Leaked   uint64 `json:"leaked"`
+	Step     uint64 `json:"step,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Ceiling  uint64 `json:"ceiling,omitempty"`
+	Started  string `json:"started,omitempty"`
+	Stopped  string `json:"stopped,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+// String describes the state of the memory leak, on one line.
+func (ls leakStatus) String() string {
+	if len(ls.Started) == 0 {
+		return "not started"
+	}
+
+	s := fmt.Sprintf("%s, leaked %s", ls.State, humanize.Bytes(ls.Leaked))
+	if ls.Ceiling > 0 {
+		s += fmt.Sprintf(" of %s", humanize.Bytes(ls.Ceiling))
+	}
+
+	return s + fmt.Sprintf(" (%s every %s, started %s by %s)", humanize.Bytes(ls.Step), ls.Interval,
+		ls.Started, ls.User)
+}
+
+// status returns the state of the memory leak.
+func (ml *memLeak) status() leakStatus {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ls := leakStatus{Running: ml.running, Leaked: ml.leaked, State: "not started"}
+	if ml.started.IsZero() {
+		return ls
+	}
+	ls.State = "leaking"
+	if !ml.running {
+		ls.State = ml.reason
+		ls.Stopped = ml.stopped.Format(time.RFC3339)
+	}
+	ls.Step = ml.step
+	ls.Interval = ml.interval.String()
+	ls.Ceiling = ml.ceiling
+	ls.Started = ml.started.Format(time.RFC3339)
+	ls.User = ml.user
+
+	return ls
+}
+
+// errLeakRunning is returned when starting a leak while one is in progress.
+var errLeakRunning = errors.New("a memory leak is already in progress, stop it first")
+
+// start starts leaking `step` bytes every `interval` up to `ceiling` (0 means
+// forever). The memory leaked before (if any) is kept.
+func (ml *memLeak) start(step uint64, interval time.Duration, ceiling uint64, user string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.running {
+		return errLeakRunning
+	}
+	ml.running = true
+	ml.step, ml.interval, ml.ceiling = step, interval, ceiling
+	ml.started, ml.stopped = time.Now(), time.Time{}
+	ml.user = user
+	ml.stop = make(chan struct{})
+	ml.done = make(chan struct{})
+
+	go ml.run(ml.stop, ml.done)
+
+	return nil
+}
+
+// run leaks memory until stopped or the ceiling is reached.
+func (ml *memLeak) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(ml.interval)
+	defer ticker.Stop()
+	for {
+		ml.mu.Lock()
+		step := ml.step
+		if ml.ceiling > 0 {
+			step = min(step, ml.ceiling-min(ml.leaked, ml.ceiling))
+		}
+		if step == 0 {
+			ml.running = false
+			ml.stopped = time.Now()
+			ml.reason = "ceiling reached"
+			ml.mu.Unlock()
+			return
+		}
+		ml.mu.Unlock()
+
+		// Write the whole chunk such that it's really in use (resident).
+		chunk := make([]byte, step)
+		_, _ = io.ReadFull(loadgen.RandomReader(), chunk)
+
+		ml.mu.Lock()
+		ml.chunks = append(ml.chunks, chunk)
+		ml.leaked += step
+		ml.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// halt stops leaking (if in progress), and releases the leaked memory if
+// `free`. Returns the state of the leak before releasing the memory.
+func (ml *memLeak) halt(free bool) leakStatus {
+	ml.mu.Lock()
+	if ml.running {
+		close(ml.stop)
+		done := ml.done
+		ml.mu.Unlock()
+		<-done
+		ml.mu.Lock()
+		ml.running = false
+		ml.stopped = time.Now()
+		ml.reason = "stopped"
+	}
+	ml.mu.Unlock()
+
+	ls := ml.status()
+	if free {
+		ml.mu.Lock()
+		ml.chunks, ml.leaked = nil, 0
+		ml.mu.Unlock()
+		debug.FreeOSMemory()
+	}
+
+	return ls
+}
+
+// maxLeakStep is the maximum size leaked at once, such that a leak stays
+// gradual.
+const maxLeakStep = 1 << 30
+
+// parseLeakRate parses a leak rate like `5MB/10s`, `1MB/s` or `100KB/100ms`.
+func parseLeakRate(s string) (uint64, time.Duration, error) {
+	size, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: invalid leak rate (expected size/interval like 5MB/10s)", s)
+	}
+	step, err := humanize.ParseBytes(size)
+	if err != nil || step == 0 || step > maxLeakStep {
+		return 0, 0, fmt.Errorf("%s: invalid leak rate size (at most %s per interval)", s,
+			humanize.IBytes(maxLeakStep))
+	}
+	// `1MB/s` means `1MB/1s`.
+	if len(per) > 0 && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	interval, err := time.ParseDuration(per)
+	if err != nil || interval < 10*time.Millisecond {
+		return 0, 0, fmt.Errorf("%s: invalid leak rate interval (at least 10ms)", s)
+	}
+
+	return step, interval, nil
+}
+
+// writeLeakStatus writes the state of the memory leak, as JSON if the client
+// accepts it and otherwise as text.
+func writeLeakStatus(w http.ResponseWriter, r *http.Request, status int, ls leakStatus) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(ls)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "Memory leak: %s\n", ls)
+}
+
+// leakHandler is an HTTP handler that is used on the `/_/leak` path and which
+// simulates a gradual memory leak: `POST` starts leaking at the `rate` query
+// param (like `5MB/10s`) up to the optional `max` ceiling, `GET` returns the
+// progress and `DELETE` stops leaking (and with `free=true` releases the
+// leaked memory). The ceiling can't exceed the allocation `limit` (also the
+// default ceiling) unless `force` is set.
+func leakHandler(ml *memLeak, limit func() uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeLeakStatus(w, r, http.StatusOK, ml.status())
+			return
+		case http.MethodDelete:
+			free, _ := strconv.ParseBool(query.Get("free"))
+			ls := ml.halt(free)
+			reqLogger.Info("Memory leak stopped", "leaked", ls.Leaked, "free", free)
+			if free {
+				ls.Leaked = 0
+				ls.State = "stopped, memory released"
+			}
+			writeLeakStatus(w, r, http.StatusOK, ls)
+			return
+		}
+
+		step, interval, err := parseLeakRate(query.Get("rate"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ceiling uint64
+		if v := query.Get("max"); len(v) > 0 {
+			if ceiling, err = humanize.ParseBytes(v); err != nil {
+				http.Error(w, fmt.Sprintf("%s: invalid max", v), http.StatusBadRequest)
+				return
+			}
+		}
+		force, _ := strconv.ParseBool(query.Get("force"))
+		if l := limit(); l > 0 && !force {
+			if ceiling == 0 {
+				ceiling = l
+			}
+			if ceiling > l || step > l {
+				http.Error(w, allocLimitError{size: max(ceiling, step), limit: l}.Error(), http.StatusConflict)
+				return
+			}
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+
+		if err := ml.start(step, interval, ceiling, user); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		reqLogger.Warn("Memory leak started", "step", step, "interval", interval, "ceiling", ceiling)
+		writeLeakStatus(w, r, http.StatusAccepted, ml.status())
+	})
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLeakRate(t *testing.T) {
+	tests := []struct {
+		in       string
+		step     uint64
+		interval time.Duration
+		wantErr  bool
+	}{
+		{in: "5MB/10s", step: 5_000_000, interval: 10 * time.Second},
+		{in: "1MiB/s", step: 1 << 20, interval: time.Second},
+		{in: "100KB/100ms", step: 100_000, interval: 100 * time.Millisecond},
+		{in: "1GiB/m", step: 1 << 30, interval: time.Minute},
+		{in: "5MB", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "x/s", wantErr: true},
+		{in: "2GiB/s", wantErr: true},
+		{in: "1MB/5ms", wantErr: true},
+		{in: "1MB/", wantErr: true},
+		{in: "1MB/soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		step, interval, err := parseLeakRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLeakRate(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if step != tt.step || interval != tt.interval {
+			t.Errorf("parseLeakRate(%q) = %d, %s, want %d, %s", tt.in, step, interval, tt.step, tt.interval)
+		}
+	}
+}
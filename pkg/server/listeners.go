@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/conduitio/bwlimit"
+	"github.com/dustin/go-humanize"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Endpoint groups which can be selected for a listener.
+const (
+	// groupStatic is the static file server (`/`).
+	groupStatic = "static"
+	// groupPublic are the `/_/` endpoints which don't require
+	// authentication.
+	groupPublic = "public"
+	// groupAdmin are the authenticated `/_/` endpoints.
+	groupAdmin = "admin"
+	// groupAll selects all the endpoints.
+	groupAll = "all"
+)
+
+// listenerSpec is the configuration of one listener of the server.
+type listenerSpec struct {
+	name    string
+	network string
+	address string
+
+	// tls is true if the listener serves HTTPS (with the server
+	// certificate).
+	tls bool
+
+	// h2c enables HTTP/2 over cleartext (without TLS, with prior
+	// knowledge) in addition to HTTP/1.1.
+	h2c bool
+
+	// http3 enables HTTP/3 (QUIC) on the UDP port with the same number as
+	// the TCP port of the listener. Requires TLS.
+	http3 bool
+
+	// bwLimit is the bandwidth limit of the listener. If `hasBwLimit` is
+	// false then the server's bandwidth limit applies (and follows it on
+	// reload).
+	bwLimit    bwlimit.Byte
+	hasBwLimit bool
+
+	// endpoints selects the endpoints served by the listener, each either
+	// an endpoint group or a path prefix.
+	endpoints []string
+}
+
+// serves returns true if the endpoint at `path`, which belongs to `group`, is
+// served by the listener.
+func (l listenerSpec) serves(path, group string) bool {
+	for _, e := range l.endpoints {
+		if e == groupAll || e == group || (strings.HasPrefix(e, "/") && strings.HasPrefix(path, e)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HealthListener is the listener of a configuration on which the health
+// endpoints can be probed, see Config.HealthListener.
+type HealthListener struct {
+	// Index is the position of the listener, which is also its line in the
+	// address file (see Config.AddrFile).
+	Index int
+	// Network is `tcp` or `unix`.
+	Network string
+	// Address is the `host:port` or the path of the Unix socket.
+	Address string
+	// TLS is true if the listener serves HTTPS.
+	TLS bool
+}
+
+// HealthListener returns the first listener of the configuration which
+// serves the health endpoints (`/_/healthz`, `/_/readyz` and `/_/startupz`),
+// for example for a health check from the same host or container.
+func (c Config) HealthListener() (HealthListener, error) {
+	specs, err := c.listenerSpecs()
+	if err != nil {
+		return HealthListener{}, err
+	}
+	for i, l := range specs {
+		if !l.serves("/_/healthz", groupPublic) {
+			continue
+		}
+		network := l.network
+		if network != "unix" {
+			network = "tcp"
+		}
+		return HealthListener{Index: i, Network: network, Address: l.address, TLS: l.tls}, nil
+	}
+
+	return HealthListener{}, errors.New("no listener serves the health endpoints")
+}
+
+// parseListenerSpecs parses a list of listeners separated by `;` (or new
+// lines). Each listener is a comma separated list of `key=value` settings:
+//   - `addr` (required): the `host:port` for TCP or the path of a Unix socket.
+//   - `name`: used in logs and stats (default: `listener-N`).
+//   - `network`: `tcp` (default), `tcp4`, `tcp6` or `unix`.
+//   - `tls`: `true` or `false`, defaults to whether the server has a TLS
+//     certificate configured.
+//   - `h2c`: `true` to also serve HTTP/2 over cleartext (non TLS listeners).
+//   - `http3`: `true` to also serve HTTP/3 (QUIC) on the same UDP port (TLS
+//     listeners).
+//   - `bw_limit`: the bandwidth limit of the listener (default: the server's).
+//   - `endpoints`: `+` separated endpoint groups (`static`, `public`,
+//     `admin`, `all`) or path prefixes, e.g. `static+/_/version` (default:
+//     `all`).
+//
+// For example: `name=public,addr=:8080,endpoints=static;name=mgmt,addr=127.0.0.1:9090,endpoints=admin+public`.
+func parseListenerSpecs(s string, tlsAvailable bool) ([]listenerSpec, error) {
+	var (
+		specs []listenerSpec
+		errs  []error
+	)
+
+	entries := strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' })
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		l := listenerSpec{
+			name:      fmt.Sprintf("listener-%d", i+1),
+			network:   "tcp",
+			tls:       tlsAvailable,
+			endpoints: []string{groupAll},
+		}
+		for _, kv := range strings.Split(entry, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: invalid listener setting (expected key=value)", kv))
+				continue
+			}
+			v = strings.TrimSpace(v)
+			switch strings.TrimSpace(k) {
+			case "name":
+				l.name = v
+			case "addr", "address":
+				l.address = v
+			case "network":
+				l.network = v
+			case "tls":
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid listener tls setting", v))
+				}
+				l.tls = b
+			case "h2c":
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid listener h2c setting", v))
+				}
+				l.h2c = b
+			case "http3":
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid listener http3 setting", v))
+				}
+				l.http3 = b
+			case "bw_limit":
+				limit, err := parseBwLimit(v)
+				if err != nil {
+					errs = append(errs, err)
+				}
+				l.bwLimit, l.hasBwLimit = limit, true
+			case "endpoints":
+				l.endpoints = strings.Split(v, "+")
+			default:
+				errs = append(errs, fmt.Errorf("%s: unknown listener setting", k))
+			}
+		}
+
+		if len(l.address) == 0 {
+			errs = append(errs, fmt.Errorf("listener %s: the address (addr) must be set", l.name))
+		}
+		switch l.network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			errs = append(errs, fmt.Errorf("listener %s: %s: unsupported network (expected tcp, tcp4, tcp6 or unix)",
+				l.name, l.network))
+		}
+		if l.tls && !tlsAvailable {
+			errs = append(errs, fmt.Errorf("listener %s: TLS requires the TLS certificate and key to be set", l.name))
+		}
+		if l.h2c && l.tls {
+			errs = append(errs, fmt.Errorf("listener %s: h2c is only for non TLS listeners, with TLS HTTP/2 is always enabled", l.name))
+		}
+		if l.http3 && (!l.tls || l.network == "unix") {
+			errs = append(errs, fmt.Errorf("listener %s: HTTP/3 requires a TLS and TCP listener", l.name))
+		}
+		for _, e := range l.endpoints {
+			switch e {
+			case groupStatic, groupPublic, groupAdmin, groupAll:
+			default:
+				if !strings.HasPrefix(e, "/") {
+					errs = append(errs, fmt.Errorf("listener %s: %s: unknown endpoint group (expected static, public, admin, all or a /path prefix)",
+						l.name, e))
+				}
+			}
+		}
+		for _, other := range specs {
+			if other.name == l.name {
+				errs = append(errs, fmt.Errorf("listener %s: duplicate listener name", l.name))
+			}
+		}
+
+		specs = append(specs, l)
+	}
+
+	return specs, errors.Join(errs...)
+}
+
+// serverListener is a listener of the server, with its own HTTP server which
+// serves the subset of endpoints selected for it.
+type serverListener struct {
+	spec    listenerSpec
+	bw      *limitedListener
+	ln      net.Listener
+	httpSrv *http.Server
+
+	// pc and h3Srv are the UDP socket and the server for HTTP/3, if enabled.
+	pc    *limitedPacketConn
+	h3Srv *http3.Server
+
+	// inherited is the listener passed by socket activation, if any, which
+	// is used instead of opening a new one.
+	inherited net.Listener
+}
+
+// listen opens the listener (or uses the inherited one). Stale Unix sockets
+// are removed first.
+func (l *serverListener) listen(limit bwlimit.Byte, tlsConfig *tls.Config) error {
+	ln := l.inherited
+	if ln != nil {
+		l.spec.network = ln.Addr().Network()
+		l.spec.address = ln.Addr().String()
+	} else {
+		if l.spec.network == "unix" {
+			if fi, err := os.Stat(l.spec.address); err == nil && fi.Mode().Type() == fs.ModeSocket {
+				_ = os.Remove(l.spec.address)
+			}
+		}
+
+		var err error
+		ln, err = net.Listen(l.spec.network, l.spec.address)
+		if err != nil {
+			return fmt.Errorf("listener %s: failed to listen: %w", l.spec.name, err)
+		}
+	}
+
+	if l.spec.hasBwLimit {
+		limit = l.spec.bwLimit
+	}
+	l.bw = newLimitedListener(ln, limit)
+	l.ln = l.bw
+	if l.spec.tls {
+		// NOTE: The TLS listener wraps the bandwidth limited one so
+		// that the limit applies to the bytes on the wire.
+		l.ln = tls.NewListener(l.ln, tlsConfig)
+	}
+
+	if l.spec.http3 {
+		// The UDP port has the same number as the TCP one (which might
+		// have been picked by the kernel).
+		network := strings.Replace(ln.Addr().Network(), "tcp", "udp", 1)
+		pc, err := net.ListenPacket(network, ln.Addr().String())
+		if err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("listener %s: failed to listen for HTTP/3: %w", l.spec.name, err)
+		}
+		l.pc = newLimitedPacketConn(pc, limit)
+	}
+
+	return nil
+}
+
+// closeSockets closes the sockets opened by listen (TCP and UDP), when the
+// listener isn't served.
+func (l *serverListener) closeSockets() {
+	if l.ln != nil {
+		_ = l.ln.Close()
+	}
+	if l.pc != nil {
+		_ = l.pc.Close()
+	}
+}
+
+// setLimit changes the bandwidth limit of the listener (TCP and UDP).
+func (l *serverListener) setLimit(limit bwlimit.Byte) {
+	if l.bw != nil {
+		l.bw.SetLimit(limit)
+	}
+	if l.pc != nil {
+		l.pc.SetLimit(limit)
+	}
+}
+
+// setupHTTP creates the HTTP server(s) of the listener. Responses from the
+// TCP listener advertise HTTP/3 with the `Alt-Svc` header, if enabled.
+func (l *serverListener) setupHTTP(h http.Handler, tlsConfig *tls.Config) {
+	if l.pc != nil {
+		l.h3Srv = &http3.Server{
+			Handler:   h,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		}
+		h3 := l.h3Srv
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = h3.SetQUICHeaders(w.Header())
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	l.httpSrv = &http.Server{
+		Handler: h,
+	}
+	if l.spec.h2c {
+		l.httpSrv.Protocols = new(http.Protocols)
+		l.httpSrv.Protocols.SetHTTP1(true)
+		l.httpSrv.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+// serve serves HTTP on the listener, and HTTP/3 if enabled, until closed.
+// Each of the servers sends its result to `errs`.
+func (l *serverListener) serve(errs chan<- error) {
+	go func() {
+		errs <- l.httpSrv.Serve(l.ln)
+	}()
+	if l.h3Srv != nil {
+		go func() {
+			errs <- l.h3Srv.Serve(l.pc)
+		}()
+	}
+}
+
+// servers returns the number of servers (HTTP, HTTP/3) of the listener.
+func (l *serverListener) servers() int {
+	if l.h3Srv != nil {
+		return 2
+	}
+
+	return 1
+}
+
+// close immediately closes the servers of the listener.
+func (l *serverListener) close() {
+	if l.httpSrv != nil {
+		_ = l.httpSrv.Close()
+	}
+	if l.h3Srv != nil {
+		_ = l.h3Srv.Close()
+	}
+}
+
+// shutdown gracefully shuts down the servers of the listener.
+func (l *serverListener) shutdown(ctx context.Context) error {
+	var errs []error
+	if l.httpSrv != nil {
+		errs = append(errs, l.httpSrv.Shutdown(ctx))
+	}
+	if l.h3Srv != nil {
+		errs = append(errs, l.h3Srv.Shutdown(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// writeStats writes the current state of the listener to `w`.
+func (l *serverListener) writeStats(w io.Writer) {
+	addr := l.spec.address
+	if l.ln != nil {
+		addr = l.ln.Addr().String()
+	}
+	conns := 0
+	limit := l.spec.bwLimit
+	if l.bw != nil {
+		conns = l.bw.Conns()
+		limit = l.bw.Limit()
+	}
+
+	_, _ = fmt.Fprintf(w, "\t%s: network=%s address=%s tls=%t h2c=%t http3=%t bandwidth_limit=%s endpoints=%s open_connections=%d\n",
+		l.spec.name, l.spec.network, addr, l.spec.tls, l.spec.h2c, l.pc != nil,
+		humanize.Bytes(uint64(limit)), strings.Join(l.spec.endpoints, "+"), conns)
+}
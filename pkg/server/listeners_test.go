@@ -0,0 +1,138 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseListenerSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		tls     bool
+		want    []listenerSpec
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			in:   "addr=:8080",
+			want: []listenerSpec{{name: "listener-1", network: "tcp", address: ":8080", endpoints: []string{groupAll}}},
+		},
+		{
+			name: "several with new lines",
+			in:   "name=public,addr=:8080,endpoints=static;\nname=mgmt, addr=127.0.0.1:9090, endpoints=admin+public+/_/version",
+			want: []listenerSpec{
+				{name: "public", network: "tcp", address: ":8080", endpoints: []string{groupStatic}},
+				{name: "mgmt", network: "tcp", address: "127.0.0.1:9090",
+					endpoints: []string{groupAdmin, groupPublic, "/_/version"}},
+			},
+		},
+		{
+			name: "tls by default with a certificate",
+			in:   "addr=:8443,http3=true;addr=:8080,tls=false,h2c=true;network=unix,addr=/tmp/hz.sock,tls=false",
+			tls:  true,
+			want: []listenerSpec{
+				{name: "listener-1", network: "tcp", address: ":8443", tls: true, http3: true, endpoints: []string{groupAll}},
+				{name: "listener-2", network: "tcp", address: ":8080", h2c: true, endpoints: []string{groupAll}},
+				{name: "listener-3", network: "unix", address: "/tmp/hz.sock", endpoints: []string{groupAll}},
+			},
+		},
+		{
+			name: "bandwidth limit",
+			in:   "addr=:8080,bw_limit=1MB",
+			want: []listenerSpec{{name: "listener-1", network: "tcp", address: ":8080", bwLimit: 1000000,
+				hasBwLimit: true, endpoints: []string{groupAll}}},
+		},
+		{name: "missing address", in: "name=x", wantErr: "the address (addr) must be set"},
+		{name: "not key=value", in: "addr=:8080,tls", wantErr: "expected key=value"},
+		{name: "unknown setting", in: "addr=:8080,port=80", wantErr: "unknown listener setting"},
+		{name: "unknown network", in: "addr=:8080,network=udp", wantErr: "unsupported network"},
+		{name: "tls without certificate", in: "addr=:8443,tls=true", wantErr: "TLS requires"},
+		{name: "h2c with tls", in: "addr=:8443,h2c=true", tls: true, wantErr: "h2c is only for non TLS"},
+		{name: "http3 without tls", in: "addr=:8080,http3=true", wantErr: "HTTP/3 requires"},
+		{name: "unknown group", in: "addr=:8080,endpoints=static+private", wantErr: "unknown endpoint group"},
+		{name: "duplicate name", in: "name=a,addr=:8080;name=a,addr=:8081", wantErr: "duplicate listener name"},
+		{name: "invalid bool", in: "addr=:8080,h2c=maybe", wantErr: "invalid listener h2c setting"},
+	}
+	for _, tt := range tests {
+		got, err := parseListenerSpecs(tt.in, tt.tls)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b listenerSpec) bool {
+			return a.name == b.name && a.network == b.network && a.address == b.address && a.tls == b.tls &&
+				a.h2c == b.h2c && a.http3 == b.http3 && a.bwLimit == b.bwLimit && a.hasBwLimit == b.hasBwLimit &&
+				slices.Equal(a.endpoints, b.endpoints)
+		}) {
+			t.Errorf("%s: parseListenerSpecs() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListenerServes(t *testing.T) {
+	l := listenerSpec{endpoints: []string{groupStatic, "/_/ver"}}
+	tests := []struct {
+		path, group string
+		want        bool
+	}{
+		{"/", groupStatic, true},
+		{"/_/version", groupPublic, true},
+		{"/_/healthz", groupPublic, false},
+		{"/_/alloc", groupAdmin, false},
+	}
+	for _, tt := range tests {
+		if got := l.serves(tt.path, tt.group); got != tt.want {
+			t.Errorf("serves(%s, %s) = %v, want %v", tt.path, tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestHealthListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    HealthListener
+		wantErr bool
+	}{
+		{
+			name:   "listen",
+			config: Config{Listen: ":8080"},
+			want:   HealthListener{Network: "tcp", Address: ":8080"},
+		},
+		{
+			name:   "tls",
+			config: Config{Listen: ":8443", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+			want:   HealthListener{Network: "tcp", Address: ":8443", TLS: true},
+		},
+		{
+			name:   "first listener serving the public endpoints",
+			config: Config{Listeners: "addr=:8080,endpoints=static;addr=[::1]:9090,network=tcp6,endpoints=admin+public"},
+			want:   HealthListener{Index: 1, Network: "tcp", Address: "[::1]:9090"},
+		},
+		{
+			name:   "unix socket",
+			config: Config{Listeners: "addr=:8080,endpoints=static;network=unix,addr=/run/hz.sock,endpoints=/_/healthz"},
+			want:   HealthListener{Index: 1, Network: "unix", Address: "/run/hz.sock"},
+		},
+		{name: "no health endpoints", config: Config{Listeners: "addr=:8080,endpoints=static+admin"}, wantErr: true},
+		{name: "invalid", config: Config{Listeners: "port=80"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.config.HealthListener()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: HealthListener() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
+	"github.com/dustin/go-humanize"
+)
+
+// maxLoadgenConcurrency is the maximum number of concurrent workers of a
+// load generator run started with `/_/loadgen`.
+const maxLoadgenConcurrency = 1024
+
+// loadgenManager holds the current (or last) load generator run started with
+// `/_/loadgen`, there can be only one run in progress at a time.
+type loadgenManager struct {
+	mu     sync.Mutex
+	runner *loadgen.Runner
+}
+
+// start starts a new run, unless one is already in progress.
+func (lm *loadgenManager) start(config loadgen.Config) (*loadgen.Runner, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.runner != nil {
+		select {
+		case <-lm.runner.Done():
+		default:
+			return nil, errLoadgenRunning
+		}
+	}
+	// The run isn't tied to the request which started it.
+	r, err := loadgen.Start(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	lm.runner = r
+
+	return r, nil
+}
+
+// current returns the current (or last) run, nil if none was started.
+func (lm *loadgenManager) current() *loadgen.Runner {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	return lm.runner
+}
+
+// stop stops the current run, if any.
+func (lm *loadgenManager) stop() {
+	if r := lm.current(); r != nil {
+		r.Stop()
+	}
+}
+
+// loadgenMaxBody is the maximum size of the form posted to `/_/loadgen`.
+const loadgenMaxBody = 64 << 10
+
+// errLoadgenRunning is returned when starting a run while another one is in
+// progress.
+var errLoadgenRunning = errors.New("a load generator run is already in progress")
+
+// parseLoadgenQuery converts the query params of a `/_/loadgen` request to a
+// load generator configuration. The credentials of the targets aren't
+// accepted in the query, which ends up in logs, but only in the
+// `X-Target-Username` and `X-Target-Password` headers or the form body.
+func parseLoadgenQuery(r *http.Request) (loadgen.Config, error) {
+	var (
+		config loadgen.Config
+		errs   []error
+	)
+	query := r.URL.Query()
+
+	for _, t := range query["target"] {
+		for _, v := range strings.Split(t, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				config.Targets = append(config.Targets, v)
+			}
+		}
+	}
+	config.Mix = query.Get("mix")
+	config.GetPath = query.Get("get_path")
+	if query.Has("username") || query.Has("password") {
+		errs = append(errs, errors.New("the target credentials must be sent in the X-Target-Username and X-Target-Password headers or in the form body, not in the query"))
+	}
+	config.Username = r.Header.Get("X-Target-Username")
+	config.Password = r.Header.Get("X-Target-Password")
+	if len(config.Username) == 0 && len(config.Password) == 0 {
+		config.Username = r.PostFormValue("username")
+		config.Password = r.PostFormValue("password")
+	}
+
+	if v := query.Get("concurrency"); len(v) > 0 {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 1 || x > maxLoadgenConcurrency {
+			errs = append(errs, fmt.Errorf("%s: invalid concurrency (1 to %d)", v, maxLoadgenConcurrency))
+		}
+		config.Concurrency = x
+	}
+	if v := query.Get("rate"); len(v) > 0 {
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid rate", v))
+		}
+		config.Rate = x
+	}
+	if v := query.Get("requests"); len(v) > 0 {
+		x, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid number of requests", v))
+		}
+		config.Requests = x
+	}
+	for _, d := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"duration", &config.Duration},
+		{"timeout", &config.Timeout},
+	} {
+		if v := query.Get(d.name); len(v) > 0 {
+			x, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid %s", v, d.name))
+			}
+			*d.dst = x
+		}
+	}
+	for _, s := range []struct {
+		name string
+		dst  *int64
+	}{
+		{"upload_size", &config.UploadSize},
+		{"download_size", &config.DownloadSize},
+	} {
+		if v := query.Get(s.name); len(v) > 0 {
+			x, err := humanize.ParseBytes(v)
+			if err != nil || x > 1<<40 {
+				errs = append(errs, fmt.Errorf("%s: invalid %s", v, s.name))
+			}
+			*s.dst = int64(x)
+		}
+	}
+	if v := query.Get("insecure"); len(v) > 0 {
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid insecure value", v))
+		}
+		config.Insecure = x
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// writeLoadgenReport writes the report of a run, as JSON if the client
+// accepts it (or with the `format=json` query param) and otherwise as text.
+func writeLoadgenReport(w http.ResponseWriter, r *http.Request, status int, report loadgen.Report) {
+	if wantsJSON(r) || r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = report.WriteJSON(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	report.WriteText(w)
+}
+
+// loadgenHandler is an HTTP handler that is used on the `/_/loadgen` path and
+// which controls the load generator: `POST` starts a run configured with the
+// query params (`target`, `mix`, `concurrency`, `rate`, `duration`,
+// `requests`, ...), `GET` returns the report of the current (or last) run and
+// `DELETE` stops the current run.
+func loadgenHandler(lm *loadgenManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			config, err := parseLoadgenQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			runner, err := lm.start(config)
+			if errors.Is(err, errLoadgenRunning) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c := runner.Config()
+			reqLogger.Info("Load generator run started", "targets", c.Targets, "mix", c.Mix,
+				"concurrency", c.Concurrency, "rate", c.Rate, "duration", c.Duration, "requests", c.Requests)
+			writeLoadgenReport(w, r, http.StatusAccepted, runner.Report())
+		case http.MethodDelete:
+			runner := lm.current()
+			if runner == nil {
+				http.Error(w, "no load generator run was started", http.StatusNotFound)
+				return
+			}
+			runner.Stop()
+			<-runner.Done()
+			reqLogger.Info("Load generator run stopped")
+			writeLoadgenReport(w, r, http.StatusOK, runner.Report())
+		default:
+			runner := lm.current()
+			if runner == nil {
+				http.Error(w, "no load generator run was started", http.StatusNotFound)
+				return
+			}
+			writeLoadgenReport(w, r, http.StatusOK, runner.Report())
+		}
+	})
+}
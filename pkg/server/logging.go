@@ -16,10 +16,14 @@ import (
 // Context key types to avoid collisions.
 type loggerKeyType struct{}
 type requestIDKeyType struct{}
+type userKeyType struct{}
+type stateKeyType struct{}
 
 var (
 	loggerKey    = loggerKeyType{}
 	requestIDKey = requestIDKeyType{}
+	userKey      = userKeyType{}
+	stateKey     = stateKeyType{}
 )
 
 // TeeLogHandler will handle logging to 2 different destinations:
@@ -30,6 +34,9 @@ type TeeLogHandler struct {
 	mu   sync.Mutex
 	buff *strings.Builder
 	next slog.Handler
+	// err is the last error of the `next` handler, reset by a successful
+	// log message.
+	err error
 }
 
 // Enabled just returns true since anyway the "internal" logger will write any
@@ -56,9 +63,17 @@ func (t *TeeLogHandler) WithGroup(name string) slog.Handler {
 
 // Handle a log record.
 func (t *TeeLogHandler) Handle(ctx context.Context, r slog.Record) error {
-	// Send the log record to the next handler.
-	if err := t.next.Handle(ctx, r); err != nil {
-		return fmt.Errorf("%w", err)
+	// Send the log record to the next handler, if it handles its level.
+	if t.next.Enabled(ctx, r.Level) {
+		err := t.next.Handle(ctx, r)
+
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("%w", err)
+		}
 	}
 
 	t.mu.Lock()
@@ -86,6 +101,15 @@ func (t *TeeLogHandler) Flush(w io.Writer) error {
 	return nil
 }
 
+// Err returns the error of the last log message sent to the `next` handler,
+// if it failed.
+func (t *TeeLogHandler) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.err
+}
+
 // NewTeeLogHandler creates and initializes a new TeeLogHandler.
 func NewTeeLogHandler(handler slog.Handler) *TeeLogHandler {
 	t := TeeLogHandler{
@@ -115,50 +139,9 @@ func quickID(length int) string {
 	return base64.URLEncoding.EncodeToString(bytes)
 }
 
-// getClientIP extracts the real client IP address from an HTTP request. It checks
-// headers in the following priority order:
-//  1. Fly-Client-IP (used by Fly.io proxy)
-//  2. X-Real-IP (used by Nginx and others)
-//  3. First entry in X-Forwarded-For (common proxy header)
-//  4. Falls back to the RemoteAddr from the request
-func getClientIP(r *http.Request) string {
-	// Check for Fly-Client-IP header (Fly.io specific).
-	if flyClientIP := r.Header.Get("Fly-Client-IP"); flyClientIP != "" {
-		return flyClientIP
-	}
-
-	// Check for X-Real-IP header (commonly set by Nginx and others).
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
-	}
-
-	// Check for X-Forwarded-For header (common for proxies).
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		// X-Forwarded-For might contain multiple IPs (client, proxy1, proxy2, ...),
-		// get the first one which is typically the client IP.
-		ips := strings.Split(forwardedFor, ",")
-		if len(ips) > 0 {
-			// Trim space that might be present after the comma.
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Fall back to RemoteAddr if no headers are found. RemoteAddr is in
-	// format "IP:port", so strip off the port if present.
-	ip := r.RemoteAddr
-	if idx := strings.LastIndex(ip, ":"); idx != -1 {
-		ip = ip[:idx]
-	}
-
-	// Remove IPv6 brackets if present.
-	ip = strings.TrimPrefix(ip, "[")
-	ip = strings.TrimSuffix(ip, "]")
-
-	return ip
-}
-
 // loggingMidd is an HTTP middleware that logs each request and adds the logger and request ID to the context.
-func loggingMidd(logger *slog.Logger, h http.Handler) http.Handler {
+// The client address is determined taking into account the `proxies` that are trusted.
+func loggingMidd(logger *slog.Logger, proxies trustedProxies, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		id := quickID(6)
@@ -171,7 +154,7 @@ func loggingMidd(logger *slog.Logger, h http.Handler) http.Handler {
 		// attributes in the log line itself.
 		reqLogger := logger.With("id", id)
 		reqLogger.Info("Request received", "id", id, "method", r.Method,
-			"url", r.URL.Path, "client_addr", getClientIP(r))
+			"url", r.URL.Path, "client_addr", proxies.clientIP(r))
 
 		// Add then logger and request ID to the context.
 		ctx := context.WithValue(r.Context(), loggerKey, reqLogger)
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// endpointMetrics are the request counters of one endpoint.
+type endpointMetrics struct {
+	requests     atomic.Int64
+	inFlight     atomic.Int64
+	clientErrors atomic.Int64
+	serverErrors atomic.Int64
+	panics       atomic.Int64
+	// duration is the total duration of all the finished requests.
+	duration atomic.Int64
+}
+
+// requestMetrics holds the request counters of all the endpoints, keyed by
+// path.
+type requestMetrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointMetrics
+}
+
+// newRequestMetrics creates an empty set of request counters.
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{endpoints: make(map[string]*endpointMetrics)}
+}
+
+// endpoint returns (creating them if needed) the counters of the endpoint at
+// `path`.
+func (m *requestMetrics) endpoint(path string) *endpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.endpoints[path]
+	if !ok {
+		e = &endpointMetrics{}
+		m.endpoints[path] = e
+	}
+
+	return e
+}
+
+// writeStats writes the counters of the endpoints which had any requests to
+// `w`, sorted by path.
+func (m *requestMetrics) writeStats(w io.Writer) {
+	m.mu.Lock()
+	paths := make([]string, 0, len(m.endpoints))
+	for p := range m.endpoints {
+		paths = append(paths, p)
+	}
+	m.mu.Unlock()
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		e := m.endpoint(p)
+		requests := e.requests.Load()
+		if requests == 0 {
+			continue
+		}
+		var avg time.Duration
+		if finished := requests - e.inFlight.Load(); finished > 0 {
+			avg = time.Duration(e.duration.Load() / finished)
+		}
+		_, _ = fmt.Fprintf(w, "\t%s: requests=%d in_flight=%d client_errors=%d server_errors=%d panics=%d avg_duration=%s\n",
+			p, requests, e.inFlight.Load(), e.clientErrors.Load(), e.serverErrors.Load(), e.panics.Load(), avg)
+	}
+}
+
+// statusRecorder is an http.ResponseWriter which remembers the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and sends the response header.
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the implicit 200 status code (if no header was written yet)
+// and writes the response body.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, if supported.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsMidd is an HTTP middleware that counts the requests of an endpoint,
+// their duration and the client (4xx) and server (5xx) errors.
+func metricsMidd(m *endpointMetrics, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.requests.Add(1)
+		m.inFlight.Add(1)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			m.inFlight.Add(-1)
+			m.duration.Add(int64(time.Since(start)))
+			switch {
+			case rec.status >= 500:
+				m.serverErrors.Add(1)
+			case rec.status >= 400:
+				m.clientErrors.Add(1)
+			}
+		}()
+
+		h.ServeHTTP(rec, r)
+	})
+}
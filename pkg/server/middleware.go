@@ -1,12 +1,112 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
 )
 
-// basicAuth wraps a handler with HTTP Basic Authentication and logs authentication failures.
-func basicAuth(handler http.Handler, username, password string) http.Handler {
+// middleware wraps an http.Handler, adding some behaviour before and/or after
+// it handles a request.
+type middleware func(h http.Handler) http.Handler
+
+// chain wraps `h` with the middlewares, the first one being the outermost
+// (it sees the request first).
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+
+	return h
+}
+
+// snapshotMidd adds the current live state of the server to the request
+// context, such that all the middlewares (and the handler) of a request use
+// the same settings even if the configuration is reloaded in the meantime.
+func (s *Server) snapshotMidd(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), stateKey, s.state.Load())
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withState adapts a middleware which depends on the live state of the server
+// (the settings that can be reloaded). The state is taken from the request
+// context (see snapshotMidd) or loaded if missing.
+func (s *Server) withState(mw func(st *liveState, h http.Handler) http.Handler) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st, ok := r.Context().Value(stateKey).(*liveState)
+			if !ok {
+				st = s.state.Load()
+			}
+			mw(st, h).ServeHTTP(w, r)
+		})
+	}
+}
+
+// methodsMidd returns a middleware which only allows the HTTP `methods` (HEAD
+// is allowed together with GET), other methods get a 405 response with the
+// `Allow` header. All methods are allowed if `methods` is empty.
+func methodsMidd(methods []string) middleware {
+	if len(methods) == 0 {
+		return func(h http.Handler) http.Handler { return h }
+	}
+
+	allowed := slices.Clone(methods)
+	if slices.Contains(allowed, http.MethodGet) && !slices.Contains(allowed, http.MethodHead) {
+		allowed = append(allowed, http.MethodHead)
+	}
+	allow := strings.Join(allowed, ", ")
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(allowed, r.Method) {
+				w.Header().Set("Allow", allow)
+				http.Error(w, fmt.Sprintf("method %s not allowed for this path", r.Method),
+					http.StatusMethodNotAllowed)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxBodyMidd returns a middleware which limits the size of request bodies to
+// `limit` bytes, reading more fails and the connection is closed. Requests
+// which declare a bigger `Content-Length` get a 413 response.
+func maxBodyMidd(limit int64) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				http.Error(w, fmt.Sprintf("request body too large (limit %d bytes)", limit),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authMidd wraps a handler with authentication according to `mode` (HTTP
+// Basic authentication, TLS client certificates or either of them) and logs
+// authentication failures. The username of an authenticated client is added
+// to the request context.
+func authMidd(handler http.Handler, auth *authenticator, mode authMode) http.Handler {
+	if mode == authNone {
+		return handler
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get the per-request logger and id.
 		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
@@ -20,16 +120,43 @@ func basicAuth(handler http.Handler, username, password string) http.Handler {
 			return
 		}
 
+		// Try the client certificate first, if allowed for this endpoint.
+		if mode == authMTLS || mode == authEither {
+			if cert := verifiedClientCert(r); cert != nil {
+				user, ok := auth.certUser(cert)
+				if !ok {
+					reqLogger.Warn("Authorization failed", "id", id, "method", "mtls",
+						"reason", "client certificate not mapped to any user",
+						"subject", cert.Subject.String())
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+
+				reqLogger.Info("Authenticated", "id", id, "method", "mtls", "user", user,
+					"subject", cert.Subject.String())
+				ctx := context.WithValue(r.Context(), userKey, user)
+				handler.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			if mode == authMTLS || len(auth.username) == 0 {
+				reqLogger.Warn("Authentication failed", "id", id, "method", "mtls",
+					"reason", "no verified client certificate provided")
+				http.Error(w, "Unauthorized: client certificate required", http.StatusUnauthorized)
+				return
+			}
+		}
+
 		user, pass, hasAuth := r.BasicAuth()
 
 		// Check if credentials were provided and are valid.
-		if !hasAuth || user != username || pass != password {
+		if !hasAuth || user != auth.username || pass != auth.password {
 			// Log the failed authentication attempt
 			if !hasAuth {
-				reqLogger.Warn("Authentication failed", "id", id,
+				reqLogger.Warn("Authentication failed", "id", id, "method", "basic",
 					"reason", "no credentials provided")
 			} else {
-				reqLogger.Warn("Authentication failed", "id", id,
+				reqLogger.Warn("Authentication failed", "id", id, "method", "basic",
 					"reason", "invalid usernamer and/or password", "user", user)
 			}
 
@@ -39,6 +166,70 @@ func basicAuth(handler http.Handler, username, password string) http.Handler {
 		}
 
 		// If we get here, credentials are valid, call the wrapped handler.
-		handler.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), userKey, user)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// wantsJSON returns true if the client accepts a JSON response.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// recoverMidd is an HTTP middleware that recovers from a panic of the handler:
+// the panic and its stack trace are logged with the request ID, counted in
+// the endpoint metrics `m` and a 500 response is returned (JSON if the client
+// accepts it, otherwise text). If `crash` is true then the process exits
+// instead, like with an unrecovered panic.
+func recoverMidd(m *endpointMetrics, crash bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// Used by net/http itself to abort a response, not a bug.
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+
+			stack := debug.Stack()
+			m.panics.Add(1)
+
+			reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+			if !ok {
+				reqLogger = slog.Default()
+			}
+			id, _ := r.Context().Value(requestIDKey).(string)
+			reqLogger.Error("Handler panic", "id", id, "method", r.Method, "url", r.URL.Path,
+				"panic", fmt.Sprint(v), "stack", string(stack))
+
+			if crash {
+				reqLogger.Error("Crashing the process because of the handler panic", "id", id)
+				// Same output and exit code as an unrecovered panic.
+				fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", v, stack)
+				os.Exit(2)
+			}
+
+			// Nothing can be sent if the response was already started.
+			if rec.status != 0 {
+				return
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"error":      "internal server error",
+					"request_id": id,
+				})
+				return
+			}
+			http.Error(w, fmt.Sprintf("Internal server error (request ID: %s)", id),
+				http.StatusInternalServerError)
+		}()
+
+		h.ServeHTTP(rec, r)
 	})
 }
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMethodsMidd(t *testing.T) {
+	h := methodsMidd([]string{http.MethodGet, http.MethodPost})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for method, want := range map[string]int{
+		http.MethodGet: http.StatusOK, http.MethodHead: http.StatusOK, http.MethodPost: http.StatusOK,
+		http.MethodDelete: http.StatusMethodNotAllowed,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", method, rec.Code, want)
+		}
+		if want == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != "GET, POST, HEAD" {
+			t.Errorf("%s: Allow %q", method, rec.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"log/slog"
+)
+
+// DefaultConfig returns the default configuration of the server, as used by
+// the hello-zedcloud app except that authentication is disabled (there is no
+// random username and password). It's a good starting point for New together
+// with options, for example:
+//
+//	srv, err := server.New(server.DefaultConfig(),
+//		server.WithListen("127.0.0.1:9090"), server.WithBasicAuth("admin", "secret"))
+func DefaultConfig() Config {
+	return Config{
+		Listen:    ":8080",
+		StaticDir: "./static",
+		BwLimit:   "2GB",
+		AuthMode:  string(authBasic),
+		LogLevel:  "debug",
+		OnPanic:   "recover",
+
+		AllocLimit:     "1GB",
+		PeerInterval:   "10s",
+		PeerSampleSize: "256KB",
+	}
+}
+
+// serverOptions are the settings of a Server which are changed by an Option.
+type serverOptions struct {
+	config     Config
+	logHandler slog.Handler
+}
+
+// Option changes a setting of a Server, see New.
+type Option func(o *serverOptions)
+
+// WithConfig replaces the whole configuration. Options given after it still
+// apply on top of it.
+func WithConfig(config Config) Option {
+	return func(o *serverOptions) {
+		o.config = config
+	}
+}
+
+// WithListen sets the address (`host:port`) of the single listener of the
+// server, see Config.Listen.
+func WithListen(addr string) Option {
+	return func(o *serverOptions) {
+		o.config.Listen = addr
+	}
+}
+
+// WithListeners sets several listeners, see Config.Listeners.
+func WithListeners(listeners string) Option {
+	return func(o *serverOptions) {
+		o.config.Listeners = listeners
+	}
+}
+
+// WithStaticDir sets the directory from which static files are served.
+func WithStaticDir(dir string) Option {
+	return func(o *serverOptions) {
+		o.config.StaticDir = dir
+	}
+}
+
+// WithVersion sets the version string returned by `/_/version`.
+func WithVersion(version string) Option {
+	return func(o *serverOptions) {
+		o.config.Version = version
+	}
+}
+
+// WithBasicAuth sets the HTTP Basic authentication credentials of the
+// authenticated endpoints. An empty username disables authentication.
+func WithBasicAuth(username, password string) Option {
+	return func(o *serverOptions) {
+		o.config.Username = username
+		o.config.Password = password
+	}
+}
+
+// WithTLS enables HTTPS with the PEM encoded certificate and private key
+// files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *serverOptions) {
+		o.config.TLSCertFile = certFile
+		o.config.TLSKeyFile = keyFile
+	}
+}
+
+// WithBandwidthLimit sets the bandwidth limit of the server, a string like
+// `2MB` (meaning 2 megabytes per second).
+func WithBandwidthLimit(limit string) Option {
+	return func(o *serverOptions) {
+		o.config.BwLimit = limit
+	}
+}
+
+// WithRateLimit sets the request rate limit of each client (like `10/s:20`)
+// and the per path prefix rate limits (like `/_/alloc=1/s`), see
+// Config.RateLimit and Config.RateLimits.
+func WithRateLimit(limit, perPath string) Option {
+	return func(o *serverOptions) {
+		o.config.RateLimit = limit
+		o.config.RateLimits = perPath
+	}
+}
+
+// WithTrustedProxies sets the CIDRs of the trusted proxies, see
+// Config.TrustedProxies.
+func WithTrustedProxies(proxies string) Option {
+	return func(o *serverOptions) {
+		o.config.TrustedProxies = proxies
+	}
+}
+
+// WithLogLevel sets the minimum level of the log messages written to stderr.
+func WithLogLevel(level string) Option {
+	return func(o *serverOptions) {
+		o.config.LogLevel = level
+	}
+}
+
+// WithOnPanic selects what happens when a request handler panics, `recover`
+// or `crash`, see Config.OnPanic.
+func WithOnPanic(mode string) Option {
+	return func(o *serverOptions) {
+		o.config.OnPanic = mode
+	}
+}
+
+// WithHealthThresholds sets the minimum free disk space and the maximum
+// memory (like `100MB`) of the built-in health checks, empty disables a check.
+func WithHealthThresholds(minFreeDisk, maxMemory string) Option {
+	return func(o *serverOptions) {
+		o.config.HealthMinFreeDisk = minFreeDisk
+		o.config.HealthMaxMemory = maxMemory
+	}
+}
+
+// WithAllocLimit sets the maximum total size (like `1GB`) of the memory
+// allocations made with `/_/alloc`, empty disables the limit.
+func WithAllocLimit(limit string) Option {
+	return func(o *serverOptions) {
+		o.config.AllocLimit = limit
+	}
+}
+
+// WithDiskDir sets the directory in which the `/_/disk` jobs write their
+// files, see Config.DiskDir.
+func WithDiskDir(dir string) Option {
+	return func(o *serverOptions) {
+		o.config.DiskDir = dir
+	}
+}
+
+// WithCrashFile sets the file in which the crashes scheduled for the next
+// starts are persisted, see Config.CrashFile.
+func WithCrashFile(path string) Option {
+	return func(o *serverOptions) {
+		o.config.CrashFile = path
+	}
+}
+
+// WithScenario sets the scenario (a file or inline YAML or JSON) run once the
+// server is started, see Config.Scenario.
+func WithScenario(scenario string) Option {
+	return func(o *serverOptions) {
+		o.config.Scenario = scenario
+	}
+}
+
+// WithPeers sets the peer instances which are probed, and the UDP address on
+// which the instances discover each other (empty disables the discovery), see
+// Config.Peers and Config.PeerDiscovery.
+func WithPeers(peers, discovery string) Option {
+	return func(o *serverOptions) {
+		o.config.Peers = peers
+		o.config.PeerDiscovery = discovery
+	}
+}
+
+// WithLogHandler sends the log messages of the server to `h` instead of
+// stderr, for example to use the logger of the program embedding the server.
+// The log level setting doesn't apply to `h`, it filters the messages itself.
+// The logs returned by `/_/logs` are not affected.
+func WithLogHandler(h slog.Handler) Option {
+	return func(o *serverOptions) {
+		o.logHandler = h
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestOptionsPrecedence(t *testing.T) {
+	o := serverOptions{config: DefaultConfig()}
+	for _, opt := range []Option{
+		WithListen(":9090"),
+		WithConfig(Config{Listen: ":7070", LogLevel: "warn"}),
+		WithBasicAuth("admin", "secret"),
+	} {
+		opt(&o)
+	}
+
+	want := Config{Listen: ":7070", LogLevel: "warn", Username: "admin", Password: "secret"}
+	if o.config != want {
+		t.Errorf("config = %+v, want %+v", o.config, want)
+	}
+}
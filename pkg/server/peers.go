@@ -0,0 +1,748 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrei-zededa/hello-zedcloud/pkg/loadgen"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// defaultPeerInterval is the default interval between the probes of the
+	// peers and between the discovery announcements.
+	defaultPeerInterval = 10 * time.Second
+
+	// defaultPeerSampleSize is the default size of the throughput samples.
+	defaultPeerSampleSize = 256 << 10
+
+	// peerExpiry is the number of probe intervals after which a discovered
+	// peer which wasn't announced (or resolved) again is removed.
+	peerExpiry = 3
+
+	// maxPeerProbeTimeout is the maximum timeout of each probe request.
+	maxPeerProbeTimeout = 5 * time.Second
+
+	// maxDiscoveredPeers is the maximum number of peers found by DNS SRV
+	// or by the discovery announcements (which aren't authenticated), the
+	// others are ignored until some expire.
+	maxDiscoveredPeers = 64
+)
+
+// The sources of the peers.
+const (
+	peerSourceStatic    = "static"
+	peerSourceSRV       = "dns-srv"
+	peerSourceMulticast = "multicast"
+	peerSourceBroadcast = "broadcast"
+)
+
+// peerConfig is the parsed peers configuration.
+type peerConfig struct {
+	name       string
+	static     []string
+	srv        []string
+	discovery  *net.UDPAddr
+	interval   time.Duration
+	sampleSize int64
+	scheme     string
+}
+
+// enabled returns true if there are any peers to probe or discover.
+func (pc peerConfig) enabled() bool {
+	return len(pc.static) > 0 || len(pc.srv) > 0 || pc.discovery != nil
+}
+
+// discoverySource returns the source of the peers found by the discovery
+// announcements.
+func (pc peerConfig) discoverySource() string {
+	if pc.discovery != nil && pc.discovery.IP.IsMulticast() {
+		return peerSourceMulticast
+	}
+
+	return peerSourceBroadcast
+}
+
+// parsePeerURL converts a static peer, a base URL or a `host:port` address,
+// to a base URL.
+func parsePeerURL(s, scheme string) (string, error) {
+	if !strings.Contains(s, "://") {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return "", fmt.Errorf("%s: invalid peer address: %w", s, err)
+		}
+		return scheme + "://" + s, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid peer URL: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return "", fmt.Errorf("%s: invalid peer URL (expected http:// or https://)", s)
+	}
+
+	return u.Scheme + "://" + u.Host + strings.TrimRight(u.Path, "/"), nil
+}
+
+// parsePeerConfig parses the peers settings of `c`.
+func parsePeerConfig(c Config) (peerConfig, error) {
+	var errs []error
+
+	pc := peerConfig{
+		name:       strings.TrimSpace(c.PeerName),
+		interval:   defaultPeerInterval,
+		sampleSize: defaultPeerSampleSize,
+		scheme:     "http",
+	}
+	if c.tlsEnabled() {
+		pc.scheme = "https"
+	}
+	if len(pc.name) == 0 {
+		pc.name, _ = os.Hostname()
+	}
+
+	for _, p := range strings.Split(c.Peers, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if name, ok := strings.CutPrefix(p, "srv:"); ok {
+			if len(name) == 0 {
+				errs = append(errs, fmt.Errorf("%s: empty DNS SRV name", p))
+				continue
+			}
+			pc.srv = append(pc.srv, name)
+			continue
+		}
+		u, err := parsePeerURL(p, pc.scheme)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pc.static = append(pc.static, u)
+	}
+
+	if d := strings.TrimSpace(c.PeerDiscovery); len(d) > 0 {
+		addr, err := net.ResolveUDPAddr("udp", d)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: invalid peer discovery address: %w", d, err))
+		case addr.Port == 0 || addr.IP == nil:
+			errs = append(errs, fmt.Errorf("%s: the peer discovery address must have an IP and a port", d))
+		case !addr.IP.IsMulticast() && addr.IP.To4() == nil:
+			errs = append(errs, fmt.Errorf("%s: the peer discovery address must be a multicast or an IPv4 broadcast address", d))
+		default:
+			pc.discovery = addr
+		}
+	}
+
+	if v := strings.TrimSpace(c.PeerInterval); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			errs = append(errs, fmt.Errorf("%s: invalid peer interval (expected a duration of at least 1s)", v))
+		} else {
+			pc.interval = d
+		}
+	}
+
+	if v := strings.TrimSpace(c.PeerSampleSize); len(v) > 0 {
+		x, err := parseSize("peer sample size", v)
+		if err != nil {
+			errs = append(errs, err)
+		} else if x > echoMaxBody/2 {
+			errs = append(errs, fmt.Errorf("%s: the peer sample size can be at most %s", v,
+				humanize.IBytes(echoMaxBody/2)))
+		} else {
+			pc.sampleSize = int64(x)
+		}
+	}
+
+	return pc, errors.Join(errs...)
+}
+
+// peerLink is the connectivity from one instance to another.
+type peerLink struct {
+	Reachable  bool    `json:"reachable"`
+	RTT        float64 `json:"rtt_ms"`
+	Throughput float64 `json:"throughput_bytes_per_second,omitempty"`
+}
+
+// peerStatus is the state of a peer and the results of its last probe.
+type peerStatus struct {
+	URL        string  `json:"url"`
+	Name       string  `json:"name,omitempty"`
+	Source     string  `json:"source"`
+	Reachable  bool    `json:"reachable"`
+	Error      string  `json:"error,omitempty"`
+	RTT        float64 `json:"rtt_ms"`
+	Throughput float64 `json:"throughput_bytes_per_second,omitempty"`
+	Probes     int     `json:"probes"`
+	Failures   int     `json:"failures"`
+	LastProbe  string  `json:"last_probe,omitempty"`
+}
+
+// link returns the connectivity to the peer.
+func (ps peerStatus) link() peerLink {
+	return peerLink{Reachable: ps.Reachable, RTT: ps.RTT, Throughput: ps.Throughput}
+}
+
+// peer is a peer instance found by one of the sources.
+type peer struct {
+	status peerStatus
+	// id is the ID of the instance announcing the peer, if discovered by
+	// its announcements.
+	id       string
+	lastSeen time.Time
+	// view are the peers of the peer (its row of the connectivity matrix),
+	// as reported by its last probe.
+	view []peerStatus
+}
+
+// peersView is the response of `/_/peers`. With the `view=local` query param
+// (used by the probes of the peers) it has only this instance's peers,
+// without the connectivity matrix.
+type peersView struct {
+	Name     string       `json:"name"`
+	ID       string       `json:"id"`
+	Enabled  bool         `json:"enabled"`
+	Interval string       `json:"interval,omitempty"`
+	Peers    []peerStatus `json:"peers"`
+
+	// Nodes are the names of all the instances known, which are the rows
+	// and the columns of the matrix (this instance first).
+	Nodes  []string                       `json:"nodes,omitempty"`
+	Matrix map[string]map[string]peerLink `json:"matrix,omitempty"`
+}
+
+// announcement is the message sent by the instances to discover each other.
+type announcement struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Scheme string `json:"scheme"`
+	Port   int    `json:"port"`
+}
+
+// peerManager discovers the peers and probes them continuously.
+type peerManager struct {
+	config peerConfig
+	// id identifies this instance (process), such that it doesn't probe
+	// itself.
+	id     string
+	client *http.Client
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	peers map[string]*peer
+	// self are the URLs which turned out to be this instance.
+	self map[string]bool
+}
+
+// newPeerManager creates a peer manager, which does nothing until run.
+func newPeerManager(config peerConfig, logger *slog.Logger) *peerManager {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The probes are diagnostics which don't send any credentials, the
+	// peers usually have self-signed certificates.
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	return &peerManager{
+		config: config,
+		id:     strings.TrimRight(quickID(9), "="),
+		client: &http.Client{Transport: transport, Timeout: min(config.interval, maxPeerProbeTimeout)},
+		logger: logger,
+		peers:  make(map[string]*peer),
+		self:   make(map[string]bool),
+	}
+}
+
+// add adds (or refreshes) a peer found by `source`. An instance announced
+// with `id` has a single peer, the one of its last announcement.
+func (pm *peerManager) add(u, source, id string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.self[u] {
+		return
+	}
+	if p, ok := pm.peers[u]; ok {
+		p.lastSeen = time.Now()
+		p.id = id
+		return
+	}
+	discovered := 0
+	for pu, p := range pm.peers {
+		if len(id) > 0 && p.id == id {
+			delete(pm.peers, pu)
+			pm.logger.Info("Peer moved", "peer", pu, "new_peer", u, "source", source)
+			continue
+		}
+		if p.status.Source != peerSourceStatic {
+			discovered++
+		}
+	}
+	if source != peerSourceStatic && discovered >= maxDiscoveredPeers {
+		pm.logger.Debug("Too many peers discovered, peer ignored", "peer", u, "source", source,
+			"max", maxDiscoveredPeers)
+		return
+	}
+	pm.peers[u] = &peer{status: peerStatus{URL: u, Source: source}, id: id, lastSeen: time.Now()}
+	pm.logger.Info("Peer found", "peer", u, "source", source)
+}
+
+// expire removes the peers that weren't found again recently, except the
+// static ones.
+func (pm *peerManager) expire() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	deadline := time.Now().Add(-peerExpiry * pm.config.interval)
+	for u, p := range pm.peers {
+		if p.status.Source != peerSourceStatic && p.lastSeen.Before(deadline) {
+			delete(pm.peers, u)
+			pm.logger.Info("Peer lost", "peer", u, "name", p.status.Name, "source", p.status.Source)
+		}
+	}
+}
+
+// resolveSRV adds the peers found by the DNS SRV lookups.
+func (pm *peerManager) resolveSRV(ctx context.Context) {
+	for _, name := range pm.config.srv {
+		_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			pm.logger.Warn("Failed to resolve the peers DNS SRV name", "name", name, "error", err)
+			continue
+		}
+		for _, a := range addrs {
+			host := strings.TrimSuffix(a.Target, ".")
+			pm.add(pm.config.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(a.Port))), peerSourceSRV, "")
+		}
+	}
+}
+
+// run discovers and probes the peers every interval, until `ctx` is done.
+// `port` and `scheme` are the port on which this instance can be probed by
+// its peers and its scheme, used in the discovery announcements (a `port` of
+// 0 disables them).
+func (pm *peerManager) run(ctx context.Context, port int, scheme string) {
+	for _, u := range pm.config.static {
+		pm.add(u, peerSourceStatic, "")
+	}
+	if pm.config.discovery != nil {
+		if err := pm.discover(ctx, port, scheme); err != nil {
+			pm.logger.Error("Peer discovery failed", "address", pm.config.discovery.String(), "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(pm.config.interval)
+	defer ticker.Stop()
+	for {
+		pm.resolveSRV(ctx)
+		pm.expire()
+		pm.probeAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discover starts sending the announcements of this instance (unless `port`
+// is 0) and receiving the ones of the peers, until `ctx` is done.
+func (pm *peerManager) discover(ctx context.Context, port int, scheme string) error {
+	addr := pm.config.discovery
+
+	var (
+		conn net.PacketConn
+		err  error
+	)
+	if addr.IP.IsMulticast() {
+		var mc *net.UDPConn
+		if mc, err = net.ListenMulticastUDP("udp", nil, addr); err == nil {
+			conn = mc
+			if lerr := multicastLoopback(mc, addr.IP.To4() != nil); lerr != nil {
+				pm.logger.Warn("Failed to enable the multicast loopback", "error", lerr)
+			}
+		}
+	} else {
+		lc := net.ListenConfig{Control: broadcastControl}
+		conn, err = lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", addr.Port))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open the discovery socket: %w", err)
+	}
+	pm.logger.Info("Peer discovery started", "address", addr.String(), "source", pm.config.discoverySource())
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	if port > 0 {
+		msg, _ := json.Marshal(announcement{ID: pm.id, Name: pm.config.name, Scheme: scheme, Port: port})
+		go func() {
+			ticker := time.NewTicker(pm.config.interval)
+			defer ticker.Stop()
+			for {
+				if _, err := conn.WriteTo(msg, addr); err != nil && ctx.Err() == nil {
+					pm.logger.Warn("Failed to send the peer discovery announcement", "error", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	} else {
+		pm.logger.Warn("No listener serves the public endpoints, this instance isn't announced to its peers")
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					pm.logger.Error("Peer discovery stopped", "error", err)
+				}
+				return
+			}
+			var a announcement
+			if err := json.Unmarshal(buf[:n], &a); err != nil || len(a.ID) == 0 || a.Port <= 0 || a.Port > 65535 {
+				continue
+			}
+			if a.ID == pm.id {
+				continue
+			}
+			udpAddr, ok := from.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			scheme := "http"
+			if a.Scheme == "https" {
+				scheme = "https"
+			}
+			pm.add(scheme+"://"+net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(a.Port)),
+				pm.config.discoverySource(), a.ID)
+		}
+	}()
+
+	return nil
+}
+
+// probeAll probes all the peers concurrently.
+func (pm *peerManager) probeAll(ctx context.Context) {
+	pm.mu.Lock()
+	urls := make([]string, 0, len(pm.peers))
+	for u := range pm.peers {
+		urls = append(urls, u)
+	}
+	pm.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pm.probe(ctx, u)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe probes a peer: its reachability and latency (`/_/version`), its name
+// and own peers (`/_/peers`) and a throughput sample (`/_/echo`).
+func (pm *peerManager) probe(ctx context.Context, u string) {
+	var (
+		view       peersView
+		throughput float64
+	)
+
+	// The round trip time of a small request.
+	start := time.Now()
+	err := pm.get(ctx, u+"/_/version", io.Discard)
+	rtt := time.Since(start)
+
+	if err == nil {
+		var b bytes.Buffer
+		if err = pm.get(ctx, u+"/_/peers?view=local", &b); err == nil {
+			err = json.Unmarshal(b.Bytes(), &view)
+		}
+		// Only hello-zedcloud instances get the throughput samples.
+		if err == nil && len(view.ID) == 0 {
+			err = errors.New("not a hello-zedcloud instance (no id in /_/peers)")
+		}
+	}
+	if err == nil && view.ID == pm.id {
+		pm.mu.Lock()
+		delete(pm.peers, u)
+		pm.self[u] = true
+		pm.mu.Unlock()
+		pm.logger.Debug("Peer is this instance, ignored", "peer", u)
+		return
+	}
+	if err == nil && pm.config.sampleSize > 0 {
+		throughput, err = pm.sample(ctx, u)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	p, ok := pm.peers[u]
+	if !ok {
+		return
+	}
+	st := &p.status
+	wasReachable := st.Reachable || st.Probes == 0
+	st.Probes++
+	st.LastProbe = time.Now().Format(time.RFC3339)
+	st.Reachable = err == nil
+	// An unreachable peer's own view is unknown.
+	p.view = nil
+	if len(view.Name) > 0 {
+		st.Name = view.Name
+		p.view = view.Peers
+	}
+	if err != nil {
+		st.Failures++
+		st.Error = err.Error()
+		st.RTT, st.Throughput = 0, 0
+		if wasReachable {
+			pm.logger.Warn("Peer unreachable", "peer", u, "name", st.Name, "error", err)
+		}
+		return
+	}
+	st.Error = ""
+	st.RTT = float64(rtt) / float64(time.Millisecond)
+	st.Throughput = throughput
+	if !wasReachable {
+		pm.logger.Info("Peer reachable again", "peer", u, "name", st.Name)
+	}
+}
+
+// get makes a GET request and copies the body of the response to `w`.
+func (pm *peerManager) get(ctx context.Context, u string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := pm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, 1<<20)); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected response %s", u, resp.Status)
+	}
+
+	return nil
+}
+
+// sample sends a throughput sample to `/_/echo` of the peer, which echoes it
+// back (quietly, without dumping the request on stdout), and returns the throughput in bytes per second (in both directions).
+func (pm *peerManager) sample(ctx context.Context, u string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u+"/_/echo?quiet=true",
+		io.LimitReader(loadgen.RandomReader(), pm.config.sampleSize))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = pm.config.sampleSize
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := pm.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	// The echo endpoint answers with 208 Already Reported.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("%s/_/echo: unexpected response %s", u, resp.Status)
+	}
+
+	return float64(pm.config.sampleSize+n) / time.Since(start).Seconds(), nil
+}
+
+// view returns the state of the peers, and the connectivity matrix unless
+// `local`.
+func (pm *peerManager) view(local bool) peersView {
+	v := peersView{
+		Name:     pm.config.name,
+		ID:       pm.id,
+		Enabled:  pm.config.enabled(),
+		Interval: pm.config.interval.String(),
+		Peers:    []peerStatus{},
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	urls := make([]string, 0, len(pm.peers))
+	for u := range pm.peers {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		v.Peers = append(v.Peers, pm.peers[u].status)
+	}
+	if local {
+		return v
+	}
+
+	// The rows are this instance and its peers, the columns all the
+	// instances known. A peer without a name yet is identified by its URL.
+	nodeName := func(ps peerStatus) string {
+		if len(ps.Name) > 0 {
+			return ps.Name
+		}
+		return ps.URL
+	}
+	v.Matrix = map[string]map[string]peerLink{v.Name: {}}
+	for _, u := range urls {
+		p := pm.peers[u]
+		v.Matrix[v.Name][nodeName(p.status)] = p.status.link()
+		if len(p.status.Name) == 0 || p.status.Name == v.Name {
+			continue
+		}
+		row := map[string]peerLink{}
+		for _, ps := range p.view {
+			row[nodeName(ps)] = ps.link()
+		}
+		v.Matrix[p.status.Name] = row
+	}
+
+	var nodes []string
+	for from, row := range v.Matrix {
+		nodes = append(nodes, from)
+		for to := range row {
+			nodes = append(nodes, to)
+		}
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+	nodes = slices.DeleteFunc(nodes, func(n string) bool { return n == v.Name })
+	v.Nodes = append([]string{v.Name}, nodes...)
+
+	return v
+}
+
+// writeText writes the state of the peers and the connectivity matrix as
+// text.
+func (v peersView) writeText(w io.Writer) {
+	if !v.Enabled {
+		_, _ = fmt.Fprintln(w, "Peer discovery is disabled, see the peers and peer_discovery settings.")
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "Instance: %s (probe interval %s)\n", v.Name, v.Interval)
+	_, _ = fmt.Fprintf(w, "Peers (%d):\n", len(v.Peers))
+	for _, p := range v.Peers {
+		name := p.Name
+		if len(name) == 0 {
+			name = "?"
+		}
+		if !p.Reachable {
+			_, _ = fmt.Fprintf(w, "\t%s %s (%s): unreachable, probes=%d failures=%d: %s\n",
+				name, p.URL, p.Source, p.Probes, p.Failures, p.Error)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "\t%s %s (%s): reachable, rtt=%.2fms throughput=%s/s probes=%d failures=%d\n",
+			name, p.URL, p.Source, p.RTT, humanize.Bytes(uint64(p.Throughput)), p.Probes, p.Failures)
+	}
+
+	if len(v.Nodes) < 2 {
+		return
+	}
+	_, _ = fmt.Fprintln(w, "Connectivity matrix (round trip time from the row to the column instance):")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "\t\t%s\n", strings.Join(v.Nodes, "\t"))
+	for _, from := range v.Nodes {
+		row, ok := v.Matrix[from]
+		cells := make([]string, 0, len(v.Nodes))
+		for _, to := range v.Nodes {
+			l, known := row[to]
+			switch {
+			case from == to:
+				cells = append(cells, "-")
+			case !ok || !known:
+				cells = append(cells, "?")
+			case !l.Reachable:
+				cells = append(cells, "FAIL")
+			default:
+				cells = append(cells, fmt.Sprintf("%.2fms", l.RTT))
+			}
+		}
+		_, _ = fmt.Fprintf(tw, "\t%s\t%s\n", from, strings.Join(cells, "\t"))
+	}
+	_ = tw.Flush()
+}
+
+// peerPort returns the port and the scheme of the first TCP listener which
+// serves the endpoints used by the probes of the peers, 0 if none.
+func (s *Server) peerPort() (int, string) {
+	for _, l := range s.listeners {
+		addr, ok := l.ln.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if l.spec.serves("/_/version", groupPublic) && l.spec.serves("/_/peers", groupPublic) &&
+			l.spec.serves("/_/echo", groupPublic) {
+			if l.spec.tls {
+				return addr.Port, "https"
+			}
+			return addr.Port, "http"
+		}
+	}
+
+	return 0, ""
+}
+
+// peersHandler is an HTTP handler that is used on the `/_/peers` path and
+// which returns the state of the peers and the connectivity matrix between
+// the instances, as JSON if the client accepts it and otherwise as text.
+func peersHandler(pm *peerManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := pm.view(r.URL.Query().Get("view") == "local")
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(v)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		v.writeText(w)
+	})
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// broadcastControl is not supported on this platform.
+func broadcastControl(_, _ string, _ syscall.RawConn) error {
+	return fmt.Errorf("peer discovery by broadcast not supported on this platform")
+}
+
+// multicastLoopback is not supported on this platform, several instances on
+// the same host don't discover each other.
+func multicastLoopback(_ *net.UDPConn, _ bool) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// broadcastControl enables sending broadcasts on the peer discovery socket,
+// and several instances on the same host to share it.
+func broadcastControl(_, _ string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); serr != nil {
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// multicastLoopback enables the loopback of the multicast announcements
+// (disabled by net.ListenMulticastUDP), such that several instances on the
+// same host discover each other.
+func multicastLoopback(conn *net.UDPConn, ipv4 bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
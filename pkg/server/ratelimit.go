@@ -0,0 +1,296 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a client bucket must be unused before it is
+// removed. This bounds the memory used for tracking clients.
+const rateLimitIdle = 10 * time.Minute
+
+// rateSpec describes a token bucket: `events` requests per `per` period, with
+// at most `burst` requests at once.
+type rateSpec struct {
+	events float64
+	per    time.Duration
+	burst  int
+}
+
+// limit returns the token bucket refill rate.
+func (r rateSpec) limit() rate.Limit {
+	return rate.Limit(r.events / r.per.Seconds())
+}
+
+// String returns the rate in the same format as parsed by parseRateSpec.
+func (r rateSpec) String() string {
+	return fmt.Sprintf("%s/%s:%d", strconv.FormatFloat(r.events, 'f', -1, 64), r.per, r.burst)
+}
+
+// parseRateSpec parses a rate like `10/s`, `100/m`, `5/h` or `3/500ms`,
+// optionally followed by a burst size (`10/s:20`). The burst defaults to the
+// number of events per period (but at least 1).
+func parseRateSpec(s string) (rateSpec, error) {
+	s = strings.TrimSpace(s)
+	spec, burstStr, hasBurst := strings.Cut(s, ":")
+
+	n, per, ok := strings.Cut(spec, "/")
+	if !ok {
+		return rateSpec{}, fmt.Errorf("%s: invalid rate (expected N/s, N/m, N/h or N/<duration>)", s)
+	}
+	events, err := strconv.ParseFloat(n, 64)
+	if err != nil || events <= 0 {
+		return rateSpec{}, fmt.Errorf("%s: invalid number of requests in rate", s)
+	}
+
+	var d time.Duration
+	switch per {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(per)
+		if err != nil || d <= 0 {
+			return rateSpec{}, fmt.Errorf("%s: invalid rate period", s)
+		}
+	}
+
+	burst := max(int(math.Ceil(events)), 1)
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return rateSpec{}, fmt.Errorf("%s: invalid burst size", s)
+		}
+	}
+
+	return rateSpec{events: events, per: d, burst: burst}, nil
+}
+
+// rateLimitRule is a rate limit that applies to all paths starting with
+// `prefix`.
+type rateLimitRule struct {
+	prefix string
+	spec   rateSpec
+}
+
+// parseRateLimitRules parses per path prefix rate limits in the format
+// `prefix=rate,...`, for example `/_/alloc=1/s:2,/_/upload=10/m`.
+func parseRateLimitRules(s string) ([]rateLimitRule, error) {
+	var rules []rateLimitRule
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		prefix, r, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%s: invalid rate limit (expected /prefix=rate)", entry)
+		}
+		spec, err := parseRateSpec(r)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rateLimitRule{prefix: prefix, spec: spec})
+	}
+
+	// Longest prefix first, such that the most specific rule is found first.
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+
+	return rules, nil
+}
+
+// clientBucket is the token bucket of one client for one rule.
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter limits the request rate of each client, a client being an
+// authenticated user or (if not authenticated) a client IP address. A global
+// rate applies to all paths, unless a more specific per path prefix rule
+// matches the request path.
+type rateLimiter struct {
+	global *rateLimitRule
+	rules  []rateLimitRule
+
+	mu        sync.Mutex
+	buckets   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a new rateLimiter from the `global` rate (can be
+// empty or `0` to disable) and the per path prefix `rules`. If neither is
+// configured then nil is returned and rate limiting is disabled.
+func newRateLimiter(global, rules string) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		buckets:   make(map[string]*clientBucket),
+		lastSweep: time.Now(),
+	}
+
+	if g := strings.TrimSpace(global); len(g) > 0 && g != "0" {
+		spec, err := parseRateSpec(g)
+		if err != nil {
+			return nil, err
+		}
+		rl.global = &rateLimitRule{prefix: "/", spec: spec}
+	}
+
+	r, err := parseRateLimitRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	rl.rules = r
+
+	if rl.global == nil && len(rl.rules) == 0 {
+		return nil, nil
+	}
+
+	return rl, nil
+}
+
+// ruleFor returns the rule which applies to `path`, or nil if none.
+func (rl *rateLimiter) ruleFor(path string) *rateLimitRule {
+	for i := range rl.rules {
+		if strings.HasPrefix(path, rl.rules[i].prefix) {
+			return &rl.rules[i]
+		}
+	}
+
+	return rl.global
+}
+
+// bucket returns (creating it if needed) the token bucket of `client` for
+// `rule`. Idle buckets are removed from time to time.
+func (rl *rateLimiter) bucket(rule *rateLimitRule, client string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for k, b := range rl.buckets {
+			if now.Sub(b.lastSeen) > rateLimitIdle {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	key := rule.prefix + "\x00" + client
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(rule.spec.limit(), rule.spec.burst)}
+		rl.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	return b.limiter
+}
+
+// authFailureLimitMidd is an HTTP middleware, before authentication, which
+// limits the failed authentication attempts (`401` and `403` responses) of
+// each client IP address with the rates of `rl`. Once the bucket of an IP
+// address is empty its requests are refused with `429 Too Many Requests`
+// until it refills, whatever their credentials. If `rl` is nil then `h` is
+// returned.
+func authFailureLimitMidd(rl *rateLimiter, proxies trustedProxies, h http.Handler) http.Handler {
+	if rl == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := rl.ruleFor(r.URL.Path)
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := "auth-failures:ip:" + proxies.clientIP(r)
+		lim := rl.bucket(rule, client)
+		if tokens := lim.Tokens(); tokens < 1 {
+			retry := math.Ceil((1 - max(tokens, 0)) / float64(rule.spec.limit()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(retry), 1)))
+
+			if reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger); ok {
+				id, _ := r.Context().Value(requestIDKey).(string)
+				reqLogger.Warn("Too many failed authentication attempts", "id", id, "client", client,
+					"prefix", rule.prefix, "rate", rule.spec.String())
+			}
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden {
+			lim.Allow()
+		}
+	})
+}
+
+// rateLimitMidd is an HTTP middleware that limits the request rate of each
+// client. It sets the `RateLimit-*` response headers and refuses requests over
+// the limit with `429 Too Many Requests`. If `rl` is nil then `h` is returned.
+func rateLimitMidd(rl *rateLimiter, proxies trustedProxies, h http.Handler) http.Handler {
+	if rl == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := rl.ruleFor(r.URL.Path)
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := "ip:" + proxies.clientIP(r)
+		if user, ok := r.Context().Value(userKey).(string); ok {
+			client = "user:" + user
+		}
+
+		lim := rl.bucket(rule, client)
+		allowed := lim.Allow()
+
+		// Seconds until the bucket is full again.
+		tokens := max(lim.Tokens(), 0)
+		reset := math.Ceil((float64(rule.spec.burst) - tokens) / float64(rule.spec.limit()))
+
+		hdr := w.Header()
+		hdr.Set("RateLimit-Limit", strconv.Itoa(rule.spec.burst))
+		hdr.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		hdr.Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+		hdr.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.spec.burst,
+			int(math.Ceil(float64(rule.spec.burst)/float64(rule.spec.limit())))))
+
+		if !allowed {
+			// Seconds until the next request would be allowed.
+			retry := math.Ceil((1 - tokens) / float64(rule.spec.limit()))
+			hdr.Set("Retry-After", strconv.Itoa(max(int(retry), 1)))
+
+			if reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger); ok {
+				id, _ := r.Context().Value(requestIDKey).(string)
+				reqLogger.Warn("Rate limit exceeded", "id", id, "client", client,
+					"prefix", rule.prefix, "rate", rule.spec.String())
+			}
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    rateSpec
+		wantErr bool
+	}{
+		{in: "10/s", want: rateSpec{events: 10, per: time.Second, burst: 10}},
+		{in: "100/m", want: rateSpec{events: 100, per: time.Minute, burst: 100}},
+		{in: " 5/h ", want: rateSpec{events: 5, per: time.Hour, burst: 5}},
+		{in: "3/500ms", want: rateSpec{events: 3, per: 500 * time.Millisecond, burst: 3}},
+		{in: "0.5/s", want: rateSpec{events: 0.5, per: time.Second, burst: 1}},
+		{in: "1.5/s", want: rateSpec{events: 1.5, per: time.Second, burst: 2}},
+		{in: "10/s:20", want: rateSpec{events: 10, per: time.Second, burst: 20}},
+		{in: "10", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "-1/s", wantErr: true},
+		{in: "x/s", wantErr: true},
+		{in: "10/d", wantErr: true},
+		{in: "10/0s", wantErr: true},
+		{in: "10/s:0", wantErr: true},
+		{in: "10/s:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateSpec(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRateSpec(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRateSpec(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRateSpecString(t *testing.T) {
+	for _, in := range []string{"10/1s:10", "0.5/1m0s:1", "3/500ms:5"} {
+		spec, err := parseRateSpec(in)
+		if err != nil {
+			t.Fatalf("parseRateSpec(%q): %v", in, err)
+		}
+		if got := spec.String(); got != in {
+			t.Errorf("parseRateSpec(%q).String() = %q", in, got)
+		}
+	}
+}
+
+// TestMiddlewareOrder checks that the failed authentication attempts are
+// limited per client IP address before authentication while the server's
+// rate limits apply per user after authentication (such that the users
+// behind the same IP address don't share a limit), like the rate limit of a
+// registered endpoint.
+func TestMiddlewareOrder(t *testing.T) {
+	s, err := New(DefaultConfig(), WithBasicAuth("admin", "secret"), WithRateLimit("", "/_/env=2/h:2"),
+		WithLogHandler(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterEndpoint("/_/custom", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "custom")
+	}), EndpointOptions{Methods: []string{http.MethodGet}, Auth: true, RateLimit: "1/h:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		user       string
+		password   string
+		remote     string
+		wantStatus int
+	}{
+		{name: "unauthenticated", method: http.MethodGet, path: "/_/env", wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", method: http.MethodGet, path: "/_/env", user: "admin", password: "guess",
+			wantStatus: http.StatusUnauthorized},
+		{name: "failed attempts limited before auth", method: http.MethodGet, path: "/_/env", user: "admin",
+			wantStatus: http.StatusTooManyRequests},
+		{name: "wrong method not a failed attempt", method: http.MethodDelete, path: "/_/env", user: "admin",
+			remote: "192.0.2.2:1234", wantStatus: http.StatusMethodNotAllowed},
+		{name: "user from another address", method: http.MethodGet, path: "/_/env", user: "admin",
+			remote: "192.0.2.2:1234", wantStatus: http.StatusOK},
+		{name: "same user from a third address", method: http.MethodGet, path: "/_/env", user: "admin",
+			remote: "192.0.2.3:1234", wantStatus: http.StatusOK},
+		{name: "limited per user", method: http.MethodGet, path: "/_/env", user: "admin",
+			remote: "192.0.2.4:1234", wantStatus: http.StatusTooManyRequests},
+		{name: "public endpoint not limited", method: http.MethodGet, path: "/_/version",
+			wantStatus: http.StatusOK},
+		{name: "endpoint limit after auth", method: http.MethodGet, path: "/_/custom",
+			wantStatus: http.StatusUnauthorized},
+		{name: "endpoint limit after auth again", method: http.MethodGet, path: "/_/custom",
+			wantStatus: http.StatusUnauthorized},
+		{name: "endpoint limit per user", method: http.MethodGet, path: "/_/custom", user: "admin",
+			wantStatus: http.StatusOK},
+		{name: "endpoint limit reached", method: http.MethodGet, path: "/_/custom", user: "admin",
+			remote: "192.0.2.3:1234", wantStatus: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if len(tt.remote) > 0 {
+			r.RemoteAddr = tt.remote
+		}
+		if len(tt.user) > 0 {
+			password := tt.password
+			if len(password) == 0 {
+				password = "secret"
+			}
+			r.SetBasicAuth(tt.user, password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: %s %s status %d, want %d (%s)", tt.name, tt.method, tt.path, rec.Code, tt.wantStatus,
+				strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce is how long to wait after a config file change before
+// reloading, editors and tools like `kubectl` generate several events for a
+// single change.
+const reloadDebounce = 500 * time.Millisecond
+
+// restartSettings are the settings (config file keys) which can't be changed
+// while the server is running, changing them requires a restart.
+var restartSettings = map[string]bool{
+	"listen":         true,
+	"listeners":      true,
+	"addr_file":      true,
+	"static_dir":     true,
+	"tls_cert_file":  true,
+	"tls_key_file":   true,
+	"client_ca_file": true,
+	"scenario":       true,
+
+	"peers":            true,
+	"peer_discovery":   true,
+	"peer_name":        true,
+	"peer_interval":    true,
+	"peer_sample_size": true,
+}
+
+// ConfigLoader returns a freshly loaded configuration, for example by reading
+// again the configuration file and the environment variables.
+type ConfigLoader func() (Config, error)
+
+// ConfigChange describes a setting that was changed by a reload.
+type ConfigChange struct {
+	// Setting is the name of the setting (the config file key).
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+
+	// Pending is true if the setting can't be changed while the server is
+	// running and will only take effect after a restart.
+	Pending bool `json:"pending"`
+}
+
+// String returns a human readable description of the change.
+func (c ConfigChange) String() string {
+	s := fmt.Sprintf("%s: %q -> %q", c.Setting, c.Old, c.New)
+	if c.Pending {
+		s += " (pending restart)"
+	}
+
+	return s
+}
+
+// diffConfigs returns the settings that differ between `old` and `new`, with
+// secrets redacted.
+func diffConfigs(old, new Config) []ConfigChange {
+	var changes []ConfigChange
+
+	ov := reflect.ValueOf(old.Redacted())
+	nv := reflect.ValueOf(new.Redacted())
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "-" || len(name) == 0 || t.Field(i).Type.Kind() != reflect.String {
+			continue
+		}
+
+		o, n := ov.Field(i).String(), nv.Field(i).String()
+		if o == n {
+			// NOTE: A changed password shows up here as unchanged
+			// since both are redacted.
+			if name != "password" || old.Password == new.Password {
+				continue
+			}
+		}
+		changes = append(changes, ConfigChange{Setting: name, Old: o, New: n,
+			Pending: restartSettings[name]})
+	}
+
+	return changes
+}
+
+// withRestartSettings returns a copy of `c` where the settings that require a
+// restart have the values of `running`.
+func withRestartSettings(c, running Config) Config {
+	cv := reflect.ValueOf(&c).Elem()
+	rv := reflect.ValueOf(running)
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if restartSettings[name] {
+			cv.Field(i).Set(rv.Field(i))
+		}
+	}
+
+	return c
+}
+
+// SetConfigLoader enables reloading the configuration with `load`, which is
+// triggered by a SIGHUP, by a `POST /_/reload` request or by a change of the
+// configuration file at `path` (can be empty if there is no file to watch).
+// Must be called before Serve.
+func (s *Server) SetConfigLoader(load ConfigLoader, path string) {
+	s.loader = load
+	s.configPath = path
+}
+
+// Reload loads the configuration with the config loader and atomically
+// applies the settings that can be changed while the server is running. The
+// settings that require a restart are returned as pending changes. If the new
+// configuration is invalid then nothing is changed. `trigger` describes what
+// caused the reload and is only used for logging.
+func (s *Server) Reload(trigger string) ([]ConfigChange, error) {
+	if s.loader == nil {
+		return nil, fmt.Errorf("reloading the configuration is not supported")
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.logger.Info("Reloading configuration", "trigger", trigger)
+
+	config, err := s.loader()
+	if err != nil {
+		s.logger.Error("Failed to reload configuration", "trigger", trigger, "error", err)
+		return nil, err
+	}
+	config.Version = s.config.Version
+	if err := config.Validate(); err != nil {
+		s.logger.Error("Reloaded configuration is invalid, keeping the current one",
+			"trigger", trigger, "error", err)
+		return nil, err
+	}
+
+	// The settings that require a restart keep their running values.
+	effective := withRestartSettings(config, s.config)
+	parsed, err := effective.parse()
+	if err != nil {
+		s.logger.Error("Reloaded configuration is invalid, keeping the current one",
+			"trigger", trigger, "error", err)
+		return nil, err
+	}
+
+	current := s.state.Load()
+	changes := diffConfigs(current.config, effective)
+	for _, c := range diffConfigs(s.config, config) {
+		if c.Pending {
+			changes = append(changes, c)
+		}
+	}
+
+	next := &liveState{
+		config:       effective,
+		auth:         parsed.auth,
+		proxies:      parsed.proxies,
+		limiter:      parsed.limiter,
+		crashOnPanic: parsed.crashOnPanic,
+		health:       parsed.health,
+		allocLimit:   parsed.allocLimit,
+	}
+	// Keep the current rate limiter (and the clients' buckets) if its
+	// settings didn't change.
+	if effective.RateLimit == current.config.RateLimit &&
+		effective.RateLimits == current.config.RateLimits {
+		next.limiter = current.limiter
+	}
+
+	s.state.Store(next)
+	s.logLevel.Set(parsed.logLevel)
+	// Listeners with their own bandwidth limit keep it.
+	for _, l := range s.listeners {
+		if !l.spec.hasBwLimit {
+			l.setLimit(parsed.limit)
+		}
+	}
+
+	for _, c := range changes {
+		if c.Pending {
+			s.logger.Warn("Configuration change requires a restart", "setting", c.Setting,
+				"old", c.Old, "new", c.New)
+			continue
+		}
+		s.logger.Info("Configuration changed", "setting", c.Setting, "old", c.Old, "new", c.New)
+	}
+	s.logger.Info("Configuration reloaded", "trigger", trigger, "changes", len(changes))
+
+	return changes, nil
+}
+
+// watchReloadTriggers reloads the configuration on SIGHUP and on changes of
+// the configuration file, until `ctx` is done.
+func (s *Server) watchReloadTriggers(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var (
+		watcher    *fsnotify.Watcher
+		fileEvents <-chan fsnotify.Event
+		fileErrors <-chan error
+	)
+	if len(s.configPath) > 0 {
+		// Watch the directory instead of the file itself, such that
+		// files replaced by a rename (editors, Kubernetes ConfigMaps)
+		// keep being watched.
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			s.logger.Error("Failed to watch the configuration file", "path", s.configPath, "error", err)
+		} else if err := w.Add(filepath.Dir(s.configPath)); err != nil {
+			s.logger.Error("Failed to watch the configuration file", "path", s.configPath, "error", err)
+			_ = w.Close()
+		} else {
+			watcher = w
+			fileEvents = w.Events
+			fileErrors = w.Errors
+		}
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if watcher != nil {
+			defer func() { _ = watcher.Close() }()
+		}
+
+		name := filepath.Base(s.configPath)
+		debounce := time.NewTimer(time.Hour)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				_, _ = s.Reload("SIGHUP")
+			case ev := <-fileEvents:
+				// `..data` is the symlink swapped by Kubernetes when
+				// a mounted ConfigMap changes.
+				base := filepath.Base(ev.Name)
+				if base != name && base != "..data" {
+					continue
+				}
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				debounce.Reset(reloadDebounce)
+			case err := <-fileErrors:
+				s.logger.Warn("Error watching the configuration file", "path", s.configPath, "error", err)
+			case <-debounce.C:
+				_, _ = s.Reload("config file change")
+			}
+		}
+	}()
+}
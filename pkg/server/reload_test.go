@@ -0,0 +1,70 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	base := Config{Listen: ":8080", LogLevel: "debug", Username: "admin", Password: "secret"}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []ConfigChange
+	}{
+		{name: "unchanged", change: func(c *Config) {}},
+		{
+			name:   "reloadable",
+			change: func(c *Config) { c.LogLevel = "info" },
+			want:   []ConfigChange{{Setting: "log_level", Old: "debug", New: "info"}},
+		},
+		{
+			name:   "pending restart",
+			change: func(c *Config) { c.Listen = ":9090" },
+			want:   []ConfigChange{{Setting: "listen", Old: ":8080", New: ":9090", Pending: true}},
+		},
+		{
+			name:   "password redacted",
+			change: func(c *Config) { c.Password = "other" },
+			want:   []ConfigChange{{Setting: "password", Old: redacted, New: redacted}},
+		},
+		{
+			name:   "password removed",
+			change: func(c *Config) { c.Password = "" },
+			want:   []ConfigChange{{Setting: "password", Old: redacted, New: ""}},
+		},
+		{
+			name:   "version ignored",
+			change: func(c *Config) { c.Version = "1.2.3" },
+		},
+		{
+			name: "several in field order",
+			change: func(c *Config) {
+				c.Username = "root"
+				c.Listen = ":9090"
+			},
+			want: []ConfigChange{
+				{Setting: "listen", Old: ":8080", New: ":9090", Pending: true},
+				{Setting: "username", Old: "admin", New: "root"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		c := base
+		tt.change(&c)
+		if got := diffConfigs(base, c); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: diffConfigs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWithRestartSettings(t *testing.T) {
+	running := Config{Listen: ":8080", LogLevel: "debug", Scenario: "a.yaml"}
+	loaded := Config{Listen: ":9090", LogLevel: "info", Scenario: "b.yaml"}
+
+	want := Config{Listen: ":8080", LogLevel: "info", Scenario: "a.yaml"}
+	if got := withRestartSettings(loaded, running); got != want {
+		t.Errorf("withRestartSettings() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResourceLeakCount is the maximum number of resources leaked by a
+// request, or at every interval of a rate.
+const maxResourceLeakCount = 1_000_000
+
+// threadMargin is the number of OS threads kept below the limit of the Go
+// runtime when leaking threads, for the threads the runtime needs itself.
+const threadMargin = 100
+
+// resourceLeaker leaks one kind of resource (goroutines, file descriptors or
+// OS threads), at once or at a rate, until released.
+type resourceLeaker struct {
+	// kind is the kind of the leaked resources, like `goroutines`.
+	kind string
+	// leakOne leaks one resource, which is released when `release` is
+	// closed or by calling the returned function (if not nil).
+	leakOne func(release <-chan struct{}) (func(), error)
+	// current returns the number of resources of this kind used by the
+	// process.
+	current func() (int, error)
+	// available returns how many more resources can be leaked, nil if
+	// not limited.
+	available func() int
+
+	mu       sync.Mutex
+	release  chan struct{}
+	closers  []func()
+	leaked   int
+	err      string
+	running  bool
+	step     int
+	interval time.Duration
+	ceiling  int
+	started  time.Time
+	user     string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// resourceLeaks are the resource leakers of `/_/leak/goroutines`,
+// `/_/leak/fds` and `/_/leak/threads`.
+type resourceLeaks struct {
+	goroutines, fds, threads *resourceLeaker
+}
+
+// newResourceLeaks returns the resource leakers.
+func newResourceLeaks() resourceLeaks {
+	return resourceLeaks{
+		goroutines: &resourceLeaker{kind: "goroutines", leakOne: leakGoroutine, current: goroutines},
+		fds:        &resourceLeaker{kind: "file descriptors", leakOne: leakFD, current: openFDs},
+		threads: &resourceLeaker{kind: "threads", leakOne: leakThread, current: osThreads,
+			available: threadsAvailable},
+	}
+}
+
+// leakGoroutine leaks a goroutine blocked until `release` is closed.
+func leakGoroutine(release <-chan struct{}) (func(), error) {
+	go func() { <-release }()
+
+	return nil, nil
+}
+
+// leakFD leaks an open file descriptor (of the null device).
+func leakFD(<-chan struct{}) (func(), error) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { _ = f.Close() }, nil
+}
+
+// leakThread leaks an OS thread, held by a goroutine locked to it until
+// `release` is closed. The goroutine exits while still locked, which
+// terminates the thread.
+func leakThread(release <-chan struct{}) (func(), error) {
+	locked := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		close(locked)
+		<-release
+	}()
+	<-locked
+
+	return nil, nil
+}
+
+// maxThreads returns the limit of the number of OS threads of the Go runtime
+// (10000 by default), beyond which the process crashes. Read once, as
+// reading it requires setting it (raising it in the meantime), which stops
+// the world.
+var maxThreads = sync.OnceValue(func() int {
+	n := debug.SetMaxThreads(math.MaxInt32)
+	debug.SetMaxThreads(n)
+
+	return n
+})
+
+// threadsAvailable returns how many more OS threads can be leaked, keeping
+// a margin below the limit of the Go runtime.
+func threadsAvailable() int {
+	n, err := osThreads()
+	if err != nil {
+		// The threads created so far (an upper bound) if not reported by
+		// the OS.
+		n = pprof.Lookup("threadcreate").Count()
+	}
+
+	return max(maxThreads()-n-threadMargin, 0)
+}
+
+// goroutines returns the number of goroutines of the process.
+func goroutines() (int, error) {
+	sample := []metrics.Sample{{Name: "/sched/goroutines:goroutines"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0, errors.New("number of goroutines not supported by the Go runtime")
+	}
+
+	return int(sample[0].Value.Uint64()), nil
+}
+
+// openFDs returns the number of open file descriptors of the process, as
+// reported by Linux.
+func openFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the open file descriptors: %w", err)
+	}
+
+	// Not counting the descriptor used to read the directory.
+	return len(entries) - 1, nil
+}
+
+// osThreads returns the number of OS threads of the process, as reported by
+// Linux.
+func osThreads() (int, error) {
+	v, err := procStatusField("Threads")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(v)
+}
+
+// fdLimit returns the (soft) limit of the number of open file descriptors of
+// the process, as reported by Linux.
+func fdLimit() (string, error) {
+	b, err := os.ReadFile("/proc/self/limits")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the process limits: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "Max open files"); ok {
+			if fields := strings.Fields(v); len(fields) > 0 {
+				return fields[0], nil
+			}
+		}
+	}
+
+	return "", errors.New("limit of the open files not found")
+}
+
+// procStatusField returns the value of the field `name` of the status of the
+// process, as reported by Linux.
+func procStatusField(name string) (string, error) {
+	b, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the process status: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, name+":"); ok {
+			return strings.TrimSpace(v), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: field not found in the process status", name)
+}
+
+// leakN leaks `n` resources, stopping at the first error or when no more can
+// be leaked. Returns the number of resources leaked.
+func (rl *resourceLeaker) leakN(n int) (int, error) {
+	// Read once, counting down locally.
+	avail := -1
+	if rl.available != nil {
+		avail = rl.available()
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.release == nil {
+		rl.release = make(chan struct{})
+	}
+	for i := range n {
+		if avail == 0 {
+			err := fmt.Errorf("leaking more %s would reach their limit, which crashes the process", rl.kind)
+			rl.err = err.Error()
+			return i, err
+		}
+		closer, err := rl.leakOne(rl.release)
+		if err != nil {
+			rl.err = err.Error()
+			return i, err
+		}
+		if closer != nil {
+			rl.closers = append(rl.closers, closer)
+		}
+		rl.leaked++
+		if avail > 0 {
+			avail--
+		}
+	}
+
+	return n, nil
+}
+
+// errResourceLeakRunning is returned when starting a leak at a rate while one
+// is in progress.
+var errResourceLeakRunning = errors.New("a leak is already in progress, release it first")
+
+// start starts leaking `step` resources every `interval` up to `ceiling` in
+// total (0 means forever).
+func (rl *resourceLeaker) start(step int, interval time.Duration, ceiling int, user string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.running {
+		return errResourceLeakRunning
+	}
+	rl.running = true
+	rl.step, rl.interval, rl.ceiling = step, interval, ceiling
+	rl.started = time.Now()
+	rl.user = user
+	rl.err = ""
+	rl.stop = make(chan struct{})
+	rl.done = make(chan struct{})
+
+	go rl.run(rl.stop, rl.done)
+
+	return nil
+}
+
+// run leaks resources until stopped, the ceiling is reached or leaking fails.
+func (rl *resourceLeaker) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+	for {
+		rl.mu.Lock()
+		step := rl.step
+		if rl.ceiling > 0 {
+			step = min(step, rl.ceiling-min(rl.leaked, rl.ceiling))
+		}
+		rl.mu.Unlock()
+		if step == 0 {
+			break
+		}
+		if _, err := rl.leakN(step); err != nil {
+			break
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	rl.mu.Lock()
+	rl.running = false
+	rl.mu.Unlock()
+}
+
+// releaseAll stops leaking (if in progress) and releases all the leaked
+// resources. Returns the number of resources released.
+func (rl *resourceLeaker) releaseAll() int {
+	rl.mu.Lock()
+	if rl.running {
+		close(rl.stop)
+		done := rl.done
+		rl.mu.Unlock()
+		<-done
+		rl.mu.Lock()
+		rl.running = false
+	}
+	defer rl.mu.Unlock()
+
+	n := rl.leaked
+	if rl.release != nil {
+		close(rl.release)
+		rl.release = nil
+	}
+	for _, closer := range rl.closers {
+		closer()
+	}
+	rl.closers, rl.leaked, rl.err = nil, 0, ""
+
+	return n
+}
+
+// resourceLeakStatus is the state of a resource leak.
+type resourceLeakStatus struct {
+	Kind     string `json:"kind"`
+	Leaked   int    `json:"leaked"`
+	Current  int    `json:"current"`
+	Running  bool   `json:"running"`
+	Step     int    `json:"step,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Ceiling  int    `json:"ceiling,omitempty"`
+	Started  string `json:"started,omitempty"`
+	User     string `json:"user,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// status returns the state of the leak.
+func (rl *resourceLeaker) status() resourceLeakStatus {
+	rl.mu.Lock()
+	rs := resourceLeakStatus{Kind: rl.kind, Leaked: rl.leaked, Running: rl.running, Error: rl.err}
+	if rl.running {
+		rs.Step = rl.step
+		rs.Interval = rl.interval.String()
+		rs.Ceiling = rl.ceiling
+		rs.Started = rl.started.Format(time.RFC3339)
+		rs.User = rl.user
+	}
+	rl.mu.Unlock()
+
+	rs.Current = -1
+	if n, err := rl.current(); err == nil {
+		rs.Current = n
+	}
+
+	return rs
+}
+
+// String describes the state of the leak, on one line.
+func (rs resourceLeakStatus) String() string {
+	s := fmt.Sprintf("%d %s leaked", rs.Leaked, rs.Kind)
+	if rs.Current >= 0 {
+		s += fmt.Sprintf(" (%d used by the process)", rs.Current)
+	}
+	if rs.Running {
+		s += fmt.Sprintf(", leaking %d every %s", rs.Step, rs.Interval)
+		if rs.Ceiling > 0 {
+			s += fmt.Sprintf(" up to %d", rs.Ceiling)
+		}
+		s += fmt.Sprintf(" (started %s by %s)", rs.Started, rs.User)
+	}
+	if len(rs.Error) > 0 {
+		s += fmt.Sprintf(", last error: %s", rs.Error)
+	}
+
+	return s
+}
+
+// parseCountRate parses a rate like `100/s`, `10/1m` or `5/100ms`.
+func parseCountRate(s string) (int, time.Duration, error) {
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: invalid rate (expected count/interval like 100/s)", s)
+	}
+	step, err := strconv.Atoi(count)
+	if err != nil || step < 1 || step > maxResourceLeakCount {
+		return 0, 0, fmt.Errorf("%s: invalid rate count (1 to %d)", s, maxResourceLeakCount)
+	}
+	// `100/s` means `100/1s`.
+	if len(per) > 0 && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	interval, err := time.ParseDuration(per)
+	if err != nil || interval < 10*time.Millisecond {
+		return 0, 0, fmt.Errorf("%s: invalid rate interval (at least 10ms)", s)
+	}
+
+	return step, interval, nil
+}
+
+// writeResourceLeakStatus writes the state of a resource leak, as JSON if the
+// client accepts it and otherwise as text.
+func writeResourceLeakStatus(w http.ResponseWriter, r *http.Request, status int, rs resourceLeakStatus) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(rs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "Leak: %s\n", rs)
+}
+
+// resourceLeakHandler is an HTTP handler that is used on the
+// `/_/leak/goroutines`, `/_/leak/fds` and `/_/leak/threads` paths: `POST`
+// leaks `count` resources at once, or starts leaking at the `rate` query
+// param (like `100/s`) up to the optional `max` total. `GET` returns the
+// number of leaked resources and of the ones used by the process, and
+// `DELETE` stops leaking and releases the leaked resources.
+func resourceLeakHandler(rl *resourceLeaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeResourceLeakStatus(w, r, http.StatusOK, rl.status())
+			return
+		case http.MethodDelete:
+			n := rl.releaseAll()
+			reqLogger.Info("Leaked resources released", "kind", rl.kind, "released", n)
+			writeResourceLeakStatus(w, r, http.StatusOK, rl.status())
+			return
+		}
+
+		count, rate := query.Get("count"), query.Get("rate")
+		if (len(count) > 0) == (len(rate) > 0) {
+			http.Error(w, "either the count or the rate must be set", http.StatusBadRequest)
+			return
+		}
+
+		if len(count) > 0 {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 || n > maxResourceLeakCount {
+				http.Error(w, fmt.Sprintf("%s: invalid count (1 to %d)", count, maxResourceLeakCount),
+					http.StatusBadRequest)
+				return
+			}
+			if rl.available != nil {
+				if avail := rl.available(); n > avail {
+					http.Error(w, fmt.Sprintf("%d: count above the %d %s which can still be leaked", n,
+						avail, rl.kind), http.StatusBadRequest)
+					return
+				}
+			}
+			leaked, err := rl.leakN(n)
+			reqLogger.Warn("Resources leaked", "kind", rl.kind, "count", n, "leaked", leaked, "error", err)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("leaked %d of %d %s: %v", leaked, n, rl.kind, err),
+					http.StatusInternalServerError)
+				return
+			}
+			writeResourceLeakStatus(w, r, http.StatusCreated, rl.status())
+			return
+		}
+
+		step, interval, err := parseCountRate(rate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ceiling int
+		if v := query.Get("max"); len(v) > 0 {
+			if ceiling, err = strconv.Atoi(v); err != nil || ceiling < 0 {
+				http.Error(w, fmt.Sprintf("%s: invalid max", v), http.StatusBadRequest)
+				return
+			}
+		}
+		// The limited resources stop at what can still be leaked.
+		if rl.available != nil {
+			avail := rl.available()
+			if step > avail {
+				http.Error(w, fmt.Sprintf("%d: rate count above the %d %s which can still be leaked", step,
+					avail, rl.kind), http.StatusBadRequest)
+				return
+			}
+			if limit := rl.status().Leaked + avail; ceiling == 0 || ceiling > limit {
+				ceiling = limit
+			}
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+
+		if err := rl.start(step, interval, ceiling, user); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		reqLogger.Warn("Resource leak started", "kind", rl.kind, "step", step, "interval", interval,
+			"ceiling", ceiling)
+		writeResourceLeakStatus(w, r, http.StatusAccepted, rl.status())
+	})
+}
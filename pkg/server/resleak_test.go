@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCountRate(t *testing.T) {
+	tests := []struct {
+		in       string
+		count    int
+		interval time.Duration
+		wantErr  bool
+	}{
+		{in: "100/s", count: 100, interval: time.Second},
+		{in: "10/1m", count: 10, interval: time.Minute},
+		{in: "5/100ms", count: 5, interval: 100 * time.Millisecond},
+		{in: "1000000/h", count: maxResourceLeakCount, interval: time.Hour},
+		{in: "100", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "-1/s", wantErr: true},
+		{in: "1000001/s", wantErr: true},
+		{in: "1.5/s", wantErr: true},
+		{in: "10/1ms", wantErr: true},
+		{in: "10/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		count, interval, err := parseCountRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCountRate(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if count != tt.count || interval != tt.interval {
+			t.Errorf("parseCountRate(%q) = %d, %s, want %d, %s", tt.in, count, interval, tt.count, tt.interval)
+		}
+	}
+}
+
+func TestLeakNAvailable(t *testing.T) {
+	var calls int
+	rl := &resourceLeaker{
+		kind:      "things",
+		leakOne:   func(<-chan struct{}) (func(), error) { return nil, nil },
+		available: func() int { calls++; return 3 },
+	}
+
+	leaked, err := rl.leakN(5)
+	if err == nil || leaked != 3 {
+		t.Errorf("leakN(5) = %d, %v, want 3 and an error", leaked, err)
+	}
+	if calls != 1 {
+		t.Errorf("available called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// defaultRuntimeMetrics are the runtime metrics displayed by `/_/stats`
+// without the `metric` query param.
+var defaultRuntimeMetrics = []string{
+	"/sched/gomaxprocs:threads",
+	"/sched/goroutines:goroutines",
+	"/cpu/classes/user:cpu-seconds",
+	"/memory/classes/total:bytes",
+	"/sched/pauses/total/gc:seconds",
+	"/sched/latencies:seconds",
+}
+
+// histogramPercentiles are the percentiles reported for the histogram
+// metrics.
+var histogramPercentiles = []float64{0.5, 0.9, 0.99}
+
+// runtimeCatalog is the description of the metrics supported by the Go
+// runtime, see https://pkg.go.dev/runtime/metrics#hdr-Supported_metrics.
+type runtimeCatalog struct {
+	// all is sorted by name.
+	all    []metrics.Description
+	byName map[string]metrics.Description
+}
+
+// runtimeMetrics returns the catalog of the runtime metrics, which is read
+// only once.
+var runtimeMetrics = sync.OnceValue(func() runtimeCatalog {
+	all := metrics.All()
+	slices.SortFunc(all, func(a, b metrics.Description) int { return strings.Compare(a.Name, b.Name) })
+	c := runtimeCatalog{all: all, byName: make(map[string]metrics.Description, len(all))}
+	for _, d := range all {
+		c.byName[d.Name] = d
+	}
+
+	return c
+})
+
+// selectRuntimeMetrics returns the names of the runtime metrics selected by
+// `filters`: a metric name, a prefix (like `/gc/`) or `all`. The filters
+// matching no metric are returned as `unknown`.
+func selectRuntimeMetrics(filters []string) (names, unknown []string) {
+	c := runtimeMetrics()
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, f := range filters {
+		if _, ok := c.byName[f]; ok {
+			add(f)
+			continue
+		}
+		found := false
+		for _, d := range c.all {
+			if f == "all" || strings.HasPrefix(d.Name, f) {
+				add(d.Name)
+				found = true
+			}
+		}
+		if !found {
+			unknown = append(unknown, f)
+		}
+	}
+
+	return names, unknown
+}
+
+// getRuntimeStat will retrive one of the supported runtime metrics (see
+// https://pkg.go.dev/runtime/metrics#hdr-Supported_metrics). Histograms are
+// summarized by their percentiles.
+func getRuntimeStat(name string) (string, error) {
+	if _, ok := runtimeMetrics().byName[name]; !ok {
+		return "", fmt.Errorf("%s: metric not supported by this Go runtime", name)
+	}
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+
+	return formatRuntimeSample(sample[0])
+}
+
+// formatRuntimeSample formats the value of a runtime metric.
+func formatRuntimeSample(s metrics.Sample) (string, error) {
+	switch s.Value.Kind() {
+	case metrics.KindUint64:
+		return fmt.Sprintf("%d", s.Value.Uint64()), nil
+	case metrics.KindFloat64:
+		return fmt.Sprintf("%f", s.Value.Float64()), nil
+	case metrics.KindFloat64Histogram:
+		_, unit, _ := strings.Cut(s.Name, ":")
+		return formatHistogram(s.Value.Float64Histogram(), unit), nil
+	case metrics.KindBad:
+		return "", fmt.Errorf("%s: metric no longer supported", s.Name)
+	default:
+		return "", fmt.Errorf("%s: unexpected metric Kind: %v", s.Name, s.Value.Kind())
+	}
+}
+
+// formatHistogram summarizes a histogram with its count, percentiles and
+// maximum. The values are the upper bounds of the buckets (the lower bound
+// for the last, unbounded, bucket).
+func formatHistogram(h *metrics.Float64Histogram, unit string) string {
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "count=%d", count)
+	if count == 0 {
+		return b.String()
+	}
+
+	bound := func(i int) float64 {
+		if math.IsInf(h.Buckets[i+1], 1) {
+			return h.Buckets[i]
+		}
+		return h.Buckets[i+1]
+	}
+	for _, p := range histogramPercentiles {
+		target := uint64(math.Ceil(p * float64(count)))
+		var cum uint64
+		for i, c := range h.Counts {
+			cum += c
+			if cum >= target {
+				_, _ = fmt.Fprintf(&b, " p%g=%s", p*100, formatUnit(bound(i), unit))
+				break
+			}
+		}
+	}
+	for i := len(h.Counts) - 1; i >= 0; i-- {
+		if h.Counts[i] > 0 {
+			_, _ = fmt.Fprintf(&b, " max=%s", formatUnit(bound(i), unit))
+			break
+		}
+	}
+
+	return b.String()
+}
+
+// formatUnit formats a value of a histogram according to the `unit` of the
+// metric.
+func formatUnit(v float64, unit string) string {
+	switch unit {
+	case "seconds":
+		return time.Duration(v * float64(time.Second)).String()
+	case "bytes":
+		return humanize.Bytes(uint64(v))
+	default:
+		return fmt.Sprintf("%g", v)
+	}
+}
+
+// writeRuntimeStats writes the runtime metrics `names` (read together) and
+// reports the metrics which aren't supported inline.
+func writeRuntimeStats(w io.Writer, names []string) {
+	c := runtimeMetrics()
+	samples := make([]metrics.Sample, 0, len(names))
+	for _, name := range names {
+		if _, ok := c.byName[name]; ok {
+			samples = append(samples, metrics.Sample{Name: name})
+		}
+	}
+	metrics.Read(samples)
+
+	for _, name := range names {
+		i := slices.IndexFunc(samples, func(s metrics.Sample) bool { return s.Name == name })
+		if i < 0 {
+			_, _ = fmt.Fprintf(w, "\t%s = unsupported (not supported by this Go runtime)\n", name)
+			continue
+		}
+		val, err := formatRuntimeSample(samples[i])
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "\t%s = unsupported (%v)\n", name, err)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "\t%s = %s\n", name, val)
+	}
+}
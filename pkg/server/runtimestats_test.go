@@ -0,0 +1,93 @@
+package server
+
+import (
+	"math"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFormatHistogram(t *testing.T) {
+	tests := []struct {
+		name string
+		h    metrics.Float64Histogram
+		unit string
+		want string
+	}{
+		{
+			name: "empty",
+			h:    metrics.Float64Histogram{Counts: []uint64{0, 0}, Buckets: []float64{0, 1, 2}},
+			unit: "seconds",
+			want: "count=0",
+		},
+		{
+			name: "seconds",
+			h: metrics.Float64Histogram{
+				Counts:  []uint64{50, 40, 9, 1},
+				Buckets: []float64{0, 0.001, 0.01, 0.1, 1},
+			},
+			unit: "seconds",
+			want: "count=100 p50=1ms p90=10ms p99=100ms max=1s",
+		},
+		{
+			name: "unbounded last bucket",
+			h: metrics.Float64Histogram{
+				Counts:  []uint64{1, 0, 3},
+				Buckets: []float64{math.Inf(-1), 1024, 4096, math.Inf(1)},
+			},
+			unit: "bytes",
+			want: "count=4 p50=4.1 kB p90=4.1 kB p99=4.1 kB max=4.1 kB",
+		},
+		{
+			name: "other unit",
+			h: metrics.Float64Histogram{
+				Counts:  []uint64{10, 0, 0},
+				Buckets: []float64{0, 8, 16, 32},
+			},
+			unit: "objects",
+			want: "count=10 p50=8 p90=8 p99=8 max=8",
+		},
+	}
+	for _, tt := range tests {
+		if got := formatHistogram(&tt.h, tt.unit); got != tt.want {
+			t.Errorf("%s: formatHistogram() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectRuntimeMetrics(t *testing.T) {
+	names, unknown := selectRuntimeMetrics([]string{
+		"/sched/goroutines:goroutines", "/gc/heap/", "/sched/goroutines:goroutines", "/nothing/",
+	})
+	if names[0] != "/sched/goroutines:goroutines" || len(names) < 2 {
+		t.Errorf("names = %q, want the goroutines then the /gc/heap/ metrics", names)
+	}
+	for _, n := range names[1:] {
+		if !strings.HasPrefix(n, "/gc/heap/") {
+			t.Errorf("unexpected metric %s", n)
+		}
+	}
+	if !slices.Equal(unknown, []string{"/nothing/"}) {
+		t.Errorf("unknown = %q, want [/nothing/]", unknown)
+	}
+
+	all, unknown := selectRuntimeMetrics([]string{"all"})
+	if len(all) != len(metrics.All()) || len(unknown) > 0 {
+		t.Errorf("all: %d metrics (unknown %q), want %d", len(all), unknown, len(metrics.All()))
+	}
+}
+
+func TestWriteRuntimeStats(t *testing.T) {
+	var b strings.Builder
+	writeRuntimeStats(&b, []string{"/sched/goroutines:goroutines", "/sched/latencies:seconds", "/not/a:metric"})
+	for _, want := range []string{
+		"\t/sched/goroutines:goroutines = ",
+		"\t/sched/latencies:seconds = count=",
+		"\t/not/a:metric = unsupported (not supported by this Go runtime)\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+}
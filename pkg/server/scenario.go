@@ -0,0 +1,544 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+// scenarioMaxBody is the maximum size of a scenario posted to `/_/scenario`.
+const scenarioMaxBody = 1 << 20
+
+// scenarioEndpoint is an endpoint called by a scenario action.
+type scenarioEndpoint struct {
+	method string
+	path   string
+	// query is added to the arguments of the step.
+	query url.Values
+}
+
+// scenarioActions are the scenario actions calling an endpoint, with the
+// arguments of the step as the query params. The `bwlimit`, `log` and
+// `request` actions are handled separately.
+var scenarioActions = map[string]scenarioEndpoint{
+	"alloc":        {http.MethodPost, "/_/alloc", nil},
+	"free":         {http.MethodDelete, "/_/alloc", url.Values{"all": {"true"}}},
+	"leak":         {http.MethodPost, "/_/leak", nil},
+	"leak_stop":    {http.MethodDelete, "/_/leak", nil},
+	"cpu":          {http.MethodPost, "/_/cpu", nil},
+	"cpu_stop":     {http.MethodDelete, "/_/cpu", url.Values{"all": {"true"}}},
+	"disk":         {http.MethodPost, "/_/disk", nil},
+	"disk_cleanup": {http.MethodDelete, "/_/disk", url.Values{"cleanup": {"true"}}},
+	"chaos":        {http.MethodPost, "/_/chaos", nil},
+	"chaos_clear":  {http.MethodDelete, "/_/chaos", url.Values{"all": {"true"}}},
+	"crash":        {http.MethodDelete, "/_/crash", url.Values{"areYouSure": {"YesIAmSure"}}},
+	"reload":       {http.MethodPost, "/_/reload", nil},
+}
+
+// scenarioStep is a step of a scenario: the `action` run with `args` at the
+// `at` offset from the start of the scenario.
+type scenarioStep struct {
+	At     time.Duration     `yaml:"-" json:"-"`
+	AtStr  string            `yaml:"at" json:"at"`
+	Action string            `yaml:"action" json:"action"`
+	Args   map[string]string `yaml:"-" json:"args,omitempty"`
+	// RawArgs are the arguments as decoded, see Args.
+	RawArgs map[string]any `yaml:"args" json:"-"`
+}
+
+// String describes the step on one line.
+func (st scenarioStep) String() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "t+%s %s", st.At, st.Action)
+	for _, k := range slices.Sorted(maps.Keys(st.Args)) {
+		_, _ = fmt.Fprintf(&b, " %s=%s", k, st.Args[k])
+	}
+
+	return b.String()
+}
+
+// scenario is a timeline of fault injection steps.
+type scenario struct {
+	Name  string         `yaml:"name" json:"name"`
+	Steps []scenarioStep `yaml:"steps" json:"steps"`
+}
+
+// parseScenario parses a scenario in YAML (or JSON) and checks its steps,
+// which are sorted by their offset.
+func parseScenario(data []byte) (*scenario, error) {
+	var sc scenario
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&sc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("empty scenario")
+		}
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("scenario without steps")
+	}
+	if len(sc.Name) == 0 {
+		sc.Name = "unnamed"
+	}
+
+	var errs []error
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		at, err := time.ParseDuration(strings.TrimPrefix(strings.TrimSpace(st.AtStr), "t+"))
+		if err != nil || at < 0 {
+			errs = append(errs, fmt.Errorf("step %d: %s: invalid offset (like 60s or t+60s)", i+1, st.AtStr))
+		}
+		st.At = at
+		st.Args = make(map[string]string, len(st.RawArgs))
+		for k, v := range st.RawArgs {
+			st.Args[k] = fmt.Sprint(v)
+		}
+		switch st.Action {
+		case "bwlimit":
+			if _, err := parseBwLimit(st.Args["limit"]); err != nil || len(st.Args["limit"]) == 0 {
+				errs = append(errs, fmt.Errorf("step %d: %s: invalid bandwidth limit", i+1, st.Args["limit"]))
+			}
+		case "log":
+		case "request":
+			if len(st.Args["method"]) == 0 || !strings.HasPrefix(st.Args["path"], "/_/") {
+				errs = append(errs, fmt.Errorf("step %d: the request action requires a method and a /_/ path", i+1))
+			}
+		default:
+			if _, ok := scenarioActions[st.Action]; !ok {
+				errs = append(errs, fmt.Errorf("step %d: %s: unknown action", i+1, st.Action))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	slices.SortStableFunc(sc.Steps, func(a, b scenarioStep) int { return cmp.Compare(a.At, b.At) })
+
+	return &sc, nil
+}
+
+// loadScenario reads the scenario of the `scenario` setting: inline YAML or
+// JSON (if it starts with `{` or has several lines) or else a file.
+func loadScenario(setting string) (*scenario, error) {
+	data := []byte(setting)
+	if s := strings.TrimSpace(setting); !strings.HasPrefix(s, "{") && !strings.Contains(s, "\n") {
+		var err error
+		if data, err = os.ReadFile(s); err != nil {
+			return nil, fmt.Errorf("failed to read scenario file: %w", err)
+		}
+	}
+
+	return parseScenario(data)
+}
+
+// stepResult is the result of a scenario step which was run.
+type stepResult struct {
+	Step   int       `json:"step"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`
+	Result string    `json:"result"`
+}
+
+// scenarioRun is a run of a scenario.
+type scenarioRun struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	State   string         `json:"state"`
+	Started time.Time      `json:"started"`
+	User    string         `json:"user"`
+	Elapsed string         `json:"elapsed"`
+	Steps   []scenarioStep `json:"steps"`
+	Results []stepResult   `json:"results"`
+
+	// elapsed is the time spent running (not paused) until `resumed`.
+	elapsed time.Duration
+	resumed time.Time
+	// changed is signalled when the run is paused, resumed or aborted.
+	changed chan struct{}
+}
+
+// elapsedNow returns the time spent running (not paused).
+func (sr *scenarioRun) elapsedNow() time.Duration {
+	if sr.State != "running" {
+		return sr.elapsed
+	}
+
+	return sr.elapsed + time.Since(sr.resumed)
+}
+
+// signal wakes up the goroutine running the scenario.
+func (sr *scenarioRun) signal() {
+	select {
+	case sr.changed <- struct{}{}:
+	default:
+	}
+}
+
+// stepExecutor runs a scenario step, returning an HTTP status code and a
+// one line result.
+type stepExecutor func(logger *slog.Logger, st scenarioStep) (int, string)
+
+// scenarioManager runs one scenario at a time, see scenarioHandler. The
+// last run is kept for its status.
+type scenarioManager struct {
+	mu     sync.Mutex
+	nextID int
+	run    *scenarioRun
+}
+
+// status returns a copy of the last run, nil if none.
+func (sm *scenarioManager) status() *scenarioRun {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.run == nil {
+		return nil
+	}
+	sr := *sm.run
+	sr.Elapsed = sm.run.elapsedNow().Round(time.Millisecond).String()
+	sr.Results = slices.Clone(sm.run.Results)
+
+	return &sr
+}
+
+// start runs `sc` in the background with `exec`, unless a scenario is
+// already running (or paused).
+func (sm *scenarioManager) start(logger *slog.Logger, sc *scenario, user string, exec stepExecutor) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.run != nil && (sm.run.State == "running" || sm.run.State == "paused") {
+		return fmt.Errorf("scenario %s (%s) already %s", sm.run.ID, sm.run.Name, sm.run.State)
+	}
+	sm.nextID++
+	now := time.Now()
+	sr := &scenarioRun{
+		ID:      strconv.Itoa(sm.nextID),
+		Name:    sc.Name,
+		State:   "running",
+		Started: now,
+		User:    user,
+		Steps:   sc.Steps,
+		resumed: now,
+		changed: make(chan struct{}, 1),
+	}
+	sm.run = sr
+	logger = logger.With("scenario", sr.Name, "scenario_id", sr.ID)
+	logger.Warn("Scenario started", "steps", len(sr.Steps), "user", user)
+	go sm.runSteps(logger, sr, exec)
+
+	return nil
+}
+
+// runSteps runs the steps of `sr` at their offsets, until they are all done
+// or the run is aborted.
+func (sm *scenarioManager) runSteps(logger *slog.Logger, sr *scenarioRun, exec stepExecutor) {
+	for i, st := range sr.Steps {
+		for {
+			sm.mu.Lock()
+			state, wait := sr.State, st.At-sr.elapsedNow()
+			sm.mu.Unlock()
+			if state == "aborted" {
+				return
+			}
+			if state == "running" && wait <= 0 {
+				break
+			}
+			// While paused only wait to be resumed (or aborted).
+			var timer <-chan time.Time
+			if state == "running" {
+				timer = time.After(wait)
+			}
+			select {
+			case <-timer:
+			case <-sr.changed:
+			}
+		}
+
+		stepLogger := logger.With("step", i+1, "at", st.At, "action", st.Action)
+		stepLogger.Info("Scenario step started", "args", st.Args)
+		status, result := exec(stepLogger, st)
+		level := slog.LevelInfo
+		if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		stepLogger.Log(context.Background(), level, "Scenario step done", "status", status, "result", result)
+
+		sm.mu.Lock()
+		sr.Results = append(sr.Results, stepResult{Step: i + 1, Action: st.Action, Time: time.Now(),
+			Status: status, Result: result})
+		sm.mu.Unlock()
+	}
+
+	sm.mu.Lock()
+	if sr.State == "running" {
+		sr.elapsed = sr.elapsedNow()
+		sr.State = "done"
+	}
+	sm.mu.Unlock()
+	logger.Info("Scenario done")
+}
+
+// control pauses, resumes or aborts the running scenario.
+func (sm *scenarioManager) control(action string) (*scenarioRun, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sr := sm.run
+	if sr == nil || (sr.State != "running" && sr.State != "paused") {
+		return nil, errNoScenario
+	}
+	switch action {
+	case "pause":
+		if sr.State == "running" {
+			sr.elapsed = sr.elapsedNow()
+			sr.State = "paused"
+		}
+	case "resume":
+		if sr.State == "paused" {
+			sr.resumed = time.Now()
+			sr.State = "running"
+		}
+	case "abort":
+		sr.elapsed = sr.elapsedNow()
+		sr.State = "aborted"
+	default:
+		return nil, fmt.Errorf("%s: invalid action (expected pause or resume)", action)
+	}
+	sr.signal()
+
+	return sr, nil
+}
+
+// halt aborts the running scenario, if any.
+func (sm *scenarioManager) halt() {
+	_, _ = sm.control("abort")
+}
+
+// errNoScenario is returned when no scenario is running.
+var errNoScenario = errors.New("no scenario running")
+
+// stepRecorder is an http.ResponseWriter which keeps the status code and the
+// first line of the body of a response.
+type stepRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *stepRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *stepRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *stepRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	// Only the beginning of the body is needed.
+	if rec.body.Len() < 1024 {
+		rec.body.Write(b[:min(len(b), 1024-rec.body.Len())])
+	}
+
+	return len(b), nil
+}
+
+// result returns the first line of the body.
+func (rec *stepRecorder) result() string {
+	line, _, _ := strings.Cut(strings.TrimSpace(rec.body.String()), "\n")
+
+	return strings.TrimSpace(line)
+}
+
+// execScenarioStep runs a scenario step, calling the built-in endpoints
+// directly (without authentication) as the `scenario` user.
+func (s *Server) execScenarioStep(logger *slog.Logger, st scenarioStep) (int, string) {
+	query := url.Values{}
+	for k, v := range st.Args {
+		query.Set(k, v)
+	}
+
+	var ep scenarioEndpoint
+	switch st.Action {
+	case "log":
+		logger.Warn("Scenario message", "message", st.Args["message"])
+		return http.StatusOK, st.Args["message"]
+	case "bwlimit":
+		limit, err := parseBwLimit(st.Args["limit"])
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		// Listeners with their own bandwidth limit keep it.
+		for _, l := range s.listeners {
+			if !l.spec.hasBwLimit {
+				l.setLimit(limit)
+			}
+		}
+		return http.StatusOK, fmt.Sprintf("Bandwidth limit set to %s", humanize.Bytes(uint64(limit)))
+	case "request":
+		ep = scenarioEndpoint{method: strings.ToUpper(st.Args["method"]), path: st.Args["path"]}
+		query.Del("method")
+		query.Del("path")
+	default:
+		ep = scenarioActions[st.Action]
+		for k, v := range ep.query {
+			query[k] = v
+		}
+	}
+
+	h, ok := s.builtins[ep.path]
+	if !ok {
+		return http.StatusNotFound, fmt.Sprintf("%s: unknown endpoint", ep.path)
+	}
+	ctx := context.WithValue(context.Background(), loggerKey, logger)
+	ctx = context.WithValue(ctx, userKey, "scenario")
+	r, err := http.NewRequestWithContext(ctx, ep.method, ep.path+"?"+query.Encode(), http.NoBody)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	rec := &stepRecorder{header: http.Header{}}
+	if msg, panicked := serveStep(h, rec, r); panicked {
+		logger.Error("Scenario step panic", "action", st.Action, "path", ep.path, "panic", msg)
+		return http.StatusInternalServerError, "panic: " + msg
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	return rec.status, rec.result()
+}
+
+// serveStep calls the handler of a step, recovering from a panic (a scenario
+// runs without the recover middleware) which is then returned.
+func serveStep(h http.Handler, w http.ResponseWriter, r *http.Request) (msg string, panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			msg, panicked = fmt.Sprint(v), true
+		}
+	}()
+	h.ServeHTTP(w, r)
+
+	return "", false
+}
+
+// writeScenarioRun writes the status of a scenario run, as JSON if the
+// request accepts it.
+func writeScenarioRun(w http.ResponseWriter, r *http.Request, status int, sr *scenarioRun) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Scenario *scenarioRun `json:"scenario"`
+		}{sr})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if sr == nil {
+		_, _ = fmt.Fprintln(w, "No scenario run")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Scenario %s (%s): %s, elapsed %s, started %s by %s\n", sr.ID, sr.Name, sr.State,
+		sr.Elapsed, sr.Started.Format(time.RFC3339), sr.User)
+	for i, st := range sr.Steps {
+		mark := "    "
+		switch {
+		case i < len(sr.Results):
+			mark = "done"
+		case i == len(sr.Results) && (sr.State == "running" || sr.State == "paused"):
+			mark = "next"
+		}
+		_, _ = fmt.Fprintf(w, "\t[%s] %d: %s\n", mark, i+1, st)
+		if i < len(sr.Results) {
+			res := sr.Results[i]
+			_, _ = fmt.Fprintf(w, "\t       %s status=%d %s\n", res.Time.Format(time.RFC3339), res.Status, res.Result)
+		}
+	}
+}
+
+// scenarioHandler is an HTTP handler that is used on the `/_/scenario` path:
+// `POST` starts the scenario in the body (YAML or JSON), or pauses or
+// resumes the running one with the `action` query param (`pause` or
+// `resume`), `GET` returns the status of the last run and `DELETE` aborts
+// the running one.
+func scenarioHandler(sm *scenarioManager, logger *slog.Logger, exec stepExecutor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqLogger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+		if !ok {
+			reqLogger = slog.New(slog.DiscardHandler)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeScenarioRun(w, r, http.StatusOK, sm.status())
+			return
+		case http.MethodDelete:
+			if _, err := sm.control("abort"); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			reqLogger.Warn("Scenario aborted")
+			writeScenarioRun(w, r, http.StatusOK, sm.status())
+			return
+		}
+
+		if action := r.URL.Query().Get("action"); len(action) > 0 {
+			if _, err := sm.control(action); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, errNoScenario) {
+					status = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			reqLogger.Info("Scenario control", "action", action)
+			writeScenarioRun(w, r, http.StatusOK, sm.status())
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read the scenario: %v", err), http.StatusBadRequest)
+			return
+		}
+		sc, err := parseScenario(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, ok := r.Context().Value(userKey).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		if err := sm.start(logger, sc, user, exec); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeScenarioRun(w, r, http.StatusAccepted, sm.status())
+	})
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScenario(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "yaml sorted by offset",
+			in: `name: outage
+steps:
+  - at: t+2m
+    action: chaos_clear
+  - at: 30s
+    action: chaos
+    args: {action: status, status: 503, probability: 0.5}
+  - at: 0s
+    action: log
+    args: {message: start}
+`,
+			want: []string{
+				"t+0s log message=start",
+				"t+30s chaos action=status probability=0.5 status=503",
+				"t+2m0s chaos_clear",
+			},
+		},
+		{
+			name: "json with equal offsets kept in order",
+			in:   `{"steps": [{"at": "1s", "action": "cpu"}, {"at": "1s", "action": "cpu_stop"}, {"at": "0s", "action": "bwlimit", "args": {"limit": "1MB"}}]}`,
+			want: []string{"t+0s bwlimit limit=1MB", "t+1s cpu", "t+1s cpu_stop"},
+		},
+		{
+			name: "request",
+			in:   "steps: [{at: 0s, action: request, args: {method: post, path: /_/probes}}]",
+			want: []string{"t+0s request method=post path=/_/probes"},
+		},
+		{name: "empty", in: "", wantErr: "empty scenario"},
+		{name: "no steps", in: "name: x\n", wantErr: "scenario without steps"},
+		{name: "unknown field", in: "steps: [{at: 0s, action: log, when: now}]", wantErr: "invalid scenario"},
+		{name: "unknown action", in: "steps: [{at: 0s, action: explode}]", wantErr: "step 1: explode: unknown action"},
+		{name: "invalid offset", in: "steps: [{at: soon, action: log}]", wantErr: "step 1: soon: invalid offset"},
+		{name: "negative offset", in: "steps: [{at: -1s, action: log}]", wantErr: "invalid offset"},
+		{name: "invalid bandwidth limit", in: "steps: [{at: 0s, action: bwlimit}]", wantErr: "invalid bandwidth limit"},
+		{
+			name:    "request outside of /_/",
+			in:      "steps: [{at: 0s, action: request, args: {method: GET, path: /index.html}}]",
+			wantErr: "requires a method and a /_/ path",
+		},
+		{
+			name:    "every error reported",
+			in:      "steps: [{at: x, action: log}, {at: 0s, action: y}]",
+			wantErr: "step 2: y: unknown action",
+		},
+	}
+	for _, tt := range tests {
+		sc, err := parseScenario([]byte(tt.in))
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, st := range sc.Steps {
+			got = append(got, st.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: steps = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadScenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.yaml")
+	if err := os.WriteFile(path, []byte("name: file\nsteps: [{at: 1s, action: log}]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting string
+		want    string
+		wantErr bool
+	}{
+		{setting: " " + path + " ", want: "file"},
+		{setting: `{"name": "inline", "steps": [{"at": "0s", "action": "log"}]}`, want: "inline"},
+		{setting: "name: lines\nsteps: [{at: 0s, action: log}]", want: "lines"},
+		{setting: filepath.Join(t.TempDir(), "missing.yaml"), wantErr: true},
+	}
+	for _, tt := range tests {
+		sc, err := loadScenario(tt.setting)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadScenario(%q) error = %v, want error %v", tt.setting, err, tt.wantErr)
+			continue
+		}
+		if err == nil && sc.Name != tt.want {
+			t.Errorf("loadScenario(%q) = %s, want %s", tt.setting, sc.Name, tt.want)
+		}
+	}
+}
+
+func TestExecScenarioStep(t *testing.T) {
+	s, err := New(DefaultConfig(), WithLogHandler(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.builtins["/_/boom"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	logger := slog.New(slog.DiscardHandler)
+
+	tests := []struct {
+		name       string
+		step       scenarioStep
+		wantStatus int
+		wantResult string
+	}{
+		{
+			name:       "log",
+			step:       scenarioStep{Action: "log", Args: map[string]string{"message": "hello"}},
+			wantStatus: http.StatusOK,
+			wantResult: "hello",
+		},
+		{
+			name:       "request",
+			step:       scenarioStep{Action: "request", Args: map[string]string{"method": "GET", "path": "/_/version"}},
+			wantStatus: http.StatusOK,
+			wantResult: "Version:",
+		},
+		{
+			name:       "HEAD allowed with GET",
+			step:       scenarioStep{Action: "request", Args: map[string]string{"method": "HEAD", "path": "/_/version"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "method not allowed",
+			step:       scenarioStep{Action: "request", Args: map[string]string{"method": "DELETE", "path": "/_/version"}},
+			wantStatus: http.StatusMethodNotAllowed,
+			wantResult: "method DELETE not allowed",
+		},
+		{
+			name:       "unknown endpoint",
+			step:       scenarioStep{Action: "request", Args: map[string]string{"method": "GET", "path": "/_/nothing"}},
+			wantStatus: http.StatusNotFound,
+			wantResult: "/_/nothing: unknown endpoint",
+		},
+		{
+			name:       "panic",
+			step:       scenarioStep{Action: "request", Args: map[string]string{"method": "GET", "path": "/_/boom"}},
+			wantStatus: http.StatusInternalServerError,
+			wantResult: "panic: boom",
+		},
+		{
+			name:       "invalid bandwidth limit",
+			step:       scenarioStep{Action: "bwlimit", Args: map[string]string{"limit": "fast"}},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		status, result := s.execScenarioStep(logger, tt.step)
+		if status != tt.wantStatus || !strings.Contains(result, tt.wantResult) {
+			t.Errorf("%s: execScenarioStep() = %d %q, want %d %q", tt.name, status, result, tt.wantStatus, tt.wantResult)
+		}
+	}
+}
+
+func TestScenarioRun(t *testing.T) {
+	sc, err := parseScenario([]byte("steps: [{at: 0s, action: log}, {at: 20ms, action: log}, {at: 1h, action: log}]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sm scenarioManager
+	exec := func(logger *slog.Logger, st scenarioStep) (int, string) { return http.StatusOK, "done" }
+	logger := slog.New(slog.DiscardHandler)
+	if err := sm.start(logger, sc, "test", exec); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.start(logger, sc, "test", exec); err == nil {
+		t.Errorf("second start: expected an error while the first run is in progress")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sm.status().Results) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := sm.control("abort"); err != nil {
+		t.Fatal(err)
+	}
+	sr := sm.status()
+	if len(sr.Results) != 2 || sr.State != "aborted" {
+		t.Errorf("run %s with %d results, want aborted with 2", sr.State, len(sr.Results))
+	}
+}
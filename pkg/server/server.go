@@ -2,13 +2,16 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "embed"
@@ -17,145 +20,368 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-isatty"
+	"github.com/quic-go/quic-go"
 )
 
 const defaultVersion = "0.0.0-dev"
 
-// Config holds the configuration for the server.
-type Config struct {
-	// Listen is the address (host:port) on which the server should listen.
-	Listen string
+// liveState holds the settings which can be changed while the server is
+// running. It is replaced as a whole (atomically) when the configuration is
+// reloaded, each request uses a single consistent snapshot.
+type liveState struct {
+	config  Config
+	auth    *authenticator
+	proxies trustedProxies
+	limiter *rateLimiter
 
-	// StaticDir is the directory from which to serve static files.
-	StaticDir string
-
-	// BwLimit limits the read and write bandwidth (each, not combined) of
-	// the entire server. A string like `2m, 2mb, 2M or 2MB`, all meaning
-	// 2 megabytes per second.
-	BwLimit string
-
-	// Username for HTTP basic authentication. Empty string disables authentication.
-	Username string
-
-	// Password for HTTP basic authentication.
-	Password string
-
-	// Version is the version string of this web server app.
-	Version string
+	crashOnPanic bool
+	health       healthThresholds
+	allocLimit   uint64
 }
 
+// shutdownTimeout is how long ServeContext waits for the requests in progress
+// to finish once its context is done.
+const shutdownTimeout = 10 * time.Second
+
 // Server represents the web server instance.
 type Server struct {
 	config    Config
 	limit     bwlimit.Byte
 	logger    *slog.Logger
+	logLevel  *slog.LevelVar
 	teeLogger *TeeLogHandler
-	httpSrv   *http.Server
-	listener  net.Listener
-	startTime time.Time
+	state     atomic.Pointer[liveState]
+	tlsConfig *tls.Config
+	listeners []*serverListener
+	ready     chan struct{}
+	started   atomic.Bool
+	// startupDone is set once the server is serving (after the scenario of
+	// the configuration started) or Handler was called, see the `startup`
+	// health check.
+	startupDone atomic.Bool
+	startTime   time.Time
+	metrics     *requestMetrics
+	health      *healthRegistry
+	loadgen     loadgenManager
+	allocs      allocRegistry
+	leak        memLeak
+	cpu         cpuBurner
+	disk        diskManager
+	crash       crasher
+	chaos       chaosRules
+	resLeaks    resourceLeaks
+	scenarios   scenarioManager
+	peers       *peerManager
+
+	// scenario is the scenario of the configuration, run on start.
+	scenario *scenario
+	// builtins are the handlers of the built-in endpoints (with only the
+	// check of the methods as middleware), called by the scenarios.
+	builtins map[string]http.Handler
+
+	// endpoints are the built-in and the registered endpoints. Once
+	// sealed (by Handler or serving) no more endpoints can be registered.
+	endpointsMu sync.Mutex
+	endpoints   []endpoint
+	sealed      bool
+
+	loader     ConfigLoader
+	configPath string
+	reloadMu   sync.Mutex
 }
 
-// New creates a new Server instance with the given configuration.
-func New(config Config) (*Server, error) {
+// New creates a new Server instance with the given configuration, changed by
+// the options (if any). See also DefaultConfig.
+func New(config Config, opts ...Option) (*Server, error) {
+	o := serverOptions{config: config}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	config = o.config
+
 	config.Version = strings.TrimSpace(config.Version)
 	if len(config.Version) == 0 {
 		// Set default version if not provided.
 		config.Version = strings.TrimSpace(defaultVersion)
 	}
 
-	// Validate configuration.
-	if config.Listen == "" {
-		return nil, fmt.Errorf("listen address cannot be empty")
+	// Validate and parse the configuration.
+	parsed, err := config.parse()
+	if err != nil {
+		return nil, err
 	}
-	if config.StaticDir == "" {
-		return nil, fmt.Errorf("static directory cannot be empty")
+
+	s := &Server{
+		config:    config,
+		limit:     parsed.limit,
+		logLevel:  new(slog.LevelVar),
+		tlsConfig: parsed.tlsConfig,
+		ready:     make(chan struct{}),
+		startTime: time.Now(),
+		metrics:   newRequestMetrics(),
+		health:    newHealthRegistry(),
+		resLeaks:  newResourceLeaks(),
+		scenario:  parsed.scenario,
+		builtins:  make(map[string]http.Handler),
 	}
+	for _, spec := range parsed.listeners {
+		s.listeners = append(s.listeners, &serverListener{spec: spec})
+	}
+	s.state.Store(&liveState{
+		config:       config,
+		auth:         parsed.auth,
+		proxies:      parsed.proxies,
+		limiter:      parsed.limiter,
+		crashOnPanic: parsed.crashOnPanic,
+		health:       parsed.health,
+		allocLimit:   parsed.allocLimit,
+	})
 
-	// Parse the bandwidth limit.
-	limit := 2 * bwlimit.GB
-	if len(config.BwLimit) > 0 && config.BwLimit != "0" {
-		x, err := humanize.ParseBytes(config.BwLimit)
-		if err != nil {
-			return nil, fmt.Errorf("invalid bandwidth limit '%s': %w", config.BwLimit, err)
-		}
-		limit = bwlimit.Byte(int(x))
+	// Set up the tee log handler.
+	s.logLevel.Set(parsed.logLevel)
+	logHandler := o.logHandler
+	if logHandler == nil {
+		logHandler = tint.NewHandler(os.Stderr, &tint.Options{
+			NoColor:    !isatty.IsTerminal(os.Stderr.Fd()),
+			Level:      s.logLevel,
+			TimeFormat: time.DateTime,
+		})
 	}
+	s.teeLogger = NewTeeLogHandler(logHandler)
+	s.logger = slog.New(s.teeLogger)
+	s.peers = newPeerManager(parsed.peers, s.logger)
 
-	s := &Server{
-		config: config,
-		limit:  limit,
+	s.registerBuiltinHealthChecks()
+	for _, rt := range s.builtinRoutes() {
+		if err := s.addRoute(rt); err != nil {
+			return nil, err
+		}
+		s.builtins[rt.path] = methodsMidd(rt.methods)(rt.handler)
 	}
 
 	return s, nil
 }
 
-// Serve initializes and starts the server. Will block if the server starts
-// successfully.
+// Serve starts the server on the configured (or socket activated) listeners.
+// Will block if the server starts successfully, until all the listeners are
+// closed or one of them fails.
 func (s *Server) Serve() error {
-	s.startTime = time.Now()
-	// Create listener with bandwidth limiting.
-	ln, err := net.Listen("tcp", s.config.Listen)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
-	}
-	s.listener = bwlimit.NewListener(ln, s.limit, s.limit)
+	return s.serve(context.Background(), nil)
+}
 
-	// Set up the tee log handler.
-	s.teeLogger = NewTeeLogHandler(tint.NewHandler(os.Stderr, &tint.Options{
-		NoColor:    !isatty.IsTerminal(os.Stderr.Fd()),
-		Level:      slog.LevelDebug,
-		TimeFormat: time.DateTime,
-	}))
-	s.logger = slog.New(s.teeLogger)
+// ServeContext is like Serve, but it gracefully shuts down the server once
+// `ctx` is done. Returns nil after a graceful shutdown.
+func (s *Server) ServeContext(ctx context.Context) error {
+	return s.serve(ctx, nil)
+}
 
-	// Create a new ServeMux for this server instance.
-	mux := http.NewServeMux()
+// ServeListener is like Serve, but it serves all the endpoints only on `ln`
+// instead of the configured listeners. The bandwidth limit applies and if TLS
+// is configured then `ln` serves HTTPS.
+func (s *Server) ServeListener(ln net.Listener) error {
+	return s.serve(context.Background(), []net.Listener{ln})
+}
 
-	// Create a file server handler to serve static files.
-	fs := http.FileServer(http.Dir(s.config.StaticDir))
+// serve opens the listeners (or uses `lns` if not nil) and serves until all
+// the listeners are closed, one of them fails or `ctx` is done.
+func (s *Server) serve(ctx context.Context, lns []net.Listener) error {
+	if !s.started.CompareAndSwap(false, true) {
+		return fmt.Errorf("server already started")
+	}
+
+	if lns != nil {
+		s.listeners = nil
+		for i, ln := range lns {
+			s.listeners = append(s.listeners, &serverListener{
+				spec: listenerSpec{
+					name:      fmt.Sprintf("listener-%d", i+1),
+					network:   ln.Addr().Network(),
+					address:   ln.Addr().String(),
+					tls:       s.tlsConfig != nil,
+					endpoints: []string{groupAll},
+				},
+				inherited: ln,
+			})
+		}
+	} else {
+		// Use the listeners passed by socket activation, if any.
+		inherited, err := inheritedListeners()
+		if err != nil {
+			return err
+		}
+		s.assignInherited(inherited)
+	}
 
-	// Serve static files.
-	mux.Handle("/", loggingMidd(s.logger, fs))
+	// Open all the listeners, with bandwidth limiting.
+	for i, l := range s.listeners {
+		if err := l.listen(s.limit, s.tlsConfig); err != nil {
+			for _, opened := range s.listeners[:i] {
+				opened.closeSockets()
+			}
+			return err
+		}
+	}
+	close(s.ready)
 
-	// Add HTTP handlers for the custom paths supported by the server.
-	mux.Handle("/_/version", loggingMidd(s.logger, displayVer(s.config.Version)))
-	mux.Handle("/_/stats", loggingMidd(s.logger, displayStats(s.startTime)))
-	mux.Handle("/_/echo", loggingMidd(s.logger, reqDump()))
+	if len(s.config.AddrFile) > 0 {
+		if err := s.writeAddrFile(); err != nil {
+			for _, l := range s.listeners {
+				l.closeSockets()
+			}
+			return err
+		}
+		defer func() { _ = os.Remove(s.config.AddrFile) }()
+	}
 
-	// Configure authenticated endpoints if credentials are provided.
 	if len(s.config.Username) > 0 {
-		username := s.config.Username
-		password := s.config.Password
+		s.logger.Info("HTTP Basic authentication credentials", "username", s.config.Username,
+			"password", s.config.Password)
+	}
 
-		s.logger.Info("HTTP Basic authentication credentials", "username", username,
-			"password", password)
+	// Create a ServeMux and the HTTP server(s) for each listener, with
+	// the endpoints selected for it.
+	for _, l := range s.listeners {
+		l.setupHTTP(s.newMux(l.spec.serves), s.tlsConfig)
+	}
 
-		mux.Handle("/_/env", loggingMidd(s.logger, basicAuth(displayEnv(), username, password)))
-		mux.Handle("/_/logs", loggingMidd(s.logger, basicAuth(displayLogs(s.teeLogger), username, password)))
-		mux.Handle("/_/crash", loggingMidd(s.logger, basicAuth(shouldCrash(), username, password)))
-		mux.Handle("/_/alloc", loggingMidd(s.logger, basicAuth(allocMemoryHandler(), username, password)))
-		mux.Handle("/_/upload", loggingMidd(s.logger, basicAuth(uploadHandler(filepath.Join(s.config.StaticDir, "_", "uploads")), username, password)))
-	} else {
-		mux.Handle("/_/env", loggingMidd(s.logger, displayEnv()))
-		mux.Handle("/_/logs", loggingMidd(s.logger, displayLogs(s.teeLogger)))
-		mux.Handle("/_/crash", loggingMidd(s.logger, shouldCrash()))
-		mux.Handle("/_/alloc", loggingMidd(s.logger, allocMemoryHandler()))
-		mux.Handle("/_/upload", loggingMidd(s.logger, uploadHandler(filepath.Join(s.config.StaticDir, "_", "uploads"))))
+	// Reload the configuration on SIGHUP and on config file changes.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.loader != nil {
+		s.watchReloadTriggers(ctx)
+	}
+
+	// Crash if requested for this start.
+	s.crashOnStart()
+
+	// Run the scenario of the configuration, if any.
+	if s.scenario != nil {
+		if err := s.scenarios.start(s.logger, s.scenario, "config", s.execScenarioStep); err != nil {
+			s.logger.Error("Failed to start the scenario", "error", err)
+		}
 	}
 
-	// Create HTTP server.
-	s.httpSrv = &http.Server{
-		Handler: mux,
+	s.startupDone.Store(true)
+
+	// Discover and probe the peers.
+	if s.peers.config.enabled() {
+		port, scheme := s.peerPort()
+		go s.peers.run(ctx, port, scheme)
 	}
 
 	// Log startup message.
-	s.logger.Info("Starting server", "version", s.config.Version, "address", s.config.Listen,
-		"static_dir", s.config.StaticDir, "bandwidth_limit", humanize.Bytes(uint64(s.limit)))
+	s.logger.Info("Starting server", "version", s.config.Version, "static_dir", s.config.StaticDir,
+		"bandwidth_limit", humanize.Bytes(uint64(s.limit)), "listeners", len(s.listeners))
+	for _, l := range s.listeners {
+		s.logger.Info("Listening", "listener", l.spec.name, "network", l.spec.network,
+			"address", l.ln.Addr().String(), "inherited", l.inherited != nil, "tls", l.spec.tls,
+			"h2c", l.spec.h2c, "http3", l.pc != nil,
+			"bandwidth_limit", humanize.Bytes(uint64(l.bw.Limit())),
+			"endpoints", strings.Join(l.spec.endpoints, "+"))
+	}
+
+	// Gracefully shut down once the context is done.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
 
-	// Start serving (blocking call).
-	if err := s.httpSrv.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		s.logger.Info("Shutting down server", "timeout", shutdownTimeout)
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(sctx); err != nil {
+			s.logger.Warn("Graceful shutdown failed, closing all connections", "error", err)
+			for _, l := range s.listeners {
+				l.close()
+			}
+		}
+	}()
+
+	// Start serving (blocking until all the listeners are done).
+	errs := make(chan error, 2*len(s.listeners))
+	servers := 0
+	for _, l := range s.listeners {
+		l.serve(errs)
+		servers += l.servers()
+	}
+
+	var serveErr error
+	for range servers {
+		err := <-errs
+		if err == nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, quic.ErrServerClosed) ||
+			serveErr != nil {
+			continue
+		}
+		// One of the listeners failed, stop all the others.
 		s.logger.Error("Server error", "error", err)
-		return fmt.Errorf("server error: %w", err)
+		serveErr = fmt.Errorf("server error: %w", err)
+		for _, l := range s.listeners {
+			l.close()
+		}
+	}
+
+	// Wait for the graceful shutdown (if any) to finish.
+	close(done)
+	<-stopped
+
+	return serveErr
+}
+
+// Ready returns a channel which is closed once the server is listening.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address of the (first) listener of the server, or nil if
+// the server isn't listening yet.
+func (s *Server) Addr() net.Addr {
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return addrs[0]
+}
+
+// Addrs returns the addresses of all the listeners of the server, or nil if
+// the server isn't listening yet.
+func (s *Server) Addrs() []net.Addr {
+	select {
+	case <-s.ready:
+	default:
+		return nil
+	}
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.ln.Addr())
+	}
+
+	return addrs
+}
+
+// writeAddrFile writes the addresses of the listeners to the address file,
+// one per line. The file is replaced atomically such that readers never see
+// a partially written file.
+func (s *Server) writeAddrFile() error {
+	var b strings.Builder
+	for _, a := range s.Addrs() {
+		_, _ = fmt.Fprintln(&b, a.String())
+	}
+
+	tmp := s.config.AddrFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write address file: %w", err)
+	}
+	if err := os.Rename(tmp, s.config.AddrFile); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write address file: %w", err)
 	}
 
 	return nil
@@ -163,10 +389,16 @@ func (s *Server) Serve() error {
 
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown(ctx context.Context) error {
-	if s.httpSrv != nil {
-		return s.httpSrv.Shutdown(ctx)
+	s.loadgen.stop()
+	s.disk.halt("")
+	s.scenarios.halt()
+
+	var errs []error
+	for _, l := range s.listeners {
+		errs = append(errs, l.shutdown(ctx))
 	}
-	return nil
+
+	return errors.Join(errs...)
 }
 
 // Logger returns the server's logger instance.